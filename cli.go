@@ -2,29 +2,95 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 
-	"bufio"
 	"github.com/spf13/cobra"
-	"github.com/tidwall/gjson"
 	"gopkg.in/yaml.v3"
-	"strings"
 	"time"
+	"ubuntuhive.tech/gonovella/internal/audit"
+	"ubuntuhive.tech/gonovella/internal/batch"
+	"ubuntuhive.tech/gonovella/internal/cache"
+	"ubuntuhive.tech/gonovella/internal/chat"
+	"ubuntuhive.tech/gonovella/internal/convert"
+	"ubuntuhive.tech/gonovella/internal/fetch"
+	"ubuntuhive.tech/gonovella/internal/logging"
+	"ubuntuhive.tech/gonovella/internal/openapi"
+	"ubuntuhive.tech/gonovella/internal/prompt"
+	"ubuntuhive.tech/gonovella/internal/upstream"
+	"ubuntuhive.tech/gonovella/internal/usage"
+	"ubuntuhive.tech/gonovella/internal/validate"
+)
+
+const (
+	model     = "gpt-4o"
+	maxTokens = 4096
+	maxImages = 8
 )
 
 var (
-	apiURL     = "https://api.openai.com/v1/chat/completions" // replace with actual endpoint
-	apiKey     = os.Getenv("OPENAI_API_KEY")
-	yamlInput  string
-	jsonOutput string
-	imagePath  string
-	prompt     string
-	rootCmd    *cobra.Command
+	apiURL         = "https://api.openai.com/v1/chat/completions" // replace with actual endpoint
+	apiKey         = os.Getenv("OPENAI_API_KEY")
+	yamlInput      string
+	jsonOutput     string
+	imagePath      string
+	promptText     string
+	cacheKind      string
+	cacheDir       string
+	cacheTTL       time.Duration
+	noCache        bool
+	upstreamConfig string
+	priceTable     string
+	logLevel       string
+	logFormat      string
+	auditFile      string
+	auditSince     string
+	auditUntil     string
+	auditKey       string
+	auditOutcome   string
+	auditFormat    string
+	auditOutput    string
+	convertFrom    string
+	convertTo      string
+	convertIndent  int
+	convertCompact bool
+	validateSchema string
+	validateFrom   string
+	validateFormat string
+	openapiOutput  string
+	openapiTo      string
+	openapiFormat  string
+	openapiStrict  bool
+	promptFile     string
+	batchPrompt    string
+	batchWorkers   int
+	batchRate      int
+	checkpointFile string
+	batchOutput    string
+	batchSidecar   string
+	templateName   string
+	templateFile   string
+	promptVars     []string
+	systemPrompt   string
+	fewShot        []string
+	chatModel      string
+	transcriptFile string
+	imageFlags     []string
+	rootCmd        *cobra.Command
 )
 
 func init() {
@@ -33,6 +99,9 @@ func init() {
 		Short: "Utilities for common tasks",
 		Long:  "Utilities to streamline common tasks like converting file formats, validating data, and extracting information from images.",
 	}
+	rootCmd.PersistentPreRunE = setupLogging
+	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", os.Getenv("LOG_LEVEL"), "Minimum level of diagnostics on stderr (debug, info, warn, error)")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", os.Getenv("LOG_FORMAT"), "Format of diagnostics on stderr (text or json)")
 
 	// Convert Yaml to JSON command
 	y2jCmd := &cobra.Command{
@@ -42,31 +111,203 @@ func init() {
 		RunE:  convertYamlToJson,
 	}
 
+	// Convert between JSON, YAML, TOML, CUE and NDJSON command
+	convertCmd := &cobra.Command{
+		Use:   "convert [input] [output]",
+		Short: "Convert between JSON, YAML, TOML, CUE and NDJSON",
+		Long: `Convert a document between JSON, YAML, TOML, CUE and NDJSON in any direction.
+
+Formats are inferred from the file extensions; use --from and --to for
+standard input and output, which are read and written when a file is "-"
+or omitted. Key order is kept, and comments too when the target format has
+them. A multi-document YAML stream converts to a JSON stream or NDJSON, and
+a JSON array converts to NDJSON one element per line.`,
+		Args: cobra.MaximumNArgs(2),
+		RunE: convertFile,
+	}
+
+	// Validate data files against a CUE definition command
+	validateCmd := &cobra.Command{
+		Use:   "validate --schema file.cue#Definition [files...]",
+		Short: "Validate JSON, YAML and NDJSON files against a CUE definition",
+		Long: `Validate every document of the given files against a CUE definition.
+
+Files may be glob patterns, and "-" or no file at all reads standard input,
+whose format is given with --from. Each failing path is reported with its
+line and column. The command exits non-zero when any document is invalid.`,
+		RunE: validateFiles,
+	}
+
+	// OpenAPI spec commands
+	openapiCmd := &cobra.Command{
+		Use:   "openapi",
+		Short: "Generate and lint OpenAPI specs",
+	}
+	openapiGenCmd := &cobra.Command{
+		Use:   "gen [files.cue...]",
+		Short: "Generate an OpenAPI spec from CUE sources",
+		Long: `Generate a complete OpenAPI spec from CUE sources.
+
+Definitions become components.schemas, with descriptions from their
+comments. Regular fields are the rest of the spec: info, servers, tags,
+security, paths and further components. A $ref may name a schema,
+e.g. $ref: "ImageUpload", instead of spelling out #/components/schemas.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: generateOpenAPI,
+	}
+	openapiLintCmd := &cobra.Command{
+		Use:   "lint [spec]",
+		Short: "Lint an OpenAPI spec",
+		Long: `Lint an OpenAPI spec in JSON or YAML, read from standard input when the
+spec is "-" or omitted.
+
+Reports missing descriptions, unused components, $refs that do not
+resolve and id properties whose pattern is not a UUID. The command exits
+non-zero on errors, and on warnings too with --strict.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: lintOpenAPI,
+	}
+	openapiCmd.AddCommand(openapiGenCmd, openapiLintCmd)
+
 	// Get Info from image command
 	imgiCmd := &cobra.Command{
 		Use:   "imgi [input.webp] [prompt]",
 		Short: "Extract info from image",
-		Args:  cobra.ExactArgs(2),
-		RunE:  getInfoFromImage,
+		Long: `Extract info from an image with a prompt, or with a prompt template.
+
+Images may be files, file:// URLs or http(s):// URLs. To ask about
+several images at once, such as before and after shots or the pages of a
+receipt, give each with --image instead of the input argument. An image
+may be labelled as --image file=label or --image url#label; the label
+names it in the request, after its number, so the prompt can refer to it.
+
+Templates are text/template files whose body renders the prompt and whose
+optional {{define "system"}} block renders the system prompt. They see
+.Prompt, the prompt given along with the template, .Vars from --var flags,
+.File (Path, Name, Base, Ext and Dir of the image), .EXIF (Make, Model,
+DateTimeOriginal, GPSLatitude, ...) of the first image, .Images, the
+number of images, and .Labels. The library has the
+templates describe, alt-text, ocr, tag and compare; use --template with
+one of their names, or --prompt-template with a file of your own.`,
+		Args: cobra.MaximumNArgs(2),
+		RunE: getInfoFromImage,
 	}
 
+	// Get Info from every image of directories or globs command
+	imgiBatchCmd := &cobra.Command{
+		Use:   "batch [dir|glob|file...]",
+		Short: "Extract info from many images in parallel",
+		Long: `Extract info from every image under the given directories, glob patterns
+and files, on a pool of workers.
+
+Processed images are recorded in a checkpoint file keyed by the SHA-256 of
+image and prompt, so an interrupted run resumes where it stopped and
+images seen before, under any name, are skipped. Results are appended to
+an NDJSON file, and with --sidecar also written next to each image.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: getInfoFromImages,
+	}
+	imgiCmd.AddCommand(imgiBatchCmd)
+
 	// Get Info from image streaming command
 	imgiStreamingCmd := &cobra.Command{
 		Use:   "imgi-streaming [input.webp] [prompt]",
 		Short: "Extract info from image using streaming",
-		Args:  cobra.ExactArgs(2),
+		Long:  "Extract info from an image like imgi does, printing the answer as it arrives.",
+		Args:  cobra.MaximumNArgs(2),
 		RunE:  getInfoFromImageStreaming,
 	}
 
+	// Chat about an image command
+	chatCmd := &cobra.Command{
+		Use:   "chat [image]",
+		Short: "Chat about an image, with follow-up questions",
+		Long: `Ask about an image, then keep asking follow-up questions in the same
+conversation. The image is sent once, with the first question, and the
+answers stream as they arrive.
+
+The conversation is saved as a JSON transcript after every answer, next
+to the image as image.ext.chat.json unless --transcript says otherwise,
+and picked up again when the same transcript is opened. Type /help in the
+chat for its commands: /image add, /model, /save, /load and /quit.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: chatAboutImage,
+	}
+
+	// Audit log commands
+	auditCmd := &cobra.Command{
+		Use:   "audit",
+		Short: "Inspect the audit log of extraction requests",
+	}
+	auditQueryCmd := &cobra.Command{
+		Use:   "query",
+		Short: "Filter the audit log and export it as NDJSON or CSV",
+		Args:  cobra.NoArgs,
+		RunE:  queryAuditLog,
+	}
+	auditCmd.AddCommand(auditQueryCmd)
+
 	// Flags
 	imgiStreamingCmd.Flags().StringVarP(&imagePath, "imagePath", "i", "", "Image file path")
-	imgiStreamingCmd.Flags().StringVarP(&prompt, "prompt", "p", "", "Prompt for the image")
+	imgiStreamingCmd.Flags().StringVarP(&promptText, "prompt", "p", "", "Prompt for the image")
 	imgiCmd.Flags().StringVarP(&imagePath, "imagePath", "i", "", "Image file path")
-	imgiCmd.Flags().StringVarP(&prompt, "prompt", "p", "", "Prompt for the image")
+	imgiCmd.Flags().StringVarP(&promptText, "prompt", "p", "", "Prompt for the image")
+	imgiBatchCmd.Flags().StringVarP(&batchPrompt, "prompt", "p", "Describe the image.", "Prompt for every image")
+	imgiBatchCmd.Flags().StringVar(&promptFile, "prompt-file", "", "File holding the prompt, instead of --prompt")
+	imgiBatchCmd.Flags().IntVar(&batchWorkers, "concurrency", 4, "Images processed in parallel")
+	imgiBatchCmd.Flags().IntVar(&batchRate, "rate", 0, "Upstream calls allowed per minute across all workers (0 for no limit)")
+	imgiBatchCmd.Flags().StringVar(&checkpointFile, "checkpoint", "imgi-batch.checkpoint", "Checkpoint file of processed images (empty to process everything)")
+	imgiBatchCmd.Flags().StringVarP(&batchOutput, "output", "o", "-", "NDJSON file results are appended to (defaults to stdout)")
+	imgiBatchCmd.Flags().StringVar(&batchSidecar, "sidecar", "", "Also write each result next to its image as image.ext.md or image.ext.json (md or json)")
+	chatCmd.Flags().StringVar(&transcriptFile, "transcript", "", "Transcript file to continue and save to (defaults to image.ext.chat.json)")
+	chatCmd.Flags().StringVar(&chatModel, "model", "", "Model to ask, instead of those of the upstream routes")
+	chatCmd.Flags().StringVar(&systemPrompt, "system", "", "System prompt of a new conversation, or @file to read it")
+	chatCmd.Flags().StringVar(&upstreamConfig, "upstream-config", os.Getenv("UPSTREAM_CONFIG"), "YAML file listing fallback provider/model routes")
+	chatCmd.Flags().StringVar(&priceTable, "prices", os.Getenv("PRICE_TABLE"), "YAML file of token prices per model")
+	for _, cmd := range []*cobra.Command{imgiCmd, imgiStreamingCmd, imgiBatchCmd} {
+		cmd.Flags().StringVar(&templateName, "template", "", "Library prompt template ("+strings.Join(prompt.Names(), ", ")+")")
+		cmd.Flags().StringVar(&templateFile, "prompt-template", "", "Prompt template file (text/template)")
+		cmd.MarkFlagsMutuallyExclusive("template", "prompt-template")
+		cmd.Flags().StringArrayVar(&promptVars, "var", nil, "Template variable as name=value, repeatable")
+		cmd.Flags().StringVar(&systemPrompt, "system", "", "System prompt, or @file to read it, replacing the template's")
+		cmd.Flags().StringArrayVar(&fewShot, "example", nil, "Few-shot example as image=answer, or image=@file to read the answer, repeatable")
+		if cmd != imgiBatchCmd {
+			cmd.Flags().StringArrayVar(&imageFlags, "image", nil, "Image file or URL to ask about, labelled as file=label or url#label, repeatable (up to 8)")
+		}
+		cmd.Flags().StringVar(&cacheKind, "cache", "disk", "Result cache backend (disk, memory or off)")
+		cmd.Flags().StringVar(&cacheDir, "cache-dir", "", "Result cache directory (defaults to the user cache dir)")
+		cmd.Flags().DurationVar(&cacheTTL, "cache-ttl", 24*time.Hour, "How long cached results stay valid")
+		cmd.Flags().BoolVar(&noCache, "no-cache", false, "Ignore cached results and ask the model again")
+		cmd.Flags().StringVar(&upstreamConfig, "upstream-config", os.Getenv("UPSTREAM_CONFIG"), "YAML file listing fallback provider/model routes")
+		cmd.Flags().StringVar(&priceTable, "prices", os.Getenv("PRICE_TABLE"), "YAML file of token prices per model")
+	}
+	auditFile = os.Getenv("AUDIT_LOG")
+	if auditFile == "" || auditFile == "off" {
+		auditFile = "audit.log"
+	}
+	auditQueryCmd.Flags().StringVarP(&auditFile, "file", "f", auditFile, "Audit log file; rotated files next to it are read too")
+	auditQueryCmd.Flags().StringVar(&auditSince, "since", "", "Only entries from this time on (RFC 3339, YYYY-MM-DD or a duration such as 24h ago)")
+	auditQueryCmd.Flags().StringVar(&auditUntil, "until", "", "Only entries before this time (same formats as --since)")
+	auditQueryCmd.Flags().StringVar(&auditKey, "key", "", "Only entries of this API key name")
+	auditQueryCmd.Flags().StringVar(&auditOutcome, "outcome", "", "Only entries with this outcome (ok, cached, replayed, invalid, conflict, overloaded, error)")
+	auditQueryCmd.Flags().StringVar(&auditFormat, "format", "ndjson", "Output format (ndjson or csv)")
+	auditQueryCmd.Flags().StringVarP(&auditOutput, "output", "o", "", "Output file (defaults to stdout)")
+	convertCmd.Flags().StringVar(&convertFrom, "from", "", "Input format (json, yaml, toml, cue or ndjson), inferred from the input extension by default")
+	convertCmd.Flags().StringVar(&convertTo, "to", "", "Output format (json, yaml, toml, cue or ndjson), inferred from the output extension by default")
+	convertCmd.Flags().IntVar(&convertIndent, "indent", 2, "Spaces per indentation level")
+	convertCmd.Flags().BoolVar(&convertCompact, "compact", false, "Write JSON on a single line and YAML in flow style")
+	validateCmd.Flags().StringVarP(&validateSchema, "schema", "s", "", "CUE schema as file.cue#Definition, e.g. contracts/image.cue#ImageUpload")
+	validateCmd.Flags().StringVar(&validateFrom, "from", "", "Input format (json, yaml or ndjson), inferred from the file extensions by default")
+	validateCmd.Flags().StringVar(&validateFormat, "format", "text", "Report format (text, json, junit or github)")
+	validateCmd.MarkFlagRequired("schema")
+	openapiGenCmd.Flags().StringVarP(&openapiOutput, "output", "o", "-", "Output file, JSON or YAML by its extension (defaults to stdout)")
+	openapiGenCmd.Flags().StringVar(&openapiTo, "to", "", "Output format (json or yaml), inferred from the output extension by default")
+	openapiLintCmd.Flags().StringVar(&openapiFormat, "format", "text", "Report format (text, json or github)")
+	openapiLintCmd.Flags().BoolVar(&openapiStrict, "strict", false, "Exit non-zero on warnings too")
 	y2jCmd.Flags().StringVarP(&yamlInput, "yaml", "y", "", "Yaml input file")
 	y2jCmd.Flags().StringVarP(&jsonOutput, "json", "j", "", "Json output file")
 
-	rootCmd.AddCommand(imgiStreamingCmd, imgiCmd, y2jCmd)
+	rootCmd.AddCommand(imgiStreamingCmd, imgiCmd, chatCmd, y2jCmd, convertCmd, validateCmd, openapiCmd, auditCmd)
 }
 
 func main() {
@@ -76,202 +317,831 @@ func main() {
 	}
 }
 
+// setupLogging sends redacted diagnostics to stderr, keeping stdout for results.
+func setupLogging(cmd *cobra.Command, args []string) error {
+	config, err := logging.ConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	config.Format = logFormat
+	if logLevel != "" {
+		if err := config.Level.UnmarshalText([]byte(logLevel)); err != nil {
+			return fmt.Errorf("invalid --log-level: %w", err)
+		}
+	}
+	logger, err := logging.New(os.Stderr, config)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
 func getInfoFromImageStreaming(cmd *cobra.Command, args []string) error {
-	imagePath := args[0]
-	prompt := args[1]
-
-	fmt.Println(fmt.Sprintf("Extracting Info from: %v\n", imagePath))
-	// Load image and encode as base64
-	imageBytes, err := os.ReadFile(imagePath)
-	if err != nil {
-		return fmt.Errorf("Error reading image file: %w", err)
-	}
-	imageBase64 := base64.StdEncoding.EncodeToString(imageBytes)
-
-	requestBody, err := json.Marshal(map[string]any{
-		"model":      "gpt-4o",
-		"max_tokens": 4096,
-		"messages": []map[string]any{
-			{
-				"role": "user",
-				"content": []map[string]any{
-					{
-						"type": "text",
-						"text": prompt,
-					},
-					{
-						"type": "image_url",
-						"image_url": map[string]any{
-							"url": fmt.Sprintf("data:image/webp;base64, %s", imageBase64),
-						},
-					},
-				},
-			},
-		},
-		"stream": true, // Enable streaming
+	images, text, err := readImages(cmd.Context(), args)
+	if err != nil {
+		return err
+	}
+	spec, err := loadPromptSpec(text)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(fmt.Sprintf("Extracting Info from: %v\n", imagePaths(images)))
+	rendered, err := spec.Render(promptData(text, images))
+	if err != nil {
+		return err
+	}
+	chain, err := upstream.LoadChain(upstreamConfig, apiURL, apiKey, model)
+	if err != nil {
+		return err
+	}
+	results, cacheKey, err := openResultCache(chain, imagesKey(images), rendered.Key())
+	if err != nil {
+		return err
+	}
+	if info, ok := lookupResult(results, cacheKey); ok {
+		fmt.Println(info.Text)
+		fmt.Println("\n--- Stream finished (cached) ---")
+		fmt.Printf("Model: %s/%s\n", info.Provider, info.Model)
+		fmt.Println("Usage:", info.Usage)
+		return nil
+	}
+
+	request := upstream.Request{
+		Model:     model,
+		MaxTokens: maxTokens,
+		Messages:  rendered.LabeledMessages(imageURLs(images)...),
+	}
+
+	// Print each chunk of content as it arrives
+	info, err := chain.Stream(cmd.Context(), request, func(content string) error {
+		fmt.Print(content)
+		return nil
 	})
 	if err != nil {
-		return fmt.Errorf("Error marshalling JSON: %w", err)
+		return fmt.Errorf("Error making request: %w", err)
 	}
+	fmt.Println("\n--- Stream finished ---")
+	fmt.Printf("Model: %s/%s\n", info.Provider, info.Model)
+	if err := printUsage(&info); err != nil {
+		return err
+	}
+
+	storeResult(results, cacheKey, info)
+	return nil
+}
 
-	req, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(requestBody))
+func getInfoFromImage(cmd *cobra.Command, args []string) error {
+	images, text, err := readImages(cmd.Context(), args)
+	if err != nil {
+		return err
+	}
+	spec, err := loadPromptSpec(text)
 	if err != nil {
-		return fmt.Errorf("Error creating request: %w", err)
+		return err
 	}
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	fmt.Println(fmt.Sprintf("Extracting Info from: %v\n", imagePaths(images)))
+	rendered, err := spec.Render(promptData(text, images))
+	if err != nil {
+		return err
+	}
+	chain, err := upstream.LoadChain(upstreamConfig, apiURL, apiKey, model)
+	if err != nil {
+		return err
+	}
+	results, cacheKey, err := openResultCache(chain, imagesKey(images), rendered.Key())
+	if err != nil {
+		return err
+	}
+	if info, ok := lookupResult(results, cacheKey); ok {
+		fmt.Println("Response:", info.Text)
+		fmt.Printf("Model: %s/%s\n", info.Provider, info.Model)
+		fmt.Println("Usage:", info.Usage)
+		return nil
+	}
+
+	request := upstream.Request{
+		Model:     model,
+		MaxTokens: maxTokens,
+		Messages:  rendered.LabeledMessages(imageURLs(images)...),
+	}
+
+	response, err := chain.Complete(cmd.Context(), request)
 	if err != nil {
 		return fmt.Errorf("Error making request: %w", err)
 	}
-	defer resp.Body.Close()
+	fmt.Println("Response:", response.Text)
+	fmt.Printf("Model: %s/%s\n", response.Provider, response.Model)
+	if err := printUsage(&response); err != nil {
+		return err
+	}
+
+	storeResult(results, cacheKey, response)
+	return nil
+}
 
-	// Check for non-OK status code
-	if resp.StatusCode != http.StatusOK {
-		respBody, _ := bufio.NewReader(resp.Body).ReadString('\n')
-		fmt.Printf("Non-OK status code: %d\nBody: %s\n", resp.StatusCode, respBody)
-		return fmt.Errorf("Non-OK status code: %d", resp.StatusCode)
+func getInfoFromImages(cmd *cobra.Command, args []string) error {
+	if promptFile != "" {
+		data, err := os.ReadFile(promptFile)
+		if err != nil {
+			return fmt.Errorf("error reading prompt file: %w", err)
+		}
+		batchPrompt = strings.TrimSpace(string(data))
+	} else if !cmd.Flags().Changed("prompt") && (templateName != "" || templateFile != "") {
+		batchPrompt = ""
+	}
+	spec, err := loadPromptSpec(batchPrompt)
+	if err != nil {
+		return err
+	}
+	if batchSidecar != "" && batchSidecar != "md" && batchSidecar != "json" {
+		return fmt.Errorf("unknown sidecar format %q (want md or json)", batchSidecar)
 	}
 
-	// Use bufio to read response line by line
-	scanner := bufio.NewScanner(resp.Body)
-	for scanner.Scan() {
-		line := scanner.Text()
+	files, err := batch.Files(args)
+	if err != nil {
+		return err
+	}
+	results, err := cache.New(cacheKind, 0, cacheDir, cacheTTL)
+	if err != nil {
+		return fmt.Errorf("Error opening result cache: %w", err)
+	}
+	chain, err := upstream.LoadChain(upstreamConfig, apiURL, apiKey, model)
+	if err != nil {
+		return err
+	}
+	prices, err := usage.LoadPrices(priceTable)
+	if err != nil {
+		return err
+	}
 
-		// OpenAI streams each chunk prefixed by "data:"
-		if !strings.HasPrefix(line, "data:") {
-			continue
+	var checkpoint *batch.Checkpoint
+	if checkpointFile != "" {
+		if checkpoint, err = batch.OpenCheckpoint(checkpointFile); err != nil {
+			return err
 		}
+		defer checkpoint.Close()
+	}
+	out := os.Stdout
+	if batchOutput != "-" {
+		if out, err = os.OpenFile(batchOutput, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			return fmt.Errorf("error opening output: %w", err)
+		}
+		defer out.Close()
+	}
 
-		// "data: [DONE]" indicates the end of the stream
-		jsonData := strings.TrimPrefix(line, "data: ")
-		if jsonData == "[DONE]" {
-			fmt.Println("\n--- Stream finished ---")
-			break
+	limiter := batch.NewLimiter(batchRate)
+	process := func(ctx context.Context, job batch.Job) batch.Result {
+		rendered, err := spec.Render(promptData(batchPrompt, []imageFile{{Path: job.Path, Data: job.Image}}))
+		if err != nil {
+			return batch.Result{Error: err.Error()}
+		}
+		key := resultKey(chain, job.Image, rendered.Key())
+		if info, ok := lookupResult(results, key); ok {
+			return batch.Result{Info: info.Text, Model: info.Provider + "/" + info.Model, Usage: &info.Usage, Cached: true}
 		}
+		if err := limiter.Wait(ctx); err != nil {
+			return batch.Result{Error: err.Error()}
+		}
+		request := upstream.Request{
+			Model:     model,
+			MaxTokens: maxTokens,
+			Messages:  rendered.Messages(dataURL(job.Image)),
+		}
+		response, err := chain.Complete(ctx, request)
+		if err != nil {
+			return batch.Result{Error: err.Error()}
+		}
+		prices.Apply(&response.Usage, response.Model)
+		storeResult(results, key, response)
+		return batch.Result{Info: response.Text, Model: response.Provider + "/" + response.Model, Usage: &response.Usage}
+	}
+	emit := func(r batch.Result) error {
+		if r.Error != "" {
+			slog.Warn("image failed", "path", r.Path, "error", r.Error)
+		} else {
+			slog.Info("image processed", "path", r.Path, "cached", r.Cached)
+		}
+		if batchSidecar != "" {
+			if err := batch.WriteSidecar(r, batchSidecar); err != nil {
+				return err
+			}
+		}
+		return batch.WriteNDJSON(out, r)
+	}
 
-		// Parse each chunk using gjson
-		result := gjson.Parse(jsonData)
+	ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	options := batch.Options{Concurrency: batchWorkers, Prompt: spec.Key(batchPrompt), Checkpoint: checkpoint}
+	cmd.SilenceUsage = true
+	summary, err := batch.Run(ctx, files, options, process, emit)
+	slog.Info("batch finished", "files", len(files), "processed", summary.Processed, "skipped", summary.Skipped, "failed", summary.Failed)
+	if errors.Is(err, context.Canceled) {
+		return fmt.Errorf("interrupted; rerun to resume from %s", checkpointFile)
+	}
+	if err != nil {
+		return err
+	}
+	if summary.Failed > 0 {
+		return fmt.Errorf("%d of %d images failed", summary.Failed, len(files))
+	}
+	return nil
+}
 
-		// The relevant content is in "choices" -> array -> "delta" -> "content"
-		// e.g., result.Get("choices.0.delta.content")
-		content := ""
-		for _, choice := range result.Get("choices").Array() {
-			contentDelta := choice.Get("delta.content").String()
-			content += contentDelta
+func chatAboutImage(cmd *cobra.Command, args []string) error {
+	path := transcriptFile
+	if path == "" && len(args) > 0 {
+		path = args[0] + ".chat.json"
+	}
+	if path == "" {
+		return errors.New("an image or --transcript is required")
+	}
+	transcript, err := chat.Load(path)
+	resumed := err == nil
+	if errors.Is(err, fs.ErrNotExist) {
+		transcript = chat.NewTranscript(chatModel)
+		system, err := readArgument(systemPrompt)
+		if err != nil {
+			return err
 		}
-		// Print the chunk of content (if any)
-		if content != "" {
-			fmt.Print(content)
+		if system != "" {
+			transcript.Messages = append(transcript.Messages, upstream.SystemMessage(system))
 		}
+	} else if err != nil {
+		return err
+	} else if chatModel != "" {
+		transcript.Model = chatModel
+	}
 
-		// Sleep for a bit to simulate processing time
-		time.Sleep(100 * time.Millisecond)
+	chain, err := upstream.LoadChain(upstreamConfig, apiURL, apiKey, model)
+	if err != nil {
+		return err
+	}
+	prices, err := usage.LoadPrices(priceTable)
+	if err != nil {
+		return err
+	}
+	session := &chat.Session{
+		Chain:      chain,
+		MaxTokens:  maxTokens,
+		Prices:     prices,
+		Transcript: transcript,
+		Path:       path,
+		In:         os.Stdin,
+		Out:        os.Stdout,
+	}
+	if len(args) > 0 {
+		if err := session.Attach(args[0]); err != nil {
+			return err
+		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("Error reading streamed response body: %w", err)
+	if resumed {
+		fmt.Printf("Continuing %s (%d messages); /help lists the commands.\n", path, len(transcript.Messages))
+	} else {
+		fmt.Println("Ask about the image; /help lists the commands.")
 	}
+	cmd.SilenceUsage = true
+	return session.Run(cmd.Context())
+}
 
-	return nil
+// loadPromptSpec reads the template, variables, system prompt and examples
+// of the imgi commands, which need a prompt or a template.
+func loadPromptSpec(text string) (prompt.Spec, error) {
+	var (
+		spec prompt.Spec
+		err  error
+	)
+	switch {
+	case templateName != "":
+		spec.Template, err = prompt.Named(templateName)
+	case templateFile != "":
+		spec.Template, err = prompt.Load(templateFile)
+	case text == "":
+		err = errors.New("a prompt, --template or --prompt-template is required")
+	case len(promptVars) > 0:
+		err = errors.New("--var needs --template or --prompt-template")
+	}
+	if err != nil {
+		return spec, err
+	}
+
+	spec.Vars = map[string]string{}
+	for _, v := range promptVars {
+		name, value, ok := strings.Cut(v, "=")
+		if !ok || name == "" {
+			return spec, fmt.Errorf("invalid --var %q (want name=value)", v)
+		}
+		spec.Vars[name] = value
+	}
+	if spec.System, err = readArgument(systemPrompt); err != nil {
+		return spec, err
+	}
+	for _, example := range fewShot {
+		path, answer, ok := strings.Cut(example, "=")
+		if !ok || path == "" {
+			return spec, fmt.Errorf("invalid --example %q (want image=answer)", example)
+		}
+		image, err := os.ReadFile(path)
+		if err != nil {
+			return spec, fmt.Errorf("error reading example image: %w", err)
+		}
+		if answer, err = readArgument(answer); err != nil {
+			return spec, err
+		}
+		spec.Examples = append(spec.Examples, prompt.Example{Image: dataURL(image), Answer: answer})
+	}
+	return spec, nil
 }
 
-func getInfoFromImage(cmd *cobra.Command, args []string) error {
-	imagePath := args[0]
-	prompt := args[1]
-
-	fmt.Println(fmt.Sprintf("Extracting Info from: %v\n", imagePath))
-	// Load image and encode as base64
-	imageBytes, err := os.ReadFile(imagePath)
-	if err != nil {
-		return fmt.Errorf("Error reading image file: %w", err)
-	}
-	imageBase64 := base64.StdEncoding.EncodeToString(imageBytes)
-
-	requestBody, err := json.Marshal(map[string]any{
-		"model":      "gpt-4o",
-		"max_tokens": 4096,
-		"messages": []map[string]any{
-			{
-				"role": "user",
-				"content": []map[string]any{
-					{
-						"type": "text",
-						"text": prompt,
-					},
-					{
-						"type": "image_url",
-						"image_url": map[string]any{
-							"url": fmt.Sprintf("data:image/webp;base64, %s", imageBase64),
-						},
-					},
-				},
-			},
-		},
-	})
+// readArgument returns value, or the trimmed contents of the file it names
+// as @file.
+func readArgument(value string) (string, error) {
+	path, ok := strings.CutPrefix(value, "@")
+	if !ok {
+		return value, nil
+	}
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return fmt.Errorf("Error marshalling JSON: %w", err)
+		return "", fmt.Errorf("error reading %s: %w", path, err)
 	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// imageFile is an image read for the imgi commands.
+type imageFile struct {
+	Path  string
+	Label string
+	Data  []byte
+}
 
-	req, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(requestBody))
+// readImages returns the images and the prompt of the imgi commands: the
+// --image flags and the prompt argument, or else the image and prompt
+// arguments. The prompt falls back to --prompt.
+func readImages(ctx context.Context, args []string) ([]imageFile, string, error) {
+	specs := imageFlags
+	if len(specs) == 0 {
+		if len(args) == 0 {
+			return nil, "", errors.New("an image argument or --image is required")
+		}
+		specs, args = []string{args[0]}, args[1:]
+	} else if len(args) > 1 {
+		return nil, "", errors.New("images are given with --image; only the prompt may be an argument")
+	}
+	if len(specs) > maxImages {
+		return nil, "", fmt.Errorf("at most %d images may be asked about at once", maxImages)
+	}
+
+	text := promptText
+	if len(args) > 0 {
+		text = args[0]
+	}
+	images := make([]imageFile, len(specs))
+	for i, spec := range specs {
+		path, label := spec, ""
+		if len(imageFlags) > 0 {
+			path, label = imageLabel(spec)
+		}
+		data, err := readImage(ctx, path)
+		if err != nil {
+			return nil, "", err
+		}
+		images[i] = imageFile{Path: path, Label: label, Data: data}
+	}
+	return images, text, nil
+}
+
+// imageLabel splits an --image flag into the image and its label: a file
+// as file=label, a URL as url#label since fragments are not fetched.
+func imageLabel(spec string) (string, string) {
+	if strings.Contains(spec, "://") {
+		image, label, _ := strings.Cut(spec, "#")
+		return image, label
+	}
+	image, label, _ := strings.Cut(spec, "=")
+	return image, label
+}
+
+// readImage reads an image from a file, a file:// URL or an http(s) URL.
+func readImage(ctx context.Context, path string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(path, "http://"), strings.HasPrefix(path, "https://"):
+		fetcher := &fetch.Fetcher{AllowPrivate: true, MaxBytes: 20 << 20, Timeout: 30 * time.Second}
+		return fetcher.Fetch(ctx, path)
+	case strings.HasPrefix(path, "file://"):
+		u, err := url.Parse(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file URL: %w", err)
+		}
+		path = u.Path
+	}
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return fmt.Errorf("Error creating request: %w", err)
+		return nil, fmt.Errorf("Error reading image file: %w", err)
+	}
+	return data, nil
+}
+
+// imagePaths lists the files of images.
+func imagePaths(images []imageFile) string {
+	paths := make([]string, len(images))
+	for i, image := range images {
+		paths[i] = image.Path
 	}
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-	req.Header.Set("Content-Type", "application/json")
+	return strings.Join(paths, ", ")
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+// imageURLs encodes images as data URLs with their labels.
+func imageURLs(images []imageFile) []prompt.Image {
+	urls := make([]prompt.Image, len(images))
+	for i, image := range images {
+		urls[i] = prompt.Image{URL: dataURL(image.Data), Label: image.Label}
+	}
+	return urls
+}
+
+// imagesKey stands for images in result cache keys: the image itself when
+// there is one, otherwise every image with its label.
+func imagesKey(images []imageFile) []byte {
+	if len(images) == 1 && images[0].Label == "" {
+		return images[0].Data
+	}
+	var key []byte
+	for _, image := range images {
+		sum := sha256.Sum256(image.Data)
+		key = fmt.Appendf(key, "%s\x00%x\x00", image.Label, sum)
+	}
+	return key
+}
+
+// promptData is what a template renders for images, the file and EXIF
+// metadata being those of the first.
+func promptData(text string, images []imageFile) prompt.Data {
+	data := prompt.Data{Prompt: text, Images: len(images)}
+	for _, image := range images {
+		data.Labels = append(data.Labels, image.Label)
+	}
+	if len(images) > 0 {
+		data.File, data.EXIF = prompt.FileOf(images[0].Path), prompt.EXIF(images[0].Data)
+	}
+	return data
+}
+
+// dataURL encodes an image as a base64 data URL of its detected type.
+func dataURL(image []byte) string {
+	return fmt.Sprintf("data:%s;base64,%s", http.DetectContentType(image), base64.StdEncoding.EncodeToString(image))
+}
+
+// printUsage prices the tokens a result spent and prints them.
+func printUsage(result *upstream.Result) error {
+	prices, err := usage.LoadPrices(priceTable)
 	if err != nil {
-		return fmt.Errorf("Error making request: %w", err)
+		return err
 	}
-	defer resp.Body.Close()
+	prices.Apply(&result.Usage, result.Model)
+	fmt.Println("Usage:", result.Usage)
+	return nil
+}
 
-	body, err := io.ReadAll(resp.Body)
+// openResultCache opens the configured result cache and returns the content
+// address of the image and prompt pair.
+func openResultCache(chain *upstream.Chain, imageBytes []byte, prompt string) (cache.Cache, string, error) {
+	results, err := cache.New(cacheKind, 0, cacheDir, cacheTTL)
 	if err != nil {
-		return fmt.Errorf("Error reading response body: %w", err)
+		return nil, "", fmt.Errorf("Error opening result cache: %w", err)
 	}
+	return results, resultKey(chain, imageBytes, prompt), nil
+}
 
-	responseString := string(body)
-	// fmt.Println("Response:", responseString)
+// resultKey is the content address of the image and prompt pair, as
+// answered by the first route of chain.
+func resultKey(chain *upstream.Chain, imageBytes []byte, prompt string) string {
+	primary := chain.Routes[0]
+	return cache.Key(imageBytes, prompt, primary.Client.Name+"/"+primary.Model, map[string]any{"max_tokens": maxTokens})
+}
 
-	result := gjson.Get(responseString, "choices.0.message.content")
+// lookupResult returns a cached result unless caching is off or bypassed.
+func lookupResult(results cache.Cache, key string) (upstream.Result, bool) {
+	if results == nil || noCache {
+		return upstream.Result{}, false
+	}
+	cached, ok := results.Get(key)
+	if !ok {
+		return upstream.Result{}, false
+	}
+	var result upstream.Result
+	if err := json.Unmarshal([]byte(cached), &result); err != nil {
+		return upstream.Result{}, false
+	}
+	slog.Info("cache hit", "cache_key", key)
+	return result, true
+}
 
-	response := result.Str
-	fmt.Println("Response:", response)
+// storeResult caches a non-empty result, with the model that gave it and
+// its usage. Fallback answers are not cached, so the first route answers
+// once it is back.
+func storeResult(results cache.Cache, key string, result upstream.Result) {
+	if results == nil || result.Text == "" || result.Fallback {
+		return
+	}
+	data, _ := json.Marshal(result)
+	if err := results.Set(key, string(data)); err != nil {
+		slog.Error("error caching result", "error", err)
+	}
+}
+
+func queryAuditLog(cmd *cobra.Command, args []string) error {
+	filter := audit.Filter{Key: auditKey, Outcome: auditOutcome}
+	var err error
+	if filter.Since, err = parseAuditTime(auditSince); err != nil {
+		return fmt.Errorf("invalid --since: %w", err)
+	}
+	if filter.Until, err = parseAuditTime(auditUntil); err != nil {
+		return fmt.Errorf("invalid --until: %w", err)
+	}
+
+	entries, err := audit.Query(auditFile, filter)
+	if err != nil {
+		return err
+	}
+
+	out := os.Stdout
+	if auditOutput != "" {
+		if out, err = os.Create(auditOutput); err != nil {
+			return fmt.Errorf("error creating output file: %w", err)
+		}
+		defer out.Close()
+	}
 
+	switch auditFormat {
+	case "ndjson":
+		err = audit.WriteNDJSON(out, entries)
+	case "csv":
+		err = audit.WriteCSV(out, entries)
+	default:
+		return fmt.Errorf("unknown format %q, want ndjson or csv", auditFormat)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing audit entries: %w", err)
+	}
+	slog.Info("audit query", "entries", len(entries))
 	return nil
 }
 
+// parseAuditTime reads an RFC 3339 time, a date, or a duration before now.
+func parseAuditTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("%q is not a time, date or duration", value)
+}
+
 func convertYamlToJson(cmd *cobra.Command, args []string) error {
 	inputFile := args[0]
 	outputFile := args[1]
 
-	// Read YAML file
-	yamlData, err := os.ReadFile(inputFile)
+	if err := convertPath(inputFile, outputFile, convert.YAML, convert.JSON, convert.Options{}); err != nil {
+		return err
+	}
+
+	fmt.Printf("Successfully converted %s to %s\n", inputFile, outputFile)
+	return nil
+}
+
+func convertFile(cmd *cobra.Command, args []string) error {
+	input, output := "-", "-"
+	if len(args) > 0 {
+		input = args[0]
+	}
+	if len(args) > 1 {
+		output = args[1]
+	}
+
+	from, err := convertFormat(convertFrom, input)
+	if err != nil {
+		return fmt.Errorf("input format: %w", err)
+	}
+	to, err := convertFormat(convertTo, output)
+	if err != nil {
+		return fmt.Errorf("output format: %w", err)
+	}
+	return convertPath(input, output, from, to, convert.Options{Indent: convertIndent, Compact: convertCompact})
+}
+
+// convertFormat returns the format named by a --from or --to flag, or the
+// one inferred from path when the flag is empty.
+func convertFormat(name, path string) (convert.Format, error) {
+	if name != "" {
+		return convert.ParseFormat(name)
+	}
+	return convert.FormatOf(path)
+}
+
+// convertPath converts the file input into output, either of which may be
+// "-" for standard input or output. The output is only written once the
+// conversion succeeded.
+func convertPath(input, output string, from, to convert.Format, options convert.Options) error {
+	in := os.Stdin
+	name := "stdin"
+	if input != "-" {
+		file, err := os.Open(input)
+		if err != nil {
+			return fmt.Errorf("error reading input: %w", err)
+		}
+		defer file.Close()
+		in, name = file, input
+	}
+
+	var out bytes.Buffer
+	if err := convert.Convert(in, &out, name, from, to, options); err != nil {
+		return fmt.Errorf("error converting %s: %w", name, err)
+	}
+
+	if output == "-" {
+		_, err := os.Stdout.Write(out.Bytes())
+		return err
+	}
+	if err := os.WriteFile(output, out.Bytes(), 0644); err != nil {
+		return fmt.Errorf("error writing output: %w", err)
+	}
+	return nil
+}
+
+func validateFiles(cmd *cobra.Command, args []string) error {
+	schema, err := validate.LoadSchema(validateSchema)
 	if err != nil {
-		return fmt.Errorf("error reading YAML file: %w", err)
+		return err
 	}
 
-	// Parse YAML
-	var data interface{}
-	if err := yaml.Unmarshal(yamlData, &data); err != nil {
-		return fmt.Errorf("error parsing YAML: %w", err)
+	var write func(io.Writer, []validate.Result) error
+	switch validateFormat {
+	case "text":
+		write = validate.WriteText
+	case "json":
+		write = validate.WriteJSON
+	case "junit":
+		write = func(w io.Writer, results []validate.Result) error {
+			return validate.WriteJUnit(w, validateSchema, results)
+		}
+	case "github":
+		write = validate.WriteGitHub
+	default:
+		return fmt.Errorf("unknown report format %q (want text, json, junit or github)", validateFormat)
 	}
 
-	// Convert to JSON
-	jsonData, err := json.MarshalIndent(data, "", "  ")
+	paths, err := expandPaths(args)
 	if err != nil {
-		return fmt.Errorf("error converting to JSON: %w", err)
+		return err
+	}
+	var results []validate.Result
+	for _, path := range paths {
+		fileResults, err := validatePath(schema, path)
+		if err != nil {
+			return err
+		}
+		results = append(results, fileResults...)
 	}
 
-	// Write JSON file
-	if err := os.WriteFile(outputFile, jsonData, 0644); err != nil {
-		return fmt.Errorf("error writing JSON file: %w", err)
+	if err := write(os.Stdout, results); err != nil {
+		return err
+	}
+	invalid := 0
+	for _, r := range results {
+		if !r.Valid() {
+			invalid++
+		}
 	}
+	if invalid > 0 {
+		cmd.SilenceUsage = true
+		return fmt.Errorf("%d of %d documents invalid", invalid, len(results))
+	}
+	return nil
+}
 
-	fmt.Printf("Successfully converted %s to %s\n", inputFile, outputFile)
+// expandPaths expands glob patterns among args. No args means standard input.
+func expandPaths(args []string) ([]string, error) {
+	if len(args) == 0 {
+		return []string{"-"}, nil
+	}
+	var paths []string
+	for _, arg := range args {
+		if arg == "-" || !strings.ContainsAny(arg, "*?[") {
+			paths = append(paths, arg)
+			continue
+		}
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", arg, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match %s", arg)
+		}
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
+func validatePath(schema *validate.Schema, path string) ([]validate.Result, error) {
+	format, err := convertFormat(validateFrom, path)
+	if err != nil {
+		return nil, fmt.Errorf("input format: %w", err)
+	}
+	if path == "-" {
+		return schema.Validate(os.Stdin, "stdin", format)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading input: %w", err)
+	}
+	defer file.Close()
+	return schema.Validate(file, path, format)
+}
+
+func generateOpenAPI(cmd *cobra.Command, args []string) error {
+	to := convert.JSON
+	if openapiTo != "" || openapiOutput != "-" {
+		format, err := convertFormat(openapiTo, openapiOutput)
+		if err != nil {
+			return fmt.Errorf("output format: %w", err)
+		}
+		to = format
+	}
+
+	spec, err := openapi.Generate(args)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	if err := convert.Encode(&out, []*yaml.Node{spec}, to, convert.Options{}); err != nil {
+		return err
+	}
+
+	if openapiOutput == "-" {
+		_, err := os.Stdout.Write(out.Bytes())
+		return err
+	}
+	if err := os.WriteFile(openapiOutput, out.Bytes(), 0644); err != nil {
+		return fmt.Errorf("error writing output: %w", err)
+	}
+	return nil
+}
+
+func lintOpenAPI(cmd *cobra.Command, args []string) error {
+	var write func(io.Writer, string, []openapi.Finding) error
+	switch openapiFormat {
+	case "text":
+		write = openapi.WriteText
+	case "json":
+		write = openapi.WriteJSON
+	case "github":
+		write = openapi.WriteGitHub
+	default:
+		return fmt.Errorf("unknown report format %q (want text, json or github)", openapiFormat)
+	}
+
+	name := "stdin"
+	var data []byte
+	var err error
+	if len(args) == 0 || args[0] == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		name = args[0]
+		data, err = os.ReadFile(name)
+	}
+	if err != nil {
+		return fmt.Errorf("error reading spec: %w", err)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("error parsing spec: %w", err)
+	}
+
+	findings := openapi.Lint(&doc)
+	if err := write(os.Stdout, name, findings); err != nil {
+		return err
+	}
+	errs, warnings := 0, 0
+	for _, f := range findings {
+		if f.Severity == openapi.SeverityError {
+			errs++
+		} else {
+			warnings++
+		}
+	}
+	if errs > 0 || (openapiStrict && warnings > 0) {
+		cmd.SilenceUsage = true
+		return fmt.Errorf("%d errors, %d warnings", errs, warnings)
+	}
 	return nil
 }
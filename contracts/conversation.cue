@@ -0,0 +1,81 @@
+import (
+	"list"
+	"strings"
+	"time"
+)
+
+// Text part of a message
+#TextPart: {
+	// Part type
+	type: "text"
+
+	// Text of the part
+	text: string & strings.MinRunes(1) & strings.MaxRunes(10_000)
+}
+
+// Image part of a message
+#ImagePart: {
+	// Part type
+	type: "image"
+
+	// Base64 encoded image
+	image: string & strings.MinRunes(3) & strings.MaxRunes(13_900_000) & =~"^data:image/(jpeg|png|gif|webp);base64,[A-Za-z0-9+/]+=*$"
+}
+
+// Part of a message, text or an image
+#Part: #TextPart | #ImagePart
+
+// New conversation contract
+#ConversationCreate: {
+	// System prompt for the whole conversation
+	system?: string & strings.MaxRunes(4000)
+}
+
+// New user message contract
+#MessageCreate: {
+	// Text and images of the message: up to 10 parts, with images of
+	// 13,900,000 characters in all
+	content: [...#Part] & list.MaxItems(10)
+
+	// Images may not add up to more than a blob
+	_imagesSize: list.Sum([for p in content if p.image != _|_ {len(p.image)}]) & <=13_900_000
+
+	// Stream the answer as server-sent events
+	stream?: bool
+}
+
+// Message of a conversation
+#Message: {
+	// Author of the message
+	role: "user" | "assistant"
+
+	// Text and images of the message
+	content: [...#Part]
+
+	// Provider and model that wrote an assistant message
+	model?: string
+
+	// Tokens spent on an assistant message
+	usage?: #Usage
+
+	// When the message was added
+	created: time.Time
+}
+
+// Conversation contract
+#Conversation: {
+	// Conversation identifier
+	id: string & =~"^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$"
+
+	// System prompt for the whole conversation
+	system?: string
+
+	// Messages, oldest first
+	messages: [...#Message]
+
+	// When the conversation was started
+	created: time.Time
+
+	// When the last message was added
+	updated: time.Time
+}
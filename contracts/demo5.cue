@@ -0,0 +1,707 @@
+// Image info API served by demo5. The schemas of the image and
+// conversation contracts come from image2.cue and conversation.cue;
+// generate the spec with
+//
+//	go run cli.go openapi gen contracts/image2.cue contracts/conversation.cue contracts/demo5.cue -o demos/demo5/openapi.json
+
+import "time"
+
+info: {
+	title:       "Image info API"
+	description: "Extracts information from images with a vision model, and reports token usage and quotas"
+	version:     "1.0.0"
+}
+
+servers: [{
+	url:         "http://localhost:8080"
+	description: "Local demo server"
+}]
+
+paths: {
+	"/extract-image-info": {
+		options: {
+			summary: "CORS preflight"
+			responses: {
+				"204": {
+					description: "Preflight answered with the route's CORS policy"
+				}
+			}
+		}
+		post: {
+			summary: "Extract Image Info"
+			parameters: [{
+				name:        "Idempotency-Key"
+				"in":        "header"
+				required:    false
+				description: "Replay key, used instead of the upload id when present"
+				schema: {
+					type: "string"
+				}
+			}, {
+				name:        "Cache-Control"
+				"in":        "header"
+				required:    false
+				description: "Send no-cache to skip cached results, no-store to keep the result out of the cache"
+				schema: {
+					type: "string"
+				}
+			}, {
+				name:        "X-Request-ID"
+				"in":        "header"
+				required:    false
+				description: "Correlation id echoed in the response, logs and errors; generated when missing"
+				schema: {
+					type:    "string"
+					pattern: "^[A-Za-z0-9._:-]{1,128}$"
+				}
+			}]
+			requestBody: {
+				required: true
+				content: {
+					"application/json": {
+						schema: {
+							"$ref": "ImageUpload"
+						}
+					}
+				}
+			}
+			responses: {
+				"200": {
+					description: "Image processed successfully"
+					headers: {
+						"X-Request-ID": {
+							description: "Id of this request"
+							schema: {
+								type: "string"
+							}
+						}
+						"X-Cache": {
+							description: "HIT when the result was served from the result cache, MISS otherwise"
+							schema: {
+								type: "string"
+								enum: ["HIT", "MISS"]
+							}
+						}
+					}
+					content: {
+						"application/json": {
+							schema: {
+								"$ref": "ImageInfo"
+							}
+						}
+						"text/event-stream": {
+							schema: {
+								type:        "string"
+								description: "When stream is true: \"event: queued\" with the queue position while waiting for an upstream slot, then the info as data events, then \"event: images\" with the preprocessing report of each image when the server preprocesses images, \"event: model\", \"event: usage\", \"event: done\" with the request id and \"data: [DONE]\". A failure mid-stream is sent as data and as \"event: error\" with the error and the request id"
+							}
+						}
+					}
+				}
+				"400": {
+					description: "Image processing failed"
+					content: {
+						"application/json": {
+							schema: {
+								"$ref": "ImageInfo"
+							}
+						}
+					}
+				}
+				"413": {
+					description: "Upload over the size limit"
+					content: {
+						"application/json": {
+							schema: {
+								"$ref": "ImageInfo"
+							}
+						}
+					}
+				}
+				"409": {
+					description: "Idempotency key reused with a different payload or still in progress"
+					content: {
+						"application/json": {
+							schema: {
+								"$ref": "ImageInfo"
+							}
+						}
+					}
+				}
+				"401": {
+					description: "Missing or unknown API key, when API keys are configured"
+					content: {
+						"application/problem+json": {
+							schema: {
+								"$ref": "Problem"
+							}
+						}
+					}
+				}
+				"429": {
+					description: "Client rate limit or concurrent stream cap exceeded, API key quota exhausted, or upstream provider is rate limiting requests"
+					headers: {
+						"Retry-After": {
+							description: "Seconds to wait before retrying, when known"
+							schema: {
+								type: "integer"
+							}
+						}
+					}
+					content: {
+						"application/json": {
+							schema: {
+								"$ref": "ImageInfo"
+							}
+						}
+					}
+				}
+				"502": {
+					description: "Upstream provider failed"
+					headers: {
+						"Retry-After": {
+							description: "Seconds to wait before retrying, when known"
+							schema: {
+								type: "integer"
+							}
+						}
+					}
+					content: {
+						"application/json": {
+							schema: {
+								"$ref": "ImageInfo"
+							}
+						}
+					}
+				}
+				"503": {
+					description: "Upstream provider unavailable, circuit breaker open, or too many upstream calls queued"
+					headers: {
+						"Retry-After": {
+							description: "Seconds to wait before retrying, when known"
+							schema: {
+								type: "integer"
+							}
+						}
+					}
+					content: {
+						"application/json": {
+							schema: {
+								"$ref": "ImageInfo"
+							}
+						}
+					}
+				}
+				"504": {
+					description: "Upstream provider timed out"
+					headers: {
+						"Retry-After": {
+							description: "Seconds to wait before retrying, when known"
+							schema: {
+								type: "integer"
+							}
+						}
+					}
+					content: {
+						"application/json": {
+							schema: {
+								"$ref": "ImageInfo"
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	"/files": {
+		post: {
+			summary:     "Upload an image"
+			description: "Keeps an image for a limited time, for uploads to refer to by file_id; only the caller that uploaded it can refer to it"
+			requestBody: {
+				required: true
+				content: {
+					"image/jpeg": {
+						schema: {
+							type:   "string"
+							format: "binary"
+						}
+					}
+					"image/png": {
+						schema: {
+							type:   "string"
+							format: "binary"
+						}
+					}
+					"image/gif": {
+						schema: {
+							type:   "string"
+							format: "binary"
+						}
+					}
+					"image/webp": {
+						schema: {
+							type:   "string"
+							format: "binary"
+						}
+					}
+				}
+			}
+			responses: {
+				"201": {
+					description: "Image uploaded"
+					content: {
+						"application/json": {
+							schema: {
+								"$ref": "File"
+							}
+						}
+					}
+				}
+				"400": {
+					description: "Not a JPEG, PNG, GIF or WebP image"
+					content: {
+						"application/problem+json": {
+							schema: {
+								"$ref": "Problem"
+							}
+						}
+					}
+				}
+				"413": {
+					description: "Image over the size limit"
+					content: {
+						"application/problem+json": {
+							schema: {
+								"$ref": "Problem"
+							}
+						}
+					}
+				}
+				"429": {
+					description: "Client rate limit exceeded, API key quota exhausted, or the caller's unexpired files at their byte limit"
+					content: {
+						"application/problem+json": {
+							schema: {
+								"$ref": "Problem"
+							}
+						}
+					}
+				}
+				"503": {
+					description: "File storage full"
+					content: {
+						"application/problem+json": {
+							schema: {
+								"$ref": "Problem"
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	"/conversations": {
+		post: {
+			summary:     "Start a conversation"
+			description: "Starts a conversation kept on the server; only the caller that started it can read it or add to it"
+			requestBody: {
+				required: true
+				content: {
+					"application/json": {
+						schema: {
+							"$ref": "ConversationCreate"
+						}
+					}
+				}
+			}
+			responses: {
+				"201": {
+					description: "Conversation started"
+					headers: {
+						Location: {
+							description: "Path of the conversation"
+							schema: {
+								type: "string"
+							}
+						}
+					}
+					content: {
+						"application/json": {
+							schema: {
+								"$ref": "Conversation"
+							}
+						}
+					}
+				}
+				"400": {
+					description: "Invalid conversation"
+					content: {
+						"application/problem+json": {
+							schema: {
+								"$ref": "Problem"
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	"/conversations/{id}": {
+		get: {
+			summary: "Read a conversation and its messages"
+			parameters: [{
+				name:        "id"
+				"in":        "path"
+				required:    true
+				description: "Conversation identifier"
+				schema: {
+					type: "string"
+				}
+			}]
+			responses: {
+				"200": {
+					description: "The conversation"
+					content: {
+						"application/json": {
+							schema: {
+								"$ref": "Conversation"
+							}
+						}
+					}
+				}
+				"404": {
+					description: "Unknown conversation, or one started by another caller"
+					content: {
+						"application/problem+json": {
+							schema: {
+								"$ref": "Problem"
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	"/conversations/{id}/messages": {
+		post: {
+			summary:     "Add a message to a conversation and answer it"
+			description: "Sends the whole history with the message to the model. The message and the answer are stored together once the answer is complete; a failed answer leaves the conversation as it was"
+			parameters: [{
+				name:        "id"
+				"in":        "path"
+				required:    true
+				description: "Conversation identifier"
+				schema: {
+					type: "string"
+				}
+			}]
+			requestBody: {
+				required: true
+				content: {
+					"application/json": {
+						schema: {
+							"$ref": "MessageCreate"
+						}
+					}
+				}
+			}
+			responses: {
+				"200": {
+					description: "The answer"
+					content: {
+						"application/json": {
+							schema: {
+								"$ref": "Message"
+							}
+						}
+						"text/event-stream": {
+							schema: {
+								type:        "string"
+								description: "When stream is true: \"event: queued\" with the queue position while waiting for an upstream slot, then the answer as data events, then \"event: model\", \"event: usage\", \"event: done\" with the request id and \"data: [DONE]\". A failure mid-stream is sent as data and as \"event: error\" with the error and the request id"
+							}
+						}
+					}
+				}
+				"400": {
+					description: "Invalid message, or the conversation is full"
+					content: {
+						"application/problem+json": {
+							schema: {
+								"$ref": "Problem"
+							}
+						}
+					}
+				}
+				"413": {
+					description: "Message over the size limit, its images over 13,900,000 characters, or the images of the conversation over the server's limit"
+					content: {
+						"application/problem+json": {
+							schema: {
+								"$ref": "Problem"
+							}
+						}
+					}
+				}
+				"404": {
+					description: "Unknown conversation, or one started by another caller"
+					content: {
+						"application/problem+json": {
+							schema: {
+								"$ref": "Problem"
+							}
+						}
+					}
+				}
+				"409": {
+					description: "Another message was added to the conversation while this one was answered"
+					content: {
+						"application/problem+json": {
+							schema: {
+								"$ref": "Problem"
+							}
+						}
+					}
+				}
+				"429": {
+					description: "Client rate limit or concurrent stream cap exceeded, API key quota exhausted, or upstream provider is rate limiting requests"
+					content: {
+						"application/problem+json": {
+							schema: {
+								"$ref": "Problem"
+							}
+						}
+					}
+				}
+				"502": {
+					description: "Upstream provider failed"
+					content: {
+						"application/problem+json": {
+							schema: {
+								"$ref": "Problem"
+							}
+						}
+					}
+				}
+				"503": {
+					description: "Upstream provider unavailable, circuit breaker open, or too many upstream calls queued"
+					content: {
+						"application/problem+json": {
+							schema: {
+								"$ref": "Problem"
+							}
+						}
+					}
+				}
+				"504": {
+					description: "Upstream provider timed out"
+					content: {
+						"application/problem+json": {
+							schema: {
+								"$ref": "Problem"
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	"/usage": {
+		get: {
+			summary: "Token usage per caller"
+			responses: {
+				"200": {
+					description: "Usage totals per caller key"
+					content: {
+						"application/json": {
+							schema: {
+								type: "array"
+								items: {
+									"$ref": "UsageTotals"
+								}
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	"/admin/usage": {
+		get: {
+			summary: "Quota usage of every API key"
+			responses: {
+				"200": {
+					description: "Usage and limits per key"
+					content: {
+						"application/json": {
+							schema: {
+								type: "array"
+								items: {
+									"$ref": "QuotaStatus"
+								}
+							}
+						}
+					}
+				}
+				"403": {
+					description: "Admin key required"
+					content: {
+						"application/problem+json": {
+							schema: {
+								"$ref": "Problem"
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	"/admin/usage/{name}": {
+		get: {
+			summary: "Quota usage of one API key"
+			parameters: [{
+				name:        "name"
+				"in":        "path"
+				required:    true
+				description: "Name of the API key"
+				schema: {
+					type: "string"
+				}
+			}]
+			responses: {
+				"200": {
+					description: "Usage and limits of the key"
+					content: {
+						"application/json": {
+							schema: {
+								"$ref": "QuotaStatus"
+							}
+						}
+					}
+				}
+				"404": {
+					description: "Unknown key name"
+					content: {
+						"application/problem+json": {
+							schema: {
+								"$ref": "Problem"
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	"/admin/usage/{name}/reset": {
+		post: {
+			summary: "Reset the current quota periods of one API key"
+			parameters: [{
+				name:        "name"
+				"in":        "path"
+				required:    true
+				description: "Name of the API key"
+				schema: {
+					type: "string"
+				}
+			}]
+			responses: {
+				"200": {
+					description: "Usage after the reset"
+					content: {
+						"application/json": {
+							schema: {
+								"$ref": "QuotaStatus"
+							}
+						}
+					}
+				}
+				"404": {
+					description: "Unknown key name"
+					content: {
+						"application/problem+json": {
+							schema: {
+								"$ref": "Problem"
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// RFC 9457 problem details
+#Problem: {
+	// URI reference identifying the problem type
+	type?: string
+
+	// Short summary of the problem type
+	title: string
+
+	// HTTP status code
+	status: int
+
+	// Explanation specific to this occurrence
+	detail?: string
+
+	// Id of the request, as in the X-Request-ID header
+	request_id?: string
+}
+
+// Request and token limits of a quota period
+#QuotaLimits: {
+	// Requests allowed per period
+	requests?: int
+
+	// Tokens allowed per period
+	tokens?: int
+}
+
+// Usage counted in the current quota period
+#QuotaCounter: {
+	// Start of the period
+	start?: time.Time
+
+	// Requests made in the period
+	requests?: int
+
+	// Tokens spent in the period
+	tokens?: int
+}
+
+// Quota usage and limits of an API key
+#QuotaStatus: {
+	// Name of the API key
+	name?: string
+
+	// Usage in the current day and month
+	usage?: {
+		day?:   #QuotaCounter
+		month?: #QuotaCounter
+	}
+
+	// Daily limits
+	daily?: #QuotaLimits
+
+	// Monthly limits
+	monthly?: #QuotaLimits
+}
+
+// Token usage aggregated per caller
+#UsageTotals: {
+	// Caller key
+	key?: string
+
+	// Requests made
+	requests?: int
+
+	// Tokens in prompts
+	prompt_tokens?: int
+
+	// Tokens in completions
+	completion_tokens?: int
+
+	// Total tokens
+	total_tokens?: int
+
+	// Estimated cost in USD
+	cost_usd?: number
+}
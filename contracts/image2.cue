@@ -1,22 +1,156 @@
-import "strings"
+import (
+	"list"
+	"strings"
+	"time"
+)
 
 // Image upload contract
 #ImageUpload: {
 	// Unique identifier
 	id: string & =~"^[0-9a-zA-Z -]{36}$"
 
-	// Image prompt
-	prompt: string & =~"^.{3,100}$" & =~"^[A-Za-z0-9 -_.]+$"
+	// Image prompt, required unless a template is given
+	prompt?: string & =~"^.{3,100}$" & =~"^[A-Za-z0-9 -_.]+$"
+
+	// Library template rendering the prompt, which it may include
+	template?: "describe" | "alt-text" | "ocr" | "tag" | "compare"
+
+	// Template variables, named like identifiers
+	vars?: {[string]: string & strings.MaxRunes(200), [!~"^[A-Za-z_][A-Za-z0-9_]*$"]: _|_}
+
+	// System prompt, replacing the template's
+	system?: string & strings.MaxRunes(2000)
+
+	// Few-shot examples, asked about before the image
+	examples?: [...#Example] & list.MaxItems(3)
 
 	// Stream enabled
 	stream: bool
 
+	// The image, or the images, asked about
+	#UploadSource
+}
+
+// Images of an upload, from exactly one source: a blob, a URL, a file id
+// or a list of images
+#UploadSource: S={
+	#ImageSource
+
+	// Images asked about together, in order: up to 8, of 13,900,000
+	// characters in all
+	images?: [...#LabeledImage] & list.MaxItems(8)
+
+	// Images may not add up to more than a blob
+	_imagesSize: list.Sum([for i in images if i.blob != _|_ {len(i.blob)}]) & <=13_900_000
+
+	// Sources are exclusive
+	_oneSource: len([if S.blob != _|_ {1}, if S.url != _|_ {1}, if S.file_id != _|_ {1}, if S.images != _|_ {1}]) & <=1
+}
+
+// Source of an image, exactly one of a blob, a URL and a file id
+#ImageSource: {
 	// Base64 encoded image
-	blob: string & strings.MinRunes(3) & strings.MaxRunes(13_900_000) & =~"^data:image/(jpeg|png|gif|webp);base64,[A-Za-z0-9+/]+=*$"
+	blob?: string & strings.MinRunes(3) & strings.MaxRunes(13_900_000) & =~"^data:image/(jpeg|png|gif|webp);base64,[A-Za-z0-9+/]+=*$"
+
+	// Image URL, fetched by the server from allow-listed hosts
+	url?: string & strings.MaxRunes(2048) & =~"^https?://[^/?#]+"
+
+	// Id of an image uploaded to /files
+	file_id?: string & =~"^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$"
+
+	// Sources are exclusive
+	_oneImageSource: len([if blob != _|_ {1}, if url != _|_ {1}, if file_id != _|_ {1}]) & <=1
+}
+
+// Image of a multi-image upload contract
+#LabeledImage: {
+	// Name of the image in the prompt, e.g. before or page 2
+	label?: string & strings.MinRunes(1) & strings.MaxRunes(100)
+
+	#ImageSource
+}
+
+// Uploaded file contract
+#File: {
+	// File identifier, the file_id of uploads referring to it
+	id: string & =~"^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$"
+
+	// Detected image type
+	content_type: "image/jpeg" | "image/png" | "image/gif" | "image/webp"
+
+	// Size in bytes
+	size: int & >0
+
+	// When the file was uploaded
+	created: time.Time
+
+	// When the file will be deleted
+	expires: time.Time
+}
+
+// Few-shot example contract
+#Example: {
+	// Base64 encoded example image
+	image: string & strings.MinRunes(3) & strings.MaxRunes(13_900_000) & =~"^data:image/(jpeg|png|gif|webp);base64,[A-Za-z0-9+/]+=*$"
+
+	// Answer expected for the example image
+	answer: string & strings.MinRunes(1) & strings.MaxRunes(4000)
 }
 
 // Image info contract
 #ImageInfo: {
 	// Image info
 	info: string
+
+	// Provider and model that produced the info
+	model?: string
+
+	// Tokens spent producing the info
+	usage?: #Usage
+
+	// Each image as received and as sent, when the server preprocesses
+	// images
+	images?: [...#ImageReport]
+}
+
+// Image preprocessing report contract
+#ImageReport: {
+	// The image as received
+	original: #ImageSize
+
+	// The image as sent, downsized and re-encoded without metadata
+	sent: #ImageSize
+
+	// Tiles of a very large image, sent after it in more detail
+	tiles?: [...#ImageSize]
+}
+
+// Encoded image size contract
+#ImageSize: {
+	// Image type
+	type: string
+
+	// Size in bytes
+	bytes: int & >0
+
+	// Width in pixels, upright
+	width: int & >0
+
+	// Height in pixels, upright
+	height: int & >0
+}
+
+// Token usage contract
+#Usage: {
+	// Tokens in the prompt, image included
+	prompt_tokens: int & >=0
+
+	// Tokens in the completion
+	completion_tokens: int & >=0
+
+	// Prompt and completion tokens
+	total_tokens: int & >=0
+
+	// Estimated cost in USD
+	cost_usd: number & >=0
 }
@@ -4,12 +4,17 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
 	"log"
 	"net/http"
+	"os"
 
 	"cuelang.org/go/cue"
 	"cuelang.org/go/cue/cuecontext"
+	"ubuntuhive.tech/gonovella/internal/auth"
+	"ubuntuhive.tech/gonovella/internal/logging"
+	"ubuntuhive.tech/gonovella/internal/metrics"
+	"ubuntuhive.tech/gonovella/internal/ratelimit"
+	"ubuntuhive.tech/gonovella/internal/requestid"
 )
 
 type User struct {
@@ -41,7 +46,8 @@ func userHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := validateUser(user); err != nil {
-		fmt.Println(fmt.Errorf("INVALID_PAYLOAD:::: +%v", err))
+		metrics.ValidationFailed("#User", err)
+		logging.From(r.Context()).Warn("INVALID_PAYLOAD", "error", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -51,6 +57,27 @@ func userHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	http.HandleFunc("POST /users", userHandler)
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	// Logging: LOG_FORMAT, LOG_LEVEL, LOG_SAMPLE and LOG_REDACT, see logging.ConfigFromEnv
+	if err := logging.Setup(os.Stderr); err != nil {
+		log.Fatal(err)
+	}
+
+	// Authentication: API_KEYS and JWKS_FILE, see auth.FromEnv
+	authn, err := auth.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Rate limits: RATE_LIMITS names a YAML file of per client limits
+	limiter, err := ratelimit.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	http.Handle("POST /users", authn.Require("users:write")(limiter.Middleware(http.HandlerFunc(userHandler))))
+
+	// Serve Prometheus metrics
+	http.Handle("GET /metrics", metrics.Handler())
+
+	log.Fatal(http.ListenAndServe(":8080", requestid.Middleware(logging.Middleware(metrics.Middleware(http.DefaultServeMux)))))
 }
@@ -3,13 +3,19 @@ package main
 import (
 	"embed"
 	"encoding/json"
-	"fmt"
     "html/template"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
 
 	"cuelang.org/go/cue"
 	"cuelang.org/go/cue/cuecontext"
+	"ubuntuhive.tech/gonovella/internal/auth"
+	"ubuntuhive.tech/gonovella/internal/logging"
+	"ubuntuhive.tech/gonovella/internal/metrics"
+	"ubuntuhive.tech/gonovella/internal/ratelimit"
+	"ubuntuhive.tech/gonovella/internal/requestid"
 )
 
 
@@ -45,7 +51,8 @@ func userHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := validateUser(user); err != nil {
-		fmt.Println(fmt.Errorf("INVALID_PAYLOAD:::: +%v", err))
+		metrics.ValidationFailed("#User", err)
+		logging.From(r.Context()).Warn("INVALID_PAYLOAD", "error", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -55,13 +62,38 @@ func userHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-    // API endpoints
-	http.HandleFunc("POST /users", userHandler)
-
-    // Serve OpenAPI spec
+    // Logging: LOG_FORMAT, LOG_LEVEL, LOG_SAMPLE and LOG_REDACT, see logging.ConfigFromEnv
+    if err := logging.Setup(os.Stderr); err != nil {
+        log.Fatal(err)
+    }
+
+    // Authentication: API_KEYS and JWKS_FILE, see auth.FromEnv
+    authn, err := auth.FromEnv()
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    // Rate limits: RATE_LIMITS names a YAML file of per client limits
+    limiter, err := ratelimit.FromEnv()
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    // API endpoints and the scope each requires
+    routes := []auth.Route{
+        {Pattern: "POST /users", Scope: "users:write", Handler: limiter.Middleware(http.HandlerFunc(userHandler))},
+    }
+    authn.Handle(http.DefaultServeMux, routes)
+
+    // Serve OpenAPI spec, with security schemes matching the configured auth
     http.HandleFunc("GET /openapi.json", func(w http.ResponseWriter, r *http.Request) {
         w.Header().Set("Content-Type", "application/json")
-        spec, _ := content.ReadFile("openapi.json")
+        data, _ := content.ReadFile("openapi.json")
+        spec, err := authn.Document(data, routes)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
         w.Write(spec)
     })
 
@@ -72,9 +104,11 @@ func main() {
         tmpl.Execute(w, nil)
     })
 
-    log.Printf("Server starting on http://localhost:8080")
-    log.Printf("API documentation available at http://localhost:8080/docs")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+    // Serve Prometheus metrics
+    http.Handle("GET /metrics", metrics.Handler())
+
+    slog.Info("server starting", "url", "http://localhost:8080", "docs", "http://localhost:8080/docs")
+	log.Fatal(http.ListenAndServe(":8080", requestid.Middleware(logging.Middleware(metrics.Middleware(http.DefaultServeMux)))))
 }
 
 const swaggerTemplate = `
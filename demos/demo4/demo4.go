@@ -1,19 +1,26 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"embed"
 	"encoding/json"
-	"fmt"
 	"html/template"
-	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"cuelang.org/go/cue"
 	"cuelang.org/go/cue/cuecontext"
-	"github.com/tidwall/gjson"
+	"ubuntuhive.tech/gonovella/internal/auth"
+	"ubuntuhive.tech/gonovella/internal/logging"
+	"ubuntuhive.tech/gonovella/internal/metrics"
+	"ubuntuhive.tech/gonovella/internal/quota"
+	"ubuntuhive.tech/gonovella/internal/ratelimit"
+	"ubuntuhive.tech/gonovella/internal/requestid"
+	"ubuntuhive.tech/gonovella/internal/upstream"
 )
 
 var (
@@ -21,6 +28,9 @@ var (
 	apiKey = os.Getenv("OPENAI_API_KEY")
 )
 
+// Shared client with retries and a circuit breaker
+var upstreamClient = upstream.New(apiURL, apiKey)
+
 //go:embed *
 var content embed.FS
 
@@ -84,9 +94,10 @@ func processImageUploadHandler(w http.ResponseWriter, r *http.Request) {
 	var (
 		image  ImageUpload
 		status ImageUploadStatus
+		logger = logging.From(r.Context())
 	)
 	if err := json.NewDecoder(r.Body).Decode(&image); err != nil {
-		fmt.Println(fmt.Errorf("BAD_PAYLOAD:::: +%v", err))
+		logger.Warn("BAD_PAYLOAD", "error", err)
 		status = ImageUploadStatus{
 			ID:     "bad-id",
 			Prompt: "bad-prompt",
@@ -99,7 +110,8 @@ func processImageUploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := validateImageUpload(image); err != nil {
-		fmt.Println(fmt.Errorf("INVALID_PAYLOAD:::: +%v with image size: %d", err, len(image.Blob)))
+		metrics.ValidationFailed("#ImageUpload", err)
+		logger.Warn("INVALID_PAYLOAD", "error", err, "image_size", len(image.Blob))
 		status = ImageUploadStatus{
 			ID:     "bad-id",
 			Prompt: "bad-prompt",
@@ -111,15 +123,16 @@ func processImageUploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err, info := getInfoFromImage(image.Blob, image.Prompt); err != nil {
-		fmt.Println(fmt.Errorf("INFO_RETRIEVAL_ERROR:::: +%v with image size: %d", err, len(image.Blob)))
+	if err, info := getInfoFromImage(r.Context(), image.Blob, image.Prompt); err != nil {
+		logger.Error("INFO_RETRIEVAL_ERROR", "error", err, "image_size", len(image.Blob))
 		status = ImageUploadStatus{
 			ID:     "bad-id",
 			Prompt: "bad-prompt",
 			Status: err.Error(),
 		}
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
+		setRetryAfter(w, err)
+		w.WriteHeader(upstream.HTTPStatus(err))
 		json.NewEncoder(w).Encode(status)
 		return
 	} else {
@@ -129,19 +142,83 @@ func processImageUploadHandler(w http.ResponseWriter, r *http.Request) {
 			Prompt: image.Prompt,
 			Status: info,
 		}
-		fmt.Println(fmt.Sprintf("Extracted Image Data; +%v", status))
+		logger.Info("extracted image data", "id", status.ID)
+		logger.Debug("extracted image info", "info", status.Status)
 		json.NewEncoder(w).Encode(status)
 	}
 }
 
+// setRetryAfter tells the client when an upstream failure is worth retrying.
+func setRetryAfter(w http.ResponseWriter, err error) {
+	if d := upstream.RetryAfter(err); d > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(d.Round(time.Second).Seconds())))
+	}
+}
+
+// openQuotas loads the keys file at path and the usage store named by
+// QUOTA_STORE, defaulting to quota-usage.json in the working directory.
+func openQuotas(path string) (*quota.Manager, error) {
+	config, err := quota.LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	storePath := os.Getenv("QUOTA_STORE")
+	if storePath == "" {
+		storePath = "quota-usage.json"
+	}
+	store, err := quota.OpenStore(storePath)
+	if err != nil {
+		return nil, err
+	}
+	return quota.New(config, store), nil
+}
+
 func main() {
-	// API endpoints
-	http.HandleFunc("POST /extract-image-info", processImageUploadHandler)
+	// Logging: LOG_FORMAT, LOG_LEVEL, LOG_SAMPLE and LOG_REDACT, see logging.ConfigFromEnv
+	if err := logging.Setup(os.Stderr); err != nil {
+		log.Fatal(err)
+	}
+
+	// Authentication: API_KEYS and JWKS_FILE, see auth.FromEnv
+	authn, err := auth.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Quotas: API_KEYS also carries the budget of each key
+	var routes []auth.Route
+	extractHandler := http.Handler(http.HandlerFunc(processImageUploadHandler))
+	if path := os.Getenv("API_KEYS"); path != "" {
+		quotas, err := openQuotas(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		extractHandler = quotas.Middleware(extractHandler)
+		routes = append(routes, auth.Route{Pattern: "/admin/", Scope: "usage:admin", Handler: quotas.AdminHandler()})
+	}
 
-	// Serve OpenAPI spec
+	// Rate limits: RATE_LIMITS names a YAML file of per client limits
+	limiter, err := ratelimit.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	extractHandler = limiter.Middleware(extractHandler)
+
+	// API endpoints and the scope each requires
+	routes = append(routes,
+		auth.Route{Pattern: "POST /extract-image-info", Scope: "images:extract", Handler: extractHandler},
+	)
+	authn.Handle(http.DefaultServeMux, routes)
+
+	// Serve OpenAPI spec, with security schemes matching the configured auth
 	http.HandleFunc("GET /openapi.json", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		spec, _ := content.ReadFile("openapi.json")
+		data, _ := content.ReadFile("openapi.json")
+		spec, err := authn.Document(data, routes)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 		w.Write(spec)
 	})
 
@@ -152,9 +229,11 @@ func main() {
 		tmpl.Execute(w, nil)
 	})
 
-	log.Printf("Server starting on http://localhost:8080")
-	log.Printf("API documentation available at http://localhost:8080/docs")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	// Serve Prometheus metrics
+	http.Handle("GET /metrics", metrics.Handler())
+
+	slog.Info("server starting", "url", "http://localhost:8080", "docs", "http://localhost:8080/docs")
+	log.Fatal(http.ListenAndServe(":8080", requestid.Middleware(logging.Middleware(metrics.Middleware(http.DefaultServeMux)))))
 }
 
 const swaggerTemplate = `
@@ -185,58 +264,19 @@ const swaggerTemplate = `
 </html>
 `
 
-func getInfoFromImage(imageUrl, prompt string) (error, string) {
-	requestBody, err := json.Marshal(map[string]any{
-		"model":      "gpt-4o",
-		"max_tokens": 4096,
-		"messages": []map[string]any{
-			{
-				"role": "user",
-				"content": []map[string]any{
-					{
-						"type": "text",
-						"text": prompt,
-					},
-					{
-						"type": "image_url",
-						"image_url": map[string]any{
-							"url": imageUrl,
-						},
-					},
-				},
-			},
-		},
-	})
-	if err != nil {
-		return fmt.Errorf("Error marshalling JSON: %w", err), ""
-	}
-
-	req, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(requestBody))
-	if err != nil {
-		return fmt.Errorf("Error creating request: %w", err), ""
+func getInfoFromImage(ctx context.Context, imageUrl, prompt string) (error, string) {
+	request := upstream.Request{
+		Model:     "gpt-4o",
+		MaxTokens: 4096,
+		Messages:  []upstream.Message{upstream.UserMessage(prompt, imageUrl)},
 	}
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	result, err := upstreamClient.Complete(ctx, request)
 	if err != nil {
-		return fmt.Errorf("Error making request: %w", err), ""
+		return err, ""
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("Error reading response body: %w", err), ""
-	}
-
-	responseString := string(body)
-	// fmt.Println("Response:", responseString)
-
-	result := gjson.Get(responseString, "choices.0.message.content")
-
-	response := result.Str
-	fmt.Println("Response:", response)
+	quota.Record(ctx, result.Usage.TotalTokens)
+	logging.From(ctx).Debug("response", "info", result.Text)
 
-	return nil, response
+	return nil, result.Text
 }
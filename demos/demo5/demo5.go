@@ -1,22 +1,48 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"embed"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"cuelang.org/go/cue"
 	"cuelang.org/go/cue/cuecontext"
-	"github.com/tidwall/gjson"
+	"go.opentelemetry.io/otel/attribute"
+	"ubuntuhive.tech/gonovella/internal/audit"
+	"ubuntuhive.tech/gonovella/internal/auth"
+	"ubuntuhive.tech/gonovella/internal/cache"
+	"ubuntuhive.tech/gonovella/internal/conversation"
+	"ubuntuhive.tech/gonovella/internal/cors"
+	"ubuntuhive.tech/gonovella/internal/fetch"
+	"ubuntuhive.tech/gonovella/internal/files"
+	"ubuntuhive.tech/gonovella/internal/idempotency"
+	"ubuntuhive.tech/gonovella/internal/logging"
+	"ubuntuhive.tech/gonovella/internal/metrics"
+	"ubuntuhive.tech/gonovella/internal/preprocess"
+	"ubuntuhive.tech/gonovella/internal/problem"
+	"ubuntuhive.tech/gonovella/internal/prompt"
+	"ubuntuhive.tech/gonovella/internal/quota"
+	"ubuntuhive.tech/gonovella/internal/ratelimit"
+	"ubuntuhive.tech/gonovella/internal/requestid"
+	"ubuntuhive.tech/gonovella/internal/tracing"
+	"ubuntuhive.tech/gonovella/internal/upstream"
+	"ubuntuhive.tech/gonovella/internal/usage"
 )
 
 var (
@@ -24,47 +50,337 @@ var (
 	apiKey = os.Getenv("OPENAI_API_KEY")
 )
 
+// Ordered provider/model routes, configured in main from UPSTREAM_CONFIG
+var upstreamChain *upstream.Chain
+
+// Bounds parallel upstream calls, configured in main from UPSTREAM_CONCURRENCY
+var upstreamLimiter *upstream.Limiter
+
+// Token prices, configured in main from PRICE_TABLE, and usage per caller
+var (
+	prices = usage.DefaultPrices
+	ledger = usage.NewLedger()
+)
+
+const (
+	model     = "gpt-4o"
+	maxTokens = 4096
+)
+
 //go:embed *
 var content embed.FS
 
 type ImageUpload struct {
-	ID     string `json:"id"`
-	Prompt string `json:"prompt"`
-	Stream bool   `json:"stream"`
-	Blob   string `json:"blob"`
+	ID       string            `json:"id"`
+	Prompt   string            `json:"prompt,omitempty"`
+	Template string            `json:"template,omitempty"`
+	Vars     map[string]string `json:"vars,omitempty"`
+	System   string            `json:"system,omitempty"`
+	Examples []prompt.Example  `json:"examples,omitempty"`
+	Stream   bool              `json:"stream"`
+	Blob     string            `json:"blob,omitempty"`
+	URL      string            `json:"url,omitempty"`
+	FileID   string            `json:"file_id,omitempty"`
+	Images   []LabeledImage    `json:"images,omitempty"`
+}
+
+type LabeledImage struct {
+	Label  string `json:"label,omitempty"`
+	Blob   string `json:"blob,omitempty"`
+	URL    string `json:"url,omitempty"`
+	FileID string `json:"file_id,omitempty"`
+}
+
+type ConversationCreate struct {
+	System string `json:"system,omitempty"`
+}
+
+type MessageCreate struct {
+	Content []conversation.Part `json:"content"`
+	Stream  bool                `json:"stream,omitempty"`
 }
 
 type ImageInfo struct {
-	Info string `json:"info"`
+	Info   string              `json:"info"`
+	Model  string              `json:"model,omitempty"`
+	Usage  *usage.Usage        `json:"usage,omitempty"`
+	Images []preprocess.Report `json:"images,omitempty"`
 }
 
 const schema = `
 
-import "strings"
+import (
+	"list"
+	"strings"
+	"time"
+)
 
 // Image upload contract
 #ImageUpload: {
 	// Unique identifier
 	id: string & =~"^[0-9a-zA-Z -]{36}$"
 
-	// Image prompt
-	prompt: string & =~"^.{3,100}$" & =~"^[A-Za-z0-9 -_.]+$"
+	// Image prompt, required unless a template is given
+	prompt?: string & =~"^.{3,100}$" & =~"^[A-Za-z0-9 -_.]+$"
+
+	// Library template rendering the prompt, which it may include
+	template?: "describe" | "alt-text" | "ocr" | "tag" | "compare"
+
+	// Template variables, named like identifiers
+	vars?: {[string]: string & strings.MaxRunes(200), [!~"^[A-Za-z_][A-Za-z0-9_]*$"]: _|_}
+
+	// System prompt, replacing the template's
+	system?: string & strings.MaxRunes(2000)
+
+	// Few-shot examples, asked about before the image
+	examples?: [...#Example] & list.MaxItems(3)
 
 	// Stream enabled
 	stream: bool
 
+	// The image, or the images, asked about
+	#UploadSource
+}
+
+// Images of an upload, from exactly one source: a blob, a URL, a file id
+// or a list of images
+#UploadSource: S={
+	#ImageSource
+
+	// Images asked about together, in order: up to 8, of 13,900,000
+	// characters in all
+	images?: [...#LabeledImage] & list.MaxItems(8)
+
+	// Images may not add up to more than a blob
+	_imagesSize: list.Sum([for i in images if i.blob != _|_ {len(i.blob)}]) & <=13_900_000
+
+	// Sources are exclusive
+	_oneSource: len([if S.blob != _|_ {1}, if S.url != _|_ {1}, if S.file_id != _|_ {1}, if S.images != _|_ {1}]) & <=1
+}
+
+// Source of an image, exactly one of a blob, a URL and a file id
+#ImageSource: {
 	// Base64 encoded image
-	blob: string & strings.MinRunes(3) & strings.MaxRunes(13_900_000) & =~"^data:image/(jpeg|png|gif|webp);base64,[A-Za-z0-9+/]+=*$"
+	blob?: string & strings.MinRunes(3) & strings.MaxRunes(13_900_000) & =~"^data:image/(jpeg|png|gif|webp);base64,[A-Za-z0-9+/]+=*$"
+
+	// Image URL, fetched by the server from allow-listed hosts
+	url?: string & strings.MaxRunes(2048) & =~"^https?://[^/?#]+"
+
+	// Id of an image uploaded to /files
+	file_id?: string & =~"^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$"
+
+	// Sources are exclusive
+	_oneImageSource: len([if blob != _|_ {1}, if url != _|_ {1}, if file_id != _|_ {1}]) & <=1
+}
+
+// Image of a multi-image upload contract
+#LabeledImage: {
+	// Name of the image in the prompt, e.g. before or page 2
+	label?: string & strings.MinRunes(1) & strings.MaxRunes(100)
+
+	#ImageSource
+}
+
+// Uploaded file contract
+#File: {
+	// File identifier, the file_id of uploads referring to it
+	id: string & =~"^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$"
+
+	// Detected image type
+	content_type: "image/jpeg" | "image/png" | "image/gif" | "image/webp"
+
+	// Size in bytes
+	size: int & >0
+
+	// When the file was uploaded
+	created: time.Time
+
+	// When the file will be deleted
+	expires: time.Time
+}
+
+// Few-shot example contract
+#Example: {
+	// Base64 encoded example image
+	image: string & strings.MinRunes(3) & strings.MaxRunes(13_900_000) & =~"^data:image/(jpeg|png|gif|webp);base64,[A-Za-z0-9+/]+=*$"
+
+	// Answer expected for the example image
+	answer: string & strings.MinRunes(1) & strings.MaxRunes(4000)
 }
 
 // Image info contract
 #ImageInfo: {
 	// Image info
 	info: string
+
+	// Provider and model that produced the info
+	model?: string
+
+	// Tokens spent producing the info
+	usage?: #Usage
+
+	// Each image as received and as sent, when the server preprocesses
+	// images
+	images?: [...#ImageReport]
+}
+
+// Image preprocessing report contract
+#ImageReport: {
+	// The image as received
+	original: #ImageSize
+
+	// The image as sent, downsized and re-encoded without metadata
+	sent: #ImageSize
+
+	// Tiles of a very large image, sent after it in more detail
+	tiles?: [...#ImageSize]
+}
+
+// Encoded image size contract
+#ImageSize: {
+	// Image type
+	type: string
+
+	// Size in bytes
+	bytes: int & >0
+
+	// Width in pixels, upright
+	width: int & >0
+
+	// Height in pixels, upright
+	height: int & >0
+}
+
+// Token usage contract
+#Usage: {
+	prompt_tokens:     int & >=0
+	completion_tokens: int & >=0
+	total_tokens:      int & >=0
+
+	// Estimated cost in USD
+	cost_usd: number & >=0
+}
+
+// Text part of a message
+#TextPart: {
+	// Part type
+	type: "text"
+
+	// Text of the part
+	text: string & strings.MinRunes(1) & strings.MaxRunes(10_000)
+}
+
+// Image part of a message
+#ImagePart: {
+	// Part type
+	type: "image"
+
+	// Base64 encoded image
+	image: string & strings.MinRunes(3) & strings.MaxRunes(13_900_000) & =~"^data:image/(jpeg|png|gif|webp);base64,[A-Za-z0-9+/]+=*$"
+}
+
+// Part of a message, text or an image
+#Part: #TextPart | #ImagePart
+
+// New conversation contract
+#ConversationCreate: {
+	// System prompt for the whole conversation
+	system?: string & strings.MaxRunes(4000)
+}
+
+// New user message contract
+#MessageCreate: {
+	// Text and images of the message: up to 10 parts, with images of
+	// 13,900,000 characters in all
+	content: [...#Part] & list.MaxItems(10)
+
+	// Images may not add up to more than a blob
+	_imagesSize: list.Sum([for p in content if p.image != _|_ {len(p.image)}]) & <=13_900_000
+
+	// Stream the answer as server-sent events
+	stream?: bool
+}
+
+// Message of a conversation
+#Message: {
+	// Author of the message
+	role: "user" | "assistant"
+
+	// Text and images of the message
+	content: [...#Part]
+
+	// Provider and model that wrote an assistant message
+	model?: string
+
+	// Tokens spent on an assistant message
+	usage?: #Usage
+
+	// When the message was added
+	created: time.Time
+}
+
+// Conversation contract
+#Conversation: {
+	// Conversation identifier
+	id: string & =~"^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$"
+
+	// System prompt for the whole conversation
+	system?: string
+
+	// Messages, oldest first
+	messages: [...#Message]
+
+	// When the conversation was started
+	created: time.Time
+
+	// When the last message was added
+	updated: time.Time
 }
 
 `
 
+// Extraction results are kept for a day so retried uploads are not billed twice
+var results = idempotency.NewStore(24 * time.Hour)
+
+// Results of identical image and prompt pairs, configured in main
+var resultCache cache.Cache
+
+// Append-only record of every extraction, configured in main from AUDIT_LOG
+var auditLog *audit.Log
+
+// Largest JSON body of an upload or a message, from UPLOAD_MAX_BYTES: room
+// for a 13,900,000 character blob and the rest of the payload
+var maxUploadBytes = 16 << 20
+
+// Image preprocessing, configured in main from IMAGE_PREPROCESS and the
+// IMAGE_* options; nil sends images as given
+var preprocessing *preprocess.Options
+
+// Images preprocessed at once, from IMAGE_PREPROCESS_CONCURRENCY, since
+// each decoded image takes up to 4 bytes per pixel
+var preprocessSlots chan struct{}
+
+// Image inputs, configured in main: URLs are fetched only when
+// IMAGE_URL_HOSTS allow-lists their hosts, and uploaded files are kept
+// FILE_TTL, at most FILE_MAX_BYTES each, FILE_OWNER_MAX_BYTES per caller
+// and FILE_STORE_MAX_BYTES in all
+var (
+	imageFetcher *fetch.Fetcher
+	uploads      *files.Store
+	maxFileBytes = 10 << 20
+)
+
+// Conversation histories, configured in main from CONVERSATION_STORE; the
+// messages a conversation may hold, from CONVERSATION_MAX_MESSAGES; and the
+// bytes of images a message and a whole conversation may hold, the latter
+// from CONVERSATION_MAX_BYTES, as every turn sends the history again
+var (
+	conversations           conversation.Store
+	maxConversationMessages = 100
+	maxMessageImageBytes    = 13_900_000
+	maxConversationBytes    = 40 << 20
+)
+
 var ctx = cuecontext.New()
 var compiledSchema = ctx.CompileString(schema)
 
@@ -73,6 +389,16 @@ func validateImageUpload(p ImageUpload) error {
 	return val.Unify(compiledSchema.LookupPath(cue.ParsePath("#ImageUpload"))).Err()
 }
 
+func validateConversationCreate(p ConversationCreate) error {
+	val := ctx.Encode(p)
+	return val.Unify(compiledSchema.LookupPath(cue.ParsePath("#ConversationCreate"))).Err()
+}
+
+func validateMessageCreate(p MessageCreate) error {
+	val := ctx.Encode(p)
+	return val.Unify(compiledSchema.LookupPath(cue.ParsePath("#MessageCreate"))).Err()
+}
+
 func validateImageInfoStatus(p ImageInfo) error {
 	val := ctx.Encode(p)
 	return val.Unify(compiledSchema.LookupPath(cue.ParsePath("#ImageUploadStatus"))).Err()
@@ -83,9 +409,33 @@ func processImageUploadHandler(w http.ResponseWriter, r *http.Request) {
 	var (
 		image  ImageUpload
 		status ImageInfo
+		logger = logging.From(r.Context())
 	)
-	if err := json.NewDecoder(r.Body).Decode(&image); err != nil {
-		fmt.Println(fmt.Errorf("BAD_PAYLOAD:::: +%v", err))
+	_, span := tracing.Start(r.Context(), "decode")
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, int64(maxUploadBytes))).Decode(&image)
+	tracing.End(span, err)
+	if err != nil {
+		logger.Warn("BAD_PAYLOAD", "error", err)
+		status = ImageInfo{
+			Info: err.Error(),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(payloadStatus(err))
+		json.NewEncoder(w).Encode(status)
+		return
+	}
+
+	// Every decoded upload is audited, however it ends
+	entry := newAuditEntry(r, image)
+	defer recordAudit(r, entry)
+
+	_, span = tracing.Start(r.Context(), "validate", attribute.String("cue.schema", "#ImageUpload"))
+	err = validateImageUpload(image)
+	tracing.End(span, err)
+	if err != nil {
+		metrics.ValidationFailed("#ImageUpload", err)
+		logger.Warn("INVALID_PAYLOAD", "error", err, "image_size", uploadSize(image))
+		entry.Outcome, entry.Error = audit.OutcomeInvalid, err.Error()
 		status = ImageInfo{
 			Info: err.Error(),
 		}
@@ -95,8 +445,13 @@ func processImageUploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := validateImageUpload(image); err != nil {
-		fmt.Println(fmt.Errorf("INVALID_PAYLOAD:::: +%v with image size: %d", err, len(image.Blob)))
+	// Images given by URL or file id are fetched or loaded as blobs
+	_, span = tracing.Start(r.Context(), "resolve")
+	err = resolveImages(r, &image)
+	tracing.End(span, err)
+	if err != nil {
+		logger.Warn("INVALID_IMAGE", "error", err)
+		entry.Outcome, entry.Error = audit.OutcomeInvalid, err.Error()
 		status = ImageInfo{
 			Info: err.Error(),
 		}
@@ -105,55 +460,1029 @@ func processImageUploadHandler(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(status)
 		return
 	}
+	entry.ImageSHA256 = audit.HashImage(uploadKey(image))
+
+	// Templates, system prompts and examples shape the messages sent upstream
+	rendered, err := renderPrompt(image)
+	if err != nil {
+		logger.Warn("INVALID_PROMPT", "error", err, "template", image.Template)
+		entry.Outcome, entry.Error = audit.OutcomeInvalid, err.Error()
+		status = ImageInfo{
+			Info: err.Error(),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(status)
+		return
+	}
+	entry.Prompt = rendered.Prompt
+
+	// The Idempotency-Key header takes precedence over the upload id. Keys
+	// are scoped to the caller, who cannot replay the results of others.
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" {
+		idempotencyKey = image.ID
+	}
+	key := callerKey(r) + "\x00" + idempotencyKey
+	replay, err := results.Begin(key, idempotency.Fingerprint(rendered.Key(), string(uploadKey(image))))
+	if err != nil {
+		logger.Warn("IDEMPOTENCY_CONFLICT", "error", err, "idempotency_key", idempotencyKey)
+		entry.Outcome, entry.Error = audit.OutcomeConflict, err.Error()
+		status = ImageInfo{
+			Info: err.Error(),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(status)
+		return
+	}
+	if replay != nil {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+
+	// Identical image and prompt pairs are answered from the result cache
+	cacheKey := imageCacheKey(image, rendered)
+	var (
+		cached   upstream.Result
+		isCached bool
+	)
+	if replay != nil {
+		cached, isCached = decodeResult(replay.Result), true
+		entry.Outcome = audit.OutcomeReplayed
+	} else if resultCache != nil {
+		cached, isCached = lookupCache(r, cacheKey)
+		metrics.CacheLookup(isCached)
+		if isCached {
+			w.Header().Set("X-Cache", "HIT")
+			results.Complete(key, encodeResult(cached))
+			entry.Outcome = audit.OutcomeCached
+		} else {
+			w.Header().Set("X-Cache", "MISS")
+		}
+	}
+
+	// Uncached images are preprocessed before they are sent upstream
+	var (
+		sent    []prompt.Image
+		reports []preprocess.Report
+	)
+	if !isCached {
+		_, span = tracing.Start(r.Context(), "preprocess")
+		sent, reports, err = preprocessImages(r.Context(), uploadImages(image))
+		tracing.End(span, err)
+		if err != nil {
+			results.Abort(key)
+			logger.Warn("INVALID_IMAGE", "error", err)
+			entry.Outcome, entry.Error = audit.OutcomeInvalid, err.Error()
+			status = ImageInfo{
+				Info: err.Error(),
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(status)
+			return
+		}
+	}
 
 	if image.Stream {
-		// Set CORS headers to allow all origins. You may want to restrict this to specific origins in a production environment.
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-		//w.Header().Set("Access-Control-Max-Age", "3600")
 		// Set the content type to text/event-stream
 		w.Header().Set("Content-Type", "text/event-stream")
 		w.Header().Set("Cache-Control", "no-cache")
 		w.Header().Set("Connection", "keep-alive")
 
-		if err := getInfoFromImageStreaming(w, image.Blob, image.Prompt); err != nil {
-			fmt.Println(fmt.Errorf("INFO_RETRIEVAL_ERROR:::: +%v with image size: %d", err, len(image.Blob)))
-			fmt.Fprintf(w, "data: %s\n\n", err.Error())
-			w.(http.Flusher).Flush()
-			fmt.Fprintf(w, "data: %s\n\n", "[DONE]")
-			w.(http.Flusher).Flush()
+		if isCached {
+			writeEvents(w, cached.Text)
+			writeResult(r.Context(), w, cached)
 			return
 		}
+
+		release, ok := acquireUpstream(w, r, true)
+		if !ok {
+			results.Abort(key)
+			entry.Outcome = audit.OutcomeOverloaded
+			return
+		}
+		defer release()
+
+		err, result := getInfoFromImageStreaming(r.Context(), w, rendered.LabeledMessages(sent...))
+		if err != nil {
+			results.Abort(key)
+			logger.Error("INFO_RETRIEVAL_ERROR", "error", err, "image_size", uploadSize(image))
+			entry.Outcome, entry.Error = audit.OutcomeError, err.Error()
+			writeError(r.Context(), w, err)
+			return
+		}
+		results.Complete(key, encodeResult(result))
+		storeCache(r, cacheKey, result)
+		ledger.Record(callerKey(r), result.Usage)
+		quota.Record(r.Context(), result.Usage.TotalTokens)
+		auditResult(entry, result)
+		if len(reports) > 0 {
+			reportJSON, _ := json.Marshal(reports)
+			fmt.Fprintf(w, "event: images\ndata: %s\n\n", reportJSON)
+		}
+		writeResult(r.Context(), w, result)
 	} else {
-		if err, info := getInfoFromImage(image.Blob, image.Prompt); err != nil {
-			fmt.Println(fmt.Errorf("INFO_RETRIEVAL_ERROR:::: +%v with image size: %d", err, len(image.Blob)))
+		if isCached {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(ImageInfo{Info: cached.Text, Model: modelName(cached), Usage: &cached.Usage})
+			return
+		}
+
+		release, ok := acquireUpstream(w, r, false)
+		if !ok {
+			results.Abort(key)
+			entry.Outcome = audit.OutcomeOverloaded
+			return
+		}
+		defer release()
+
+		if err, result := getInfoFromImage(r.Context(), rendered.LabeledMessages(sent...)); err != nil {
+			results.Abort(key)
+			logger.Error("INFO_RETRIEVAL_ERROR", "error", err, "image_size", uploadSize(image))
+			entry.Outcome, entry.Error = audit.OutcomeError, err.Error()
 			status = ImageInfo{
 				Info: err.Error(),
 			}
 			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
+			setRetryAfter(w, err)
+			w.WriteHeader(upstream.HTTPStatus(err))
 			json.NewEncoder(w).Encode(status)
 			return
 		} else {
+			results.Complete(key, encodeResult(result))
+			storeCache(r, cacheKey, result)
+			ledger.Record(callerKey(r), result.Usage)
+			quota.Record(r.Context(), result.Usage.TotalTokens)
+			auditResult(entry, result)
 			w.Header().Set("Content-Type", "application/json")
 			status = ImageInfo{
-				Info: info,
+				Info:   result.Text,
+				Model:  modelName(result),
+				Usage:  &result.Usage,
+				Images: reports,
 			}
-			fmt.Println(fmt.Sprintf("Extracted Image Data; +%v", status))
+			logger.Info("extracted image data", "model", status.Model, "total_tokens", result.Usage.TotalTokens, "cost_usd", result.Usage.CostUSD)
+			logger.Debug("extracted image info", "info", status.Info)
 			json.NewEncoder(w).Encode(status)
 		}
 	}
 }
 
+// newAuditEntry starts the audit record of an upload, keeping only a hash
+// of the image.
+func newAuditEntry(r *http.Request, image ImageUpload) *audit.Entry {
+	return &audit.Entry{
+		Time:        time.Now().UTC(),
+		RequestID:   requestid.FromContext(r.Context()),
+		Key:         callerKey(r),
+		ImageSHA256: audit.HashImage(uploadKey(image)),
+		Prompt:      image.Prompt,
+		Stream:      image.Stream,
+		Outcome:     audit.OutcomeOK,
+	}
+}
+
+// auditResult records who answered and what it cost.
+func auditResult(entry *audit.Entry, result upstream.Result) {
+	entry.Model = modelName(result)
+	entry.PromptTokens = result.Usage.PromptTokens
+	entry.CompletionTokens = result.Usage.CompletionTokens
+	entry.TotalTokens = result.Usage.TotalTokens
+	entry.CostUSD = result.Usage.CostUSD
+}
+
+// recordAudit appends a finished upload to the audit log.
+func recordAudit(r *http.Request, entry *audit.Entry) {
+	entry.LatencyMS = time.Since(entry.Time).Milliseconds()
+	if err := auditLog.Record(*entry); err != nil {
+		logging.From(r.Context()).Error("AUDIT_ERROR", "error", err)
+	}
+}
+
+// uploadFileHandler keeps an uploaded image for FILE_TTL, for uploads of
+// the same caller to refer to by its id.
+func uploadFileHandler(w http.ResponseWriter, r *http.Request) {
+	logger := logging.From(r.Context())
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(maxFileBytes)))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		problem.Write(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("image over %d bytes", tooLarge.Limit))
+		return
+	}
+	if err != nil {
+		logger.Warn("BAD_PAYLOAD", "error", err)
+		problem.Write(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	contentType, err := imageType(data)
+	if err != nil {
+		logger.Warn("INVALID_PAYLOAD", "error", err)
+		problem.Write(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	f, err := uploads.Add(callerKey(r), contentType, data)
+	switch {
+	case errors.Is(err, files.ErrOwnerFull):
+		logger.Warn("FILES_FULL", "error", err)
+		problem.Write(w, http.StatusTooManyRequests, fmt.Sprintf("files of the caller would exceed %d bytes, retry once earlier files expire", uploads.MaxOwnerBytes))
+		return
+	case err != nil:
+		logger.Error("FILES_FULL", "error", err)
+		problem.Write(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	logger.Info("file uploaded", "file_id", f.ID, "content_type", f.ContentType, "size", f.Size)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(f)
+}
+
+// createConversationHandler starts a conversation owned by the caller. An
+// empty body starts one without a system prompt.
+func createConversationHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		create ConversationCreate
+		logger = logging.From(r.Context())
+	)
+	if err := json.NewDecoder(r.Body).Decode(&create); err != nil && err != io.EOF {
+		logger.Warn("BAD_PAYLOAD", "error", err)
+		problem.Write(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateConversationCreate(create); err != nil {
+		metrics.ValidationFailed("#ConversationCreate", err)
+		logger.Warn("INVALID_PAYLOAD", "error", err)
+		problem.Write(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c := conversation.New(callerKey(r), create.System)
+	if err := conversations.Create(c); err != nil {
+		logger.Error("CONVERSATION_ERROR", "error", err)
+		problem.Write(w, http.StatusInternalServerError, "error storing conversation")
+		return
+	}
+	logger.Info("conversation started", "conversation_id", c.ID)
+	w.Header().Set("Location", "/conversations/"+c.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c)
+}
+
+// getConversationHandler returns a conversation of the caller with its
+// messages.
+func getConversationHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := lookupConversation(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+// postMessageHandler answers a user message with the whole history of the
+// conversation. The message and its answer are stored together once the
+// answer is complete, so a failed answer leaves the conversation as it was.
+func postMessageHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		message MessageCreate
+		logger  = logging.From(r.Context())
+	)
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, int64(maxUploadBytes))).Decode(&message); err != nil {
+		logger.Warn("BAD_PAYLOAD", "error", err)
+		problem.Write(w, payloadStatus(err), err.Error())
+		return
+	}
+	user := conversation.Message{Role: "user", Content: message.Content}
+	if size := imagesSize(user); size > maxMessageImageBytes {
+		logger.Warn("INVALID_PAYLOAD", "error", "images too large", "image_size", size)
+		problem.Write(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("images of %d bytes, at most %d per message", size, maxMessageImageBytes))
+		return
+	}
+	err := validateMessageCreate(message)
+	if err == nil && len(message.Content) == 0 {
+		err = errors.New("content: a message needs at least one part")
+	}
+	if err != nil {
+		metrics.ValidationFailed("#MessageCreate", err)
+		logger.Warn("INVALID_PAYLOAD", "error", err)
+		problem.Write(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c, ok := lookupConversation(w, r)
+	if !ok {
+		return
+	}
+	if len(c.Messages)+2 > maxConversationMessages {
+		problem.Write(w, http.StatusBadRequest, fmt.Sprintf("conversation is full (%d messages); start a new one", len(c.Messages)))
+		return
+	}
+
+	// Images are preprocessed before they are stored and sent upstream
+	_, span := tracing.Start(r.Context(), "preprocess")
+	content, err := preprocessParts(r.Context(), message.Content)
+	tracing.End(span, err)
+	if err != nil {
+		logger.Warn("INVALID_IMAGE", "error", err)
+		problem.Write(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	user = conversation.Message{Role: "user", Content: content, Created: time.Now().UTC()}
+	if size := imagesSize(c.Messages...) + imagesSize(user); size > maxConversationBytes {
+		problem.Write(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("conversation images would take %d bytes, at most %d; start a new one", size, maxConversationBytes))
+		return
+	}
+	messages := c.Upstream(user)
+
+	if message.Stream {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		release, ok := acquireUpstream(w, r, true)
+		if !ok {
+			return
+		}
+		defer release()
+
+		err, result := getInfoFromImageStreaming(r.Context(), w, messages)
+		if err == nil {
+			err = appendAnswer(r, c, user, result)
+		}
+		if err != nil {
+			logger.Error("CONVERSATION_ERROR", "error", err, "conversation_id", c.ID)
+			writeError(r.Context(), w, err)
+			return
+		}
+		writeResult(r.Context(), w, result)
+		return
+	}
+
+	release, ok := acquireUpstream(w, r, false)
+	if !ok {
+		return
+	}
+	defer release()
+
+	err, result := getInfoFromImage(r.Context(), messages)
+	if err != nil {
+		logger.Error("INFO_RETRIEVAL_ERROR", "error", err, "conversation_id", c.ID)
+		setRetryAfter(w, err)
+		problem.Write(w, upstream.HTTPStatus(err), err.Error())
+		return
+	}
+	if err := appendAnswer(r, c, user, result); errors.Is(err, conversation.ErrConflict) {
+		problem.Write(w, http.StatusConflict, err.Error())
+		return
+	} else if err != nil {
+		logger.Error("CONVERSATION_ERROR", "error", err, "conversation_id", c.ID)
+		problem.Write(w, http.StatusInternalServerError, "error storing conversation")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(answerMessage(result))
+}
+
+// imagesSize adds up the image parts of messages.
+func imagesSize(messages ...conversation.Message) int {
+	size := 0
+	for _, m := range messages {
+		for _, p := range m.Content {
+			if p.Type == conversation.PartImage {
+				size += len(p.Image)
+			}
+		}
+	}
+	return size
+}
+
+// lookupConversation loads the conversation named in the path. Unknown
+// conversations and those of other callers are answered with 404.
+func lookupConversation(w http.ResponseWriter, r *http.Request) (*conversation.Conversation, bool) {
+	c, err := conversations.Get(r.PathValue("id"))
+	if err == nil && c.Owner != callerKey(r) {
+		err = conversation.ErrNotFound
+	}
+	if errors.Is(err, conversation.ErrNotFound) {
+		problem.Write(w, http.StatusNotFound, err.Error())
+		return nil, false
+	}
+	if err != nil {
+		logging.From(r.Context()).Error("CONVERSATION_ERROR", "error", err)
+		problem.Write(w, http.StatusInternalServerError, "error reading conversation")
+		return nil, false
+	}
+	return c, true
+}
+
+// appendAnswer stores a user message and its answer, and accounts for the
+// tokens spent.
+func appendAnswer(r *http.Request, c *conversation.Conversation, user conversation.Message, result upstream.Result) error {
+	ledger.Record(callerKey(r), result.Usage)
+	quota.Record(r.Context(), result.Usage.TotalTokens)
+	return conversations.Append(c.ID, len(c.Messages), user, answerMessage(result))
+}
+
+// answerMessage is the assistant message of a result.
+func answerMessage(result upstream.Result) conversation.Message {
+	return conversation.Message{
+		Role:    "assistant",
+		Content: []conversation.Part{{Type: conversation.PartText, Text: result.Text}},
+		Model:   modelName(result),
+		Usage:   &result.Usage,
+		Created: time.Now().UTC(),
+	}
+}
+
+// renderPrompt renders the template of an upload, if any, with its prompt,
+// variables and the EXIF metadata of its image.
+func renderPrompt(image ImageUpload) (prompt.Rendered, error) {
+	if image.Prompt == "" && image.Template == "" {
+		return prompt.Rendered{}, errors.New("a prompt or a template is required")
+	}
+	spec := prompt.Spec{Vars: image.Vars, System: image.System, Examples: image.Examples}
+	if image.Template != "" {
+		var err error
+		if spec.Template, err = prompt.Named(image.Template); err != nil {
+			return prompt.Rendered{}, err
+		}
+	}
+	images := uploadImages(image)
+	data := prompt.Data{Prompt: image.Prompt, Images: len(images)}
+	for _, i := range images {
+		data.Labels = append(data.Labels, i.Label)
+	}
+	if len(images) > 0 {
+		decoded, _ := cache.DecodeDataURL(images[0].URL)
+		data.EXIF = prompt.EXIF(decoded)
+	}
+	return spec.Render(data)
+}
+
+// resolveImages replaces the images of an upload given by URL or file id
+// with their blobs. URLs are fetched from the allow-listed hosts, and files
+// must have been uploaded by the caller.
+func resolveImages(r *http.Request, image *ImageUpload) error {
+	if len(image.Images) == 0 {
+		if image.Blob == "" && image.URL == "" && image.FileID == "" {
+			return errors.New("a blob, url, file_id or images is required")
+		}
+		blob, err := resolveImage(r, LabeledImage{Blob: image.Blob, URL: image.URL, FileID: image.FileID})
+		if err != nil {
+			return err
+		}
+		image.Blob, image.URL, image.FileID = blob, "", ""
+		return nil
+	}
+	for i, source := range image.Images {
+		blob, err := resolveImage(r, source)
+		if err != nil {
+			return fmt.Errorf("images.%d: %w", i, err)
+		}
+		image.Images[i] = LabeledImage{Label: source.Label, Blob: blob}
+	}
+	return nil
+}
+
+// resolveImage returns the blob of an image, whatever its source.
+func resolveImage(r *http.Request, source LabeledImage) (string, error) {
+	switch {
+	case source.Blob != "":
+		return source.Blob, nil
+	case source.URL != "":
+		if imageFetcher == nil {
+			return "", errors.New("image URLs are not accepted by this server")
+		}
+		data, err := imageFetcher.Fetch(r.Context(), source.URL)
+		if err != nil {
+			return "", err
+		}
+		contentType, err := imageType(data)
+		if err != nil {
+			return "", err
+		}
+		return dataURL(contentType, data), nil
+	case source.FileID != "":
+		f, err := uploads.Get(source.FileID)
+		if err == nil && f.Owner != callerKey(r) {
+			err = files.ErrNotFound
+		}
+		if err != nil {
+			return "", fmt.Errorf("%w: %s", err, source.FileID)
+		}
+		return dataURL(f.ContentType, f.Data), nil
+	default:
+		return "", errors.New("a blob, url or file_id is required")
+	}
+}
+
+// imageType detects the type of an image, which must be one the upstream
+// accepts.
+func imageType(data []byte) (string, error) {
+	switch contentType := http.DetectContentType(data); contentType {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+		return contentType, nil
+	default:
+		return "", fmt.Errorf("not a JPEG, PNG, GIF or WebP image (%s)", contentType)
+	}
+}
+
+// dataURL encodes an image as a base64 data URL.
+func dataURL(contentType string, data []byte) string {
+	return fmt.Sprintf("data:%s;base64,%s", contentType, base64.StdEncoding.EncodeToString(data))
+}
+
+// preprocessImages prepares images for the upstream, each followed by its
+// tiles if it was cut, and reports every image as received and as sent.
+// Images go as given when preprocessing is off.
+func preprocessImages(ctx context.Context, images []prompt.Image) ([]prompt.Image, []preprocess.Report, error) {
+	if preprocessing == nil {
+		return images, nil, nil
+	}
+	var (
+		sent    []prompt.Image
+		reports []preprocess.Report
+	)
+	for i, image := range images {
+		processed, err := preprocessImage(ctx, image.URL)
+		if err != nil {
+			if len(images) > 1 {
+				err = fmt.Errorf("images.%d: %w", i, err)
+			}
+			return nil, nil, err
+		}
+		report := processed.Report
+		metrics.ImagePreprocessed(report.Original.Bytes, report.SentBytes())
+
+		number := len(sent) + 1
+		sent = append(sent, prompt.Image{URL: dataURL(report.Sent.Type, processed.Data), Label: image.Label})
+		for j, tile := range processed.Tiles {
+			label := fmt.Sprintf("tile %d of %d of image %d, row %d, column %d", j+1, len(processed.Tiles), number, tile.Row, tile.Column)
+			sent = append(sent, prompt.Image{URL: dataURL(report.Tiles[j].Type, tile.Data), Label: label})
+		}
+		reports = append(reports, report)
+	}
+	return sent, reports, nil
+}
+
+// preprocessImage decodes and preprocesses a data URL once one of the
+// preprocessSlots is free.
+func preprocessImage(ctx context.Context, url string) (preprocess.Image, error) {
+	data, err := cache.DecodeDataURL(url)
+	if err != nil {
+		return preprocess.Image{}, err
+	}
+	select {
+	case preprocessSlots <- struct{}{}:
+		defer func() { <-preprocessSlots }()
+	case <-ctx.Done():
+		return preprocess.Image{}, ctx.Err()
+	}
+	return preprocess.Process(data, *preprocessing)
+}
+
+// preprocessParts preprocesses the image parts of a message, followed by
+// their tiles with a text part naming each.
+func preprocessParts(ctx context.Context, parts []conversation.Part) ([]conversation.Part, error) {
+	if preprocessing == nil {
+		return parts, nil
+	}
+	var sent []conversation.Part
+	for i, part := range parts {
+		if part.Type != conversation.PartImage {
+			sent = append(sent, part)
+			continue
+		}
+		processed, err := preprocessImage(ctx, part.Image)
+		if err != nil {
+			return nil, fmt.Errorf("content.%d: %w", i, err)
+		}
+		report := processed.Report
+		metrics.ImagePreprocessed(report.Original.Bytes, report.SentBytes())
+
+		sent = append(sent, conversation.Part{Type: conversation.PartImage, Image: dataURL(report.Sent.Type, processed.Data)})
+		for j, tile := range processed.Tiles {
+			label := fmt.Sprintf("Tile %d of %d of the image above, row %d, column %d", j+1, len(processed.Tiles), tile.Row, tile.Column)
+			sent = append(sent,
+				conversation.Part{Type: conversation.PartText, Text: label},
+				conversation.Part{Type: conversation.PartImage, Image: dataURL(report.Tiles[j].Type, tile.Data)},
+			)
+		}
+	}
+	return sent, nil
+}
+
+// uploadImages lists the images of an upload: its blob, or its labelled
+// images.
+func uploadImages(image ImageUpload) []prompt.Image {
+	if image.Blob != "" {
+		return []prompt.Image{{URL: image.Blob}}
+	}
+	images := make([]prompt.Image, len(image.Images))
+	for i, labeled := range image.Images {
+		images[i] = prompt.Image{URL: labeled.Blob, Label: labeled.Label}
+	}
+	return images
+}
+
+// uploadSize is the length of the encoded images of an upload.
+func uploadSize(image ImageUpload) int {
+	size := 0
+	for _, i := range uploadImages(image) {
+		size += len(i.URL)
+	}
+	return size
+}
+
+// uploadKey stands for the images of an upload in cache keys, fingerprints
+// and audit hashes: the decoded image of a blob, otherwise the label and
+// hash of every image.
+func uploadKey(image ImageUpload) []byte {
+	images := uploadImages(image)
+	if len(images) == 1 && images[0].Label == "" {
+		data, err := cache.DecodeDataURL(images[0].URL)
+		if err != nil {
+			data = []byte(images[0].URL)
+		}
+		return data
+	}
+	var key []byte
+	for _, i := range images {
+		data, err := cache.DecodeDataURL(i.URL)
+		if err != nil {
+			data = []byte(i.URL)
+		}
+		key = fmt.Appendf(key, "%s\x00%s\x00", i.Label, audit.HashImage(data))
+	}
+	return key
+}
+
+// imageCacheKey addresses an upload by its decoded images, rendered prompt
+// and model settings. The model is the one of the first upstream route,
+// the only one whose answers are cached.
+func imageCacheKey(image ImageUpload, rendered prompt.Rendered) string {
+	params := map[string]any{"max_tokens": maxTokens}
+	if preprocessing != nil {
+		params["preprocess"] = preprocessing.String()
+	}
+	primary := upstreamChain.Routes[0]
+	return cache.Key(uploadKey(image), rendered.Key(), primary.Client.Name+"/"+primary.Model, params)
+}
+
+// lookupCache returns the cached result unless the client asked to bypass it.
+func lookupCache(r *http.Request, key string) (upstream.Result, bool) {
+	if strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
+		return upstream.Result{}, false
+	}
+	cached, ok := resultCache.Get(key)
+	if !ok {
+		return upstream.Result{}, false
+	}
+	var result upstream.Result
+	if err := json.Unmarshal([]byte(cached), &result); err != nil {
+		return upstream.Result{}, false
+	}
+	return result, true
+}
+
+// storeCache saves a fresh result unless the client asked not to store it.
+// Fallback answers are not cached, so the first route answers once it is
+// back.
+func storeCache(r *http.Request, key string, result upstream.Result) {
+	if resultCache == nil || result.Fallback || strings.Contains(r.Header.Get("Cache-Control"), "no-store") {
+		return
+	}
+	if err := resultCache.Set(key, encodeResult(result)); err != nil {
+		logging.From(r.Context()).Error("CACHE_ERROR", "error", err)
+	}
+}
+
+// encodeResult keeps a result, with the model that gave it and its usage,
+// as the text the result cache and the idempotency store hold.
+func encodeResult(result upstream.Result) string {
+	data, _ := json.Marshal(result)
+	return string(data)
+}
+
+// decodeResult reads a result kept by encodeResult.
+func decodeResult(text string) upstream.Result {
+	var result upstream.Result
+	if err := json.Unmarshal([]byte(text), &result); err != nil {
+		return upstream.Result{Text: text}
+	}
+	return result
+}
+
+// envDuration reads a duration such as "24h" from the environment.
+func envDuration(name string, fallback time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(name)); err == nil {
+		return d
+	}
+	return fallback
+}
+
+// envInt reads an integer from the environment.
+func envInt(name string, fallback int) int {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return n
+	}
+	return fallback
+}
+
+// callerKey identifies who is spending tokens.
+func callerKey(r *http.Request) string {
+	if name := quota.Caller(r.Context()); name != "" {
+		return name
+	}
+	if p, ok := auth.FromContext(r.Context()); ok {
+		return p.Name
+	}
+	return "anonymous"
+}
+
+// usageReportHandler lists the token usage aggregated per caller.
+func usageReportHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ledger.Report())
+}
+
+// wantsStream peeks at the upload to tell streaming requests apart for
+// rate limiting, leaving the body for the handler to decode.
+func wantsStream(r *http.Request) bool {
+	body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, int64(maxUploadBytes)))
+	if err != nil {
+		// The handler reads the error, such as the body being over the
+		// limit, after what was read
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), errorReader{err}))
+		return false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	var upload struct {
+		Stream bool `json:"stream"`
+	}
+	json.Unmarshal(body, &upload)
+	return upload.Stream
+}
+
+// errorReader fails every read with err.
+type errorReader struct{ err error }
+
+func (e errorReader) Read([]byte) (int, error) { return 0, e.err }
+
+// payloadStatus is 413 for bodies over the limit, and 400 for other
+// undecodable ones.
+func payloadStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// acquireUpstream waits for a free upstream slot. Streaming clients are sent
+// an "event: queued" with their position whenever it changes. When the queue
+// is full the request is rejected with 503 before anything is streamed.
+func acquireUpstream(w http.ResponseWriter, r *http.Request, stream bool) (func(), bool) {
+	queued := false
+	var onQueued func(int)
+	if stream {
+		onQueued = func(position int) {
+			queued = true
+			fmt.Fprintf(w, "event: queued\ndata: %d\n\n", position)
+			w.(http.Flusher).Flush()
+		}
+	}
+	release, err := upstreamLimiter.Acquire(r.Context(), onQueued)
+	if err == nil {
+		return release, true
+	}
+
+	logging.From(r.Context()).Warn("UPSTREAM_OVERLOADED", "error", err)
+	if queued {
+		writeError(r.Context(), w, err)
+		return nil, false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	setRetryAfter(w, err)
+	w.WriteHeader(upstream.HTTPStatus(err))
+	json.NewEncoder(w).Encode(ImageInfo{Info: err.Error()})
+	return nil, false
+}
+
+// modelName reports which provider and model answered.
+func modelName(result upstream.Result) string {
+	return result.Provider + "/" + result.Model
+}
+
+// setRetryAfter tells the client when an upstream failure is worth retrying.
+func setRetryAfter(w http.ResponseWriter, err error) {
+	if d := upstream.RetryAfter(err); d > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(d.Round(time.Second).Seconds())))
+	}
+}
+
+// openQuotas loads the keys file at path and the usage store named by
+// QUOTA_STORE, defaulting to quota-usage.json in the working directory.
+func openQuotas(path string) (*quota.Manager, error) {
+	config, err := quota.LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	storePath := os.Getenv("QUOTA_STORE")
+	if storePath == "" {
+		storePath = "quota-usage.json"
+	}
+	store, err := quota.OpenStore(storePath)
+	if err != nil {
+		return nil, err
+	}
+	return quota.New(config, store), nil
+}
+
 func main() {
-	// API endpoints
-	http.HandleFunc("POST /extract-image-info", processImageUploadHandler)
+	// Logging: LOG_FORMAT, LOG_LEVEL, LOG_SAMPLE and LOG_REDACT, see logging.ConfigFromEnv
+	if err := logging.Setup(os.Stderr); err != nil {
+		log.Fatal(err)
+	}
+
+	// Result cache: IMAGE_CACHE=memory|disk|off
+	var err error
+	resultCache, err = cache.New(
+		os.Getenv("IMAGE_CACHE"),
+		envInt("IMAGE_CACHE_SIZE", 256),
+		os.Getenv("IMAGE_CACHE_DIR"),
+		envDuration("IMAGE_CACHE_TTL", 24*time.Hour),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Tracing: OTEL_TRACES_EXPORTER=otlp|stdout|none, see tracing.Setup
+	shutdownTracing, err := tracing.Setup(context.Background(), "demo5")
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		// Flush pending spans before exiting
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+		shutdownTracing(context.Background())
+		os.Exit(0)
+	}()
+
+	// Audit log: AUDIT_LOG names the file, "off" disables it; rotated at
+	// AUDIT_LOG_MAX_SIZE bytes keeping AUDIT_LOG_MAX_FILES old files
+	if path := os.Getenv("AUDIT_LOG"); path != "off" {
+		if path == "" {
+			path = "audit.log"
+		}
+		auditLog, err = audit.Open(path, int64(envInt("AUDIT_LOG_MAX_SIZE", 10<<20)), envInt("AUDIT_LOG_MAX_FILES", 5))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Request bodies: UPLOAD_MAX_BYTES for uploads and messages
+	maxUploadBytes = envInt("UPLOAD_MAX_BYTES", maxUploadBytes)
+
+	// Image inputs: IMAGE_URL_HOSTS is a comma separated list of hosts, or
+	// *.domain for subdomains, that image URLs may be fetched from, in
+	// IMAGE_URL_TIMEOUT and up to IMAGE_URL_MAX_BYTES
+	if list := os.Getenv("IMAGE_URL_HOSTS"); list != "" {
+		var hosts []string
+		for _, host := range strings.Split(list, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				hosts = append(hosts, host)
+			}
+		}
+		imageFetcher = fetch.New(hosts, int64(envInt("IMAGE_URL_MAX_BYTES", 10<<20)), envDuration("IMAGE_URL_TIMEOUT", 10*time.Second))
+	}
+	uploads = files.NewStore(envDuration("FILE_TTL", 24*time.Hour))
+	uploads.MaxOwnerBytes = int64(envInt("FILE_OWNER_MAX_BYTES", 100<<20))
+	uploads.MaxBytes = int64(envInt("FILE_STORE_MAX_BYTES", 1<<30))
+	maxFileBytes = envInt("FILE_MAX_BYTES", maxFileBytes)
+
+	// Image preprocessing: IMAGE_PREPROCESS=off sends images as given;
+	// otherwise they are downsized to IMAGE_MAX_DIMENSION pixels, re-encoded
+	// as IMAGE_FORMAT=auto|jpeg|png at IMAGE_QUALITY, and also cut into
+	// tiles when longer than IMAGE_TILE_ABOVE pixels (0 never). Images over
+	// IMAGE_MAX_PIXELS are refused, and IMAGE_PREPROCESS_CONCURRENCY images
+	// are preprocessed at once
+	if os.Getenv("IMAGE_PREPROCESS") != "off" {
+		preprocessing = &preprocess.Options{
+			MaxDimension: envInt("IMAGE_MAX_DIMENSION", 2048),
+			Format:       os.Getenv("IMAGE_FORMAT"),
+			Quality:      envInt("IMAGE_QUALITY", 85),
+			TileAbove:    envInt("IMAGE_TILE_ABOVE", 0),
+			MaxPixels:    envInt("IMAGE_MAX_PIXELS", preprocess.DefaultMaxPixels),
+		}
+		preprocessSlots = make(chan struct{}, max(1, envInt("IMAGE_PREPROCESS_CONCURRENCY", runtime.NumCPU())))
+		switch preprocessing.Format {
+		case "":
+			preprocessing.Format = preprocess.FormatAuto
+		case preprocess.FormatAuto, preprocess.FormatJPEG, preprocess.FormatPNG:
+		default:
+			log.Fatalf("unknown IMAGE_FORMAT: %q", preprocessing.Format)
+		}
+	}
+
+	// Conversations: CONVERSATION_STORE=memory|sqlite, the SQLite database
+	// at CONVERSATION_DB, each of at most CONVERSATION_MAX_MESSAGES messages
+	// and CONVERSATION_MAX_BYTES of images
+	dbPath := os.Getenv("CONVERSATION_DB")
+	if dbPath == "" {
+		dbPath = "conversations.db"
+	}
+	conversations, err = conversation.Open(os.Getenv("CONVERSATION_STORE"), dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	maxConversationMessages = envInt("CONVERSATION_MAX_MESSAGES", maxConversationMessages)
+	maxConversationBytes = envInt("CONVERSATION_MAX_BYTES", maxConversationBytes)
+
+	// Fallback chain: UPSTREAM_CONFIG names a YAML file of provider/model routes
+	upstreamChain, err = upstream.LoadChain(os.Getenv("UPSTREAM_CONFIG"), apiURL, apiKey, model)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Upstream backpressure: UPSTREAM_CONCURRENCY parallel calls, UPSTREAM_QUEUE
+	// callers waiting at most UPSTREAM_QUEUE_TIMEOUT; 0 concurrency disables it
+	upstreamLimiter = upstream.NewLimiter(envInt("UPSTREAM_CONCURRENCY", 16), envInt("UPSTREAM_QUEUE", 64))
+	if upstreamLimiter != nil {
+		upstreamLimiter.MaxWait = envDuration("UPSTREAM_QUEUE_TIMEOUT", time.Minute)
+	}
+
+	// Price table: PRICE_TABLE names a YAML file of per model token prices
+	prices, err = usage.LoadPrices(os.Getenv("PRICE_TABLE"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Authentication: API_KEYS and JWKS_FILE, see auth.FromEnv
+	authn, err := auth.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Quotas: API_KEYS also carries the budget of each key
+	var routes []auth.Route
+	extractHandler := http.Handler(http.HandlerFunc(processImageUploadHandler))
+	messageHandler := http.Handler(http.HandlerFunc(postMessageHandler))
+	fileHandler := http.Handler(http.HandlerFunc(uploadFileHandler))
+	if path := os.Getenv("API_KEYS"); path != "" {
+		quotas, err := openQuotas(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		extractHandler = quotas.Middleware(extractHandler)
+		messageHandler = quotas.Middleware(messageHandler)
+		fileHandler = quotas.Middleware(fileHandler)
+		routes = append(routes, auth.Route{Pattern: "/admin/", Scope: "usage:admin", Handler: quotas.AdminHandler()})
+	}
+
+	// Rate limits: RATE_LIMITS names a YAML file of per client limits
+	limiter, err := ratelimit.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	limiter.IsStream = wantsStream
+	extractHandler = limiter.Middleware(extractHandler)
+	messageHandler = limiter.Middleware(messageHandler)
+	fileHandler = limiter.Middleware(fileHandler)
 
-	// Serve OpenAPI spec
+	// API endpoints and the scope each requires
+	routes = append(routes,
+		auth.Route{Pattern: "POST /extract-image-info", Scope: "images:extract", Handler: extractHandler},
+		auth.Route{Pattern: "POST /files", Scope: "images:extract", Handler: fileHandler},
+		auth.Route{Pattern: "POST /conversations", Scope: "images:extract", Handler: http.HandlerFunc(createConversationHandler)},
+		auth.Route{Pattern: "GET /conversations/{id}", Scope: "images:extract", Handler: http.HandlerFunc(getConversationHandler)},
+		auth.Route{Pattern: "POST /conversations/{id}/messages", Scope: "images:extract", Handler: messageHandler},
+		auth.Route{Pattern: "GET /usage", Scope: "usage:read", Handler: http.HandlerFunc(usageReportHandler)},
+	)
+
+	// CORS: CORS_CONFIG names a YAML file of per route policies
+	corsConfig, err := cors.LoadConfig(os.Getenv("CORS_CONFIG"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, route := range routes {
+		corsConfig.Handle(http.DefaultServeMux, route.Pattern, authn.Require(route.Scope)(route.Handler))
+	}
+
+	// Serve OpenAPI spec, with security schemes matching the configured auth
 	http.HandleFunc("GET /openapi.json", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		spec, _ := content.ReadFile("openapi.json")
+		data, _ := content.ReadFile("openapi.json")
+		spec, err := authn.Document(data, routes)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 		w.Write(spec)
 	})
 
@@ -164,9 +1493,11 @@ func main() {
 		tmpl.Execute(w, nil)
 	})
 
-	log.Printf("Server starting on http://localhost:8080")
-	log.Printf("API documentation available at http://localhost:8080/docs")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	// Serve Prometheus metrics
+	http.Handle("GET /metrics", metrics.Handler())
+
+	slog.Info("server starting", "url", "http://localhost:8080", "docs", "http://localhost:8080/docs")
+	log.Fatal(http.ListenAndServe(":8080", requestid.Middleware(tracing.Middleware(logging.Middleware(metrics.Middleware(http.DefaultServeMux))))))
 }
 
 const swaggerTemplate = `
@@ -197,153 +1528,76 @@ const swaggerTemplate = `
 </html>
 `
 
-func getInfoFromImageStreaming(w http.ResponseWriter, imageUrl, prompt string) error {
-	requestBody, err := json.Marshal(map[string]any{
-		"model":      "gpt-4o",
-		"max_tokens": 4096,
-		"messages": []map[string]any{
-			{
-				"role": "user",
-				"content": []map[string]any{
-					{
-						"type": "text",
-						"text": prompt,
-					},
-					{
-						"type": "image_url",
-						"image_url": map[string]any{
-							"url": imageUrl,
-						},
-					},
-				},
-			},
-		},
-		"stream": true, // Enable streaming
-	})
-	if err != nil {
-		return fmt.Errorf("Error marshalling JSON: %w", err)
-	}
-
-	req, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(requestBody))
-	if err != nil {
-		return fmt.Errorf("Error creating request: %w", err)
-	}
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("Error making request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	// Check for non-OK status code
-	if resp.StatusCode != http.StatusOK {
-		respBody, _ := bufio.NewReader(resp.Body).ReadString('\n')
-		fmt.Printf("Non-OK status code: %d\nBody: %s\n", resp.StatusCode, respBody)
-		return fmt.Errorf("Non-OK status code: %d", resp.StatusCode)
+// writeEvents sends text as server-sent events, one event per line.
+func writeEvents(w http.ResponseWriter, text string) {
+	for _, line := range strings.Split(text, "\n") {
+		fmt.Fprintf(w, "data: %s\n\n", line)
 	}
+	w.(http.Flusher).Flush()
+}
 
-	// Use bufio to read response line by line
-	scanner := bufio.NewScanner(resp.Body)
-	for scanner.Scan() {
-		line := scanner.Text()
-
-		// OpenAI streams each chunk prefixed by "data:"
-		if !strings.HasPrefix(line, "data:") {
-			continue
-		}
-
-		// "data: [DONE]" indicates the end of the stream
-		jsonData := strings.TrimPrefix(line, "data: ")
-		if jsonData == "[DONE]" {
-			fmt.Println("\n--- Stream finished ---")
-			fmt.Fprintf(w, "data: %s\n\n", "[DONE]")
-			w.(http.Flusher).Flush()
-			break
-		}
-
-		// Parse each chunk using gjson
-		result := gjson.Parse(jsonData)
-
-		// The relevant content is in "choices" -> array -> "delta" -> "content"
-		// e.g., result.Get("choices.0.delta.content")
-		content := ""
-		for _, choice := range result.Get("choices").Array() {
-			contentDelta := choice.Get("delta.content").String()
-			content += contentDelta
-		}
-		// Print the chunk of content (if any)
-		if content != "" {
-			fmt.Print(content)
-			fmt.Fprintf(w, "data: %s\n\n", content)
-			w.(http.Flusher).Flush()
-		}
+// writeDone ends a stream with an "event: done" carrying the request id,
+// then the "data: [DONE]" sentinel clients wait for.
+func writeDone(ctx context.Context, w http.ResponseWriter) {
+	done, _ := json.Marshal(map[string]string{"request_id": requestid.FromContext(ctx)})
+	fmt.Fprintf(w, "event: done\ndata: %s\n\n", done)
+	fmt.Fprintf(w, "data: %s\n\n", "[DONE]")
+	w.(http.Flusher).Flush()
+}
 
-		// Sleep for a bit to simulate processing time
-		time.Sleep(100 * time.Millisecond)
-	}
+// writeError ends a stream that failed. The error goes out as plain data,
+// which the frontend shows, and as an "event: error" with the request id.
+func writeError(ctx context.Context, w http.ResponseWriter, err error) {
+	event, _ := json.Marshal(map[string]string{"error": err.Error(), "request_id": requestid.FromContext(ctx)})
+	fmt.Fprintf(w, "data: %s\n\n", err.Error())
+	fmt.Fprintf(w, "event: error\ndata: %s\n\n", event)
+	fmt.Fprintf(w, "data: %s\n\n", "[DONE]")
+	w.(http.Flusher).Flush()
+}
 
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("Error reading streamed response body: %w", err)
+func getInfoFromImageStreaming(ctx context.Context, w http.ResponseWriter, messages []upstream.Message) (error, upstream.Result) {
+	request := upstream.Request{
+		Model:     model,
+		MaxTokens: maxTokens,
+		Messages:  messages,
 	}
 
-	return nil
-}
-
-func getInfoFromImage(imageUrl, prompt string) (error, string) {
-	requestBody, err := json.Marshal(map[string]any{
-		"model":      "gpt-4o",
-		"max_tokens": 4096,
-		"messages": []map[string]any{
-			{
-				"role": "user",
-				"content": []map[string]any{
-					{
-						"type": "text",
-						"text": prompt,
-					},
-					{
-						"type": "image_url",
-						"image_url": map[string]any{
-							"url": imageUrl,
-						},
-					},
-				},
-			},
-		},
+	// Relay each chunk of content to the client as it arrives
+	result, err := upstreamChain.Stream(ctx, request, func(content string) error {
+		fmt.Fprintf(w, "data: %s\n\n", content)
+		w.(http.Flusher).Flush()
+		return nil
 	})
 	if err != nil {
-		return fmt.Errorf("Error marshalling JSON: %w", err), ""
+		return err, result
 	}
+	prices.Apply(&result.Usage, result.Model)
+	logging.From(ctx).Debug("stream finished", "info", result.Text)
+	return nil, result
+}
 
-	req, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(requestBody))
-	if err != nil {
-		return fmt.Errorf("Error creating request: %w", err), ""
-	}
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-	req.Header.Set("Content-Type", "application/json")
+// writeResult reports which model answered and what it cost, then closes
+// the stream.
+func writeResult(ctx context.Context, w http.ResponseWriter, result upstream.Result) {
+	usageJSON, _ := json.Marshal(result.Usage)
+	fmt.Fprintf(w, "event: model\ndata: %s\n\n", modelName(result))
+	fmt.Fprintf(w, "event: usage\ndata: %s\n\n", usageJSON)
+	writeDone(ctx, w)
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("Error making request: %w", err), ""
+func getInfoFromImage(ctx context.Context, messages []upstream.Message) (error, upstream.Result) {
+	request := upstream.Request{
+		Model:     model,
+		MaxTokens: maxTokens,
+		Messages:  messages,
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	result, err := upstreamChain.Complete(ctx, request)
 	if err != nil {
-		return fmt.Errorf("Error reading response body: %w", err), ""
+		return err, result
 	}
+	prices.Apply(&result.Usage, result.Model)
+	logging.From(ctx).Debug("response", "info", result.Text)
 
-	responseString := string(body)
-	// fmt.Println("Response:", responseString)
-
-	result := gjson.Get(responseString, "choices.0.message.content")
-
-	response := result.Str
-	fmt.Println("Response:", response)
-
-	return nil, response
+	return nil, result
 }
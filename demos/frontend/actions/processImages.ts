@@ -1,6 +1,8 @@
 "use server";
 
 import crypto from "node:crypto"
+import { headers } from "next/headers";
+import { traceparent } from "@/lib/traceparent";
 
 export async function extractImageInfo(formData: FormData) {
   try {
@@ -36,18 +38,26 @@ export async function extractImageInfo(formData: FormData) {
     const body = JSON.stringify(payload);
 
     const API_ENDPOINT = process.env.API_ENDPOINT || "http://localhost:8080";
+    // Sent as X-API-Key when the API requires authentication
+    const API_KEY = process.env.API_KEY;
+
+    // Correlates this upload with the API logs and errors
+    const requestId = crypto.randomUUID();
 
     // Send base64 to remote API (replace with your actual API endpoint)
     const response = await fetch(`${API_ENDPOINT}/extract-image-info`, {
       method: "POST",
       headers: {
         "Content-Type": "application/json",
+        "X-Request-ID": requestId,
+        traceparent: traceparent(await headers()),
+        ...(API_KEY ? { "X-API-Key": API_KEY } : {}),
       },
       body,
     });
 
     if (!response.ok) {
-      console.log(`Response status: ${response.status}`);
+      console.log(`Response status: ${response.status} (request ${response.headers.get("X-Request-ID") ?? requestId})`);
       throw new Error("Failed to process image");
     }
 
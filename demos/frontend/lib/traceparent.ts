@@ -0,0 +1,15 @@
+import crypto from "node:crypto";
+
+const TRACEPARENT = /^00-[0-9a-f]{32}-[0-9a-f]{16}-[0-9a-f]{2}$/;
+
+// W3C trace context for a call to the API: continues the caller's trace when
+// the incoming request carries a valid traceparent, otherwise starts one.
+// Each call gets its own parent span id.
+export function traceparent(incoming?: Headers): string {
+  const header = incoming?.get("traceparent")?.trim().toLowerCase();
+  const traceId = header && TRACEPARENT.test(header)
+    ? header.split("-")[1]
+    : crypto.randomBytes(16).toString("hex");
+  const spanId = crypto.randomBytes(8).toString("hex");
+  return `00-${traceId}-${spanId}-01`;
+}
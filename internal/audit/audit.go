@@ -0,0 +1,143 @@
+// Package audit keeps an append-only log of extraction requests: who asked
+// what about which image, which model answered, what it cost and how it
+// ended. Images are recorded by hash only. The log is newline delimited
+// JSON, rotated by size.
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Outcomes of a request.
+const (
+	OutcomeOK         = "ok"
+	OutcomeCached     = "cached"     // answered from the result cache
+	OutcomeReplayed   = "replayed"   // answered from the idempotency store
+	OutcomeInvalid    = "invalid"    // rejected by the schema
+	OutcomeConflict   = "conflict"   // idempotency key conflict
+	OutcomeOverloaded = "overloaded" // upstream queue full
+	OutcomeError      = "error"      // upstream failure
+)
+
+// Entry is one audited request.
+type Entry struct {
+	Time             time.Time `json:"time"`
+	RequestID        string    `json:"request_id"`
+	Key              string    `json:"key"`
+	ImageSHA256      string    `json:"image_sha256"`
+	Prompt           string    `json:"prompt"`
+	Model            string    `json:"model,omitempty"`
+	Stream           bool      `json:"stream"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	TotalTokens      int       `json:"total_tokens"`
+	CostUSD          float64   `json:"cost_usd"`
+	Outcome          string    `json:"outcome"`
+	Error            string    `json:"error,omitempty"`
+	LatencyMS        int64     `json:"latency_ms"`
+}
+
+// HashImage returns the hex SHA-256 of an image.
+func HashImage(image []byte) string {
+	sum := sha256.Sum256(image)
+	return hex.EncodeToString(sum[:])
+}
+
+// Log appends entries to a file, rotating it once it reaches MaxSize bytes
+// and keeping MaxFiles rotated files named path.1 (newest) to path.N.
+// A nil *Log records nothing.
+type Log struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// Open opens, or creates, the log at path.
+func Open(path string, maxSize int64, maxFiles int) (*Log, error) {
+	l := &Log{path: path, maxSize: maxSize, maxFiles: max(maxFiles, 1)}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("error opening audit log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("error opening audit log: %w", err)
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+// Record appends e to the log.
+func (l *Log) Record(e Entry) error {
+	if l == nil {
+		return nil
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("error writing audit log: %w", err)
+	}
+	return nil
+}
+
+// rotate shifts path.N-1 to path.N, down to path to path.1, dropping the
+// oldest file, and starts a new log.
+func (l *Log) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return fmt.Errorf("error rotating audit log: %w", err)
+	}
+	os.Remove(rotated(l.path, l.maxFiles))
+	for n := l.maxFiles - 1; n >= 1; n-- {
+		os.Rename(rotated(l.path, n), rotated(l.path, n+1))
+	}
+	if err := os.Rename(l.path, rotated(l.path, 1)); err != nil {
+		return fmt.Errorf("error rotating audit log: %w", err)
+	}
+	return l.open()
+}
+
+// Close closes the log file.
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+func rotated(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
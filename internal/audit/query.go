@@ -0,0 +1,120 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Filter selects entries. Zero fields match everything.
+type Filter struct {
+	Since   time.Time
+	Until   time.Time
+	Key     string
+	Outcome string
+}
+
+// Match reports whether e passes f.
+func (f Filter) Match(e Entry) bool {
+	switch {
+	case !f.Since.IsZero() && e.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !e.Time.Before(f.Until):
+		return false
+	case f.Key != "" && e.Key != f.Key:
+		return false
+	case f.Outcome != "" && e.Outcome != f.Outcome:
+		return false
+	}
+	return true
+}
+
+// Query reads the log at path and its rotated files, oldest first, and
+// returns the entries passing f.
+func Query(path string, f Filter) ([]Entry, error) {
+	var paths []string
+	for n := 1; ; n++ {
+		if _, err := os.Stat(rotated(path, n)); err != nil {
+			break
+		}
+		paths = append([]string{rotated(path, n)}, paths...)
+	}
+	paths = append(paths, path)
+
+	var entries []Entry
+	for _, p := range paths {
+		file, err := os.Open(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading audit log: %w", err)
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			var e Entry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("%s:%d: %w", p, line, err)
+			}
+			if f.Match(e) {
+				entries = append(entries, e)
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading audit log: %w", err)
+		}
+	}
+	return entries, nil
+}
+
+// WriteNDJSON writes entries as newline delimited JSON.
+func WriteNDJSON(w io.Writer, entries []Entry) error {
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteCSV writes entries as CSV with a header row.
+func WriteCSV(w io.Writer, entries []Entry) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{
+		"time", "request_id", "key", "image_sha256", "prompt", "model", "stream",
+		"prompt_tokens", "completion_tokens", "total_tokens", "cost_usd",
+		"outcome", "error", "latency_ms",
+	})
+	for _, e := range entries {
+		cw.Write([]string{
+			e.Time.Format(time.RFC3339Nano),
+			e.RequestID,
+			e.Key,
+			e.ImageSHA256,
+			e.Prompt,
+			e.Model,
+			strconv.FormatBool(e.Stream),
+			strconv.Itoa(e.PromptTokens),
+			strconv.Itoa(e.CompletionTokens),
+			strconv.Itoa(e.TotalTokens),
+			strconv.FormatFloat(e.CostUSD, 'f', -1, 64),
+			e.Outcome,
+			e.Error,
+			strconv.FormatInt(e.LatencyMS, 10),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
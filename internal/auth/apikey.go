@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// APIKeys authenticates the X-API-Key header against a keys file:
+//
+//	keys:
+//	  - name: frontend
+//	    key: sk-local-frontend
+//	    scopes: [images:extract]
+//	  - name: ops
+//	    key: sk-local-ops
+//	    scopes: [images:extract, users:write, usage:read, usage:admin]
+//
+// The same file carries the budgets read by the quota package.
+type APIKeys struct {
+	byHash map[[sha256.Size]byte]*Principal
+}
+
+type apiKeysFile struct {
+	Keys []struct {
+		Name   string   `yaml:"name"`
+		Key    string   `yaml:"key"`
+		Scopes []string `yaml:"scopes"`
+	} `yaml:"keys"`
+}
+
+// LoadAPIKeys reads a keys file.
+func LoadAPIKeys(path string) (*APIKeys, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading keys file: %w", err)
+	}
+	var file apiKeysFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("error parsing keys file: %w", err)
+	}
+
+	// Keys are looked up by hash so comparisons do not leak the secret
+	keys := &APIKeys{byHash: make(map[[sha256.Size]byte]*Principal)}
+	for i, k := range file.Keys {
+		if k.Name == "" || k.Key == "" {
+			return nil, fmt.Errorf("keys file entry %d needs a name and a key", i+1)
+		}
+		keys.byHash[sha256.Sum256([]byte(k.Key))] = &Principal{Name: k.Name, Scopes: k.Scopes, Method: "api_key"}
+	}
+	return keys, nil
+}
+
+func (k *APIKeys) Authenticate(r *http.Request) (*Principal, error) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+	p, ok := k.byHash[sha256.Sum256([]byte(key))]
+	if !ok {
+		return nil, fmt.Errorf("unknown API key")
+	}
+	return p, nil
+}
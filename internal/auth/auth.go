@@ -0,0 +1,164 @@
+// Package auth authenticates requests with static API keys or JWTs signed
+// with keys from a local JWKS file, and guards routes by scope.
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"ubuntuhive.tech/gonovella/internal/logging"
+	"ubuntuhive.tech/gonovella/internal/problem"
+)
+
+// ErrNoCredentials is returned by a method when the request carries no
+// credentials meant for it, so the next method can have a go.
+var ErrNoCredentials = errors.New("no credentials")
+
+// Principal is an authenticated caller.
+type Principal struct {
+	Name   string
+	Scopes []string
+	Method string // "api_key" or "jwt"
+}
+
+// HasScope reports whether p was granted scope.
+func (p *Principal) HasScope(scope string) bool {
+	return slices.Contains(p.Scopes, scope)
+}
+
+// Method authenticates a request one way.
+type Method interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+type principalKey struct{}
+
+// FromContext returns the principal of an authenticated request.
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
+
+// Authenticator tries its methods in order. A nil *Authenticator lets
+// every request through, which keeps the demos open until auth is set up.
+type Authenticator struct {
+	methods []Method
+	apiKeys bool
+	jwt     bool
+}
+
+// New returns an authenticator trying methods in order.
+func New(methods ...Method) *Authenticator {
+	a := &Authenticator{methods: methods}
+	for _, m := range methods {
+		switch m.(type) {
+		case *APIKeys:
+			a.apiKeys = true
+		case *JWT:
+			a.jwt = true
+		}
+	}
+	return a
+}
+
+// FromEnv configures an authenticator from the environment:
+//
+//	API_KEYS          YAML keys file, shared with quota, with scopes per key
+//	JWKS_FILE         JSON Web Key Set used to verify bearer JWTs
+//	JWT_ISSUER        required iss claim, optional
+//	JWT_AUDIENCE      required aud claim, optional
+//	JWT_ALLOW_NO_EXP  "true" accepts tokens without an exp claim
+//
+// It returns nil when neither API_KEYS nor JWKS_FILE is set.
+func FromEnv() (*Authenticator, error) {
+	var methods []Method
+	if path := os.Getenv("API_KEYS"); path != "" {
+		keys, err := LoadAPIKeys(path)
+		if err != nil {
+			return nil, err
+		}
+		methods = append(methods, keys)
+	}
+	if path := os.Getenv("JWKS_FILE"); path != "" {
+		jwt, err := LoadJWKS(path)
+		if err != nil {
+			return nil, err
+		}
+		jwt.Issuer = os.Getenv("JWT_ISSUER")
+		jwt.Audience = os.Getenv("JWT_AUDIENCE")
+		jwt.AllowNoExpiry = os.Getenv("JWT_ALLOW_NO_EXP") == "true"
+		methods = append(methods, jwt)
+	}
+	if len(methods) == 0 {
+		return nil, nil
+	}
+	return New(methods...), nil
+}
+
+// Authenticate returns the principal of the first method that recognises
+// the request's credentials.
+func (a *Authenticator) Authenticate(r *http.Request) (*Principal, error) {
+	for _, m := range a.methods {
+		p, err := m.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return p, err
+	}
+	return nil, ErrNoCredentials
+}
+
+// Require returns middleware admitting only callers granted scope. An
+// empty scope admits any authenticated caller.
+func (a *Authenticator) Require(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if a == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, err := a.Authenticate(r)
+			if err != nil {
+				if !errors.Is(err, ErrNoCredentials) {
+					logging.From(r.Context()).Warn("rejected credentials", "path", r.URL.Path, "error", err)
+				}
+				w.Header().Set("WWW-Authenticate", a.challenge(""))
+				problem.Write(w, http.StatusUnauthorized, authError(err))
+				return
+			}
+			if scope != "" && !p.HasScope(scope) {
+				w.Header().Set("WWW-Authenticate", a.challenge(scope))
+				problem.Write(w, http.StatusForbidden, fmt.Sprintf("%s lacks the %s scope", p.Name, scope))
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+		})
+	}
+}
+
+// challenge builds the WWW-Authenticate header value.
+func (a *Authenticator) challenge(scope string) string {
+	var schemes []string
+	if a.jwt {
+		if scope != "" {
+			schemes = append(schemes, fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, scope))
+		} else {
+			schemes = append(schemes, "Bearer")
+		}
+	}
+	if a.apiKeys {
+		schemes = append(schemes, `ApiKey header="X-API-Key"`)
+	}
+	return strings.Join(schemes, ", ")
+}
+
+func authError(err error) string {
+	if errors.Is(err, ErrNoCredentials) {
+		return "missing credentials"
+	}
+	return "invalid credentials"
+}
@@ -0,0 +1,222 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// JWT authenticates bearer tokens signed with HS256/384/512 or
+// RS256/384/512 by a key from a local JWKS file. The principal is the sub
+// claim and its scopes come from the scope (space separated) or scp claim.
+// Tokens must carry an exp claim unless AllowNoExpiry is set.
+type JWT struct {
+	keys []jwk
+
+	// Issuer and Audience, when set, must match the iss and aud claims.
+	Issuer   string
+	Audience string
+
+	// Leeway tolerates clock skew when checking exp and nbf.
+	Leeway time.Duration
+
+	// AllowNoExpiry accepts tokens without an exp claim, which never
+	// expire.
+	AllowNoExpiry bool
+}
+
+// minSecretBytes is the shortest "oct" secret accepted, the size of an
+// HS256 hash; shorter secrets can be brute-forced from a single token.
+const minSecretBytes = 32
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	K   string `json:"k"` // oct
+	N   string `json:"n"` // RSA
+	E   string `json:"e"` // RSA
+
+	secret []byte
+	public *rsa.PublicKey
+}
+
+// LoadJWKS reads a JSON Web Key Set holding "oct" and "RSA" keys.
+func LoadJWKS(path string) (*JWT, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading JWKS file: %w", err)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("error parsing JWKS file: %w", err)
+	}
+
+	for i := range set.Keys {
+		k := &set.Keys[i]
+		switch k.Kty {
+		case "oct":
+			if k.secret, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(k.K, "=")); err != nil {
+				return nil, fmt.Errorf("JWKS key %q: bad k: %w", k.Kid, err)
+			}
+			if len(k.secret) < minSecretBytes {
+				return nil, fmt.Errorf("JWKS key %q: secret of %d bytes, at least %d required", k.Kid, len(k.secret), minSecretBytes)
+			}
+		case "RSA":
+			n, err := decodeBigInt(k.N)
+			if err != nil {
+				return nil, fmt.Errorf("JWKS key %q: bad n: %w", k.Kid, err)
+			}
+			e, err := decodeBigInt(k.E)
+			if err != nil {
+				return nil, fmt.Errorf("JWKS key %q: bad e: %w", k.Kid, err)
+			}
+			k.public = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		default:
+			return nil, fmt.Errorf("JWKS key %q: unsupported key type %q", k.Kid, k.Kty)
+		}
+	}
+	return &JWT{keys: set.Keys, Leeway: time.Minute}, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+var hashes = map[string]crypto.Hash{
+	"HS256": crypto.SHA256, "HS384": crypto.SHA384, "HS512": crypto.SHA512,
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+}
+
+func (j *JWT) Authenticate(r *http.Request) (*Principal, error) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return nil, ErrNoCredentials
+	}
+
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("bad token header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("bad token signature: %w", err)
+	}
+	if err := j.verify(header.Alg, header.Kid, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims struct {
+		Sub   string          `json:"sub"`
+		Iss   string          `json:"iss"`
+		Aud   json.RawMessage `json:"aud"`
+		Exp   *float64        `json:"exp"`
+		Nbf   *float64        `json:"nbf"`
+		Scope string          `json:"scope"`
+		Scp   json.RawMessage `json:"scp"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("bad token claims: %w", err)
+	}
+
+	now := time.Now()
+	if claims.Exp == nil && !j.AllowNoExpiry {
+		return nil, errors.New("token has no expiry")
+	}
+	if claims.Exp != nil && now.After(time.Unix(int64(*claims.Exp), 0).Add(j.Leeway)) {
+		return nil, errors.New("token expired")
+	}
+	if claims.Nbf != nil && now.Add(j.Leeway).Before(time.Unix(int64(*claims.Nbf), 0)) {
+		return nil, errors.New("token not valid yet")
+	}
+	if j.Issuer != "" && claims.Iss != j.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", claims.Iss)
+	}
+	if j.Audience != "" && !slices.Contains(stringOrList(claims.Aud), j.Audience) {
+		return nil, errors.New("token not meant for this audience")
+	}
+	if claims.Sub == "" {
+		return nil, errors.New("token has no subject")
+	}
+
+	scopes := strings.Fields(claims.Scope)
+	scopes = append(scopes, stringOrList(claims.Scp)...)
+	return &Principal{Name: claims.Sub, Scopes: scopes, Method: "jwt"}, nil
+}
+
+// verify checks signature against every key that fits alg and kid.
+func (j *JWT) verify(alg, kid, signingInput string, signature []byte) error {
+	hash, ok := hashes[alg]
+	if !ok {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	for _, k := range j.keys {
+		if (kid != "" && k.Kid != kid) || (k.Alg != "" && k.Alg != alg) {
+			continue
+		}
+		h := hash.New()
+		switch {
+		case strings.HasPrefix(alg, "HS") && k.secret != nil:
+			mac := hmac.New(hash.New, k.secret)
+			mac.Write([]byte(signingInput))
+			if hmac.Equal(mac.Sum(nil), signature) {
+				return nil
+			}
+		case strings.HasPrefix(alg, "RS") && k.public != nil:
+			h.Write([]byte(signingInput))
+			if rsa.VerifyPKCS1v15(k.public, hash, h.Sum(nil), signature) == nil {
+				return nil
+			}
+		}
+	}
+	return errors.New("token signature does not match any key")
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// stringOrList decodes a claim that is either a string or a list of them.
+func stringOrList(raw json.RawMessage) []string {
+	if len(raw) == 0 {
+		return nil
+	}
+	var list []string
+	if json.Unmarshal(raw, &list) == nil {
+		return list
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return strings.Fields(s)
+	}
+	return nil
+}
@@ -0,0 +1,312 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testSecret = []byte("0123456789abcdef0123456789abcdef")
+	testRSA    *rsa.PrivateKey
+)
+
+func TestMain(m *testing.M) {
+	var err error
+	if testRSA, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// writeJWKS writes keys as a JWKS file and loads it.
+func writeJWKS(t *testing.T, keys ...map[string]string) (*JWT, error) {
+	t.Helper()
+	data, err := json.Marshal(map[string]any{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return LoadJWKS(path)
+}
+
+func testJWT(t *testing.T) *JWT {
+	t.Helper()
+	j, err := writeJWKS(t,
+		map[string]string{"kty": "oct", "kid": "hmac", "alg": "HS256", "k": b64(testSecret)},
+		map[string]string{"kty": "RSA", "kid": "rsa", "n": b64(testRSA.N.Bytes()), "e": b64(big.NewInt(int64(testRSA.E)).Bytes())},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+// sign makes a token of claims with header, signed by key: a []byte HMAC
+// secret or an RSA private key. Other keys leave the signature empty.
+func sign(t *testing.T, header, claims map[string]any, key any) string {
+	t.Helper()
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	input := b64(h) + "." + b64(c)
+	hash := hashes[header["alg"].(string)]
+	var signature []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(hash.New, key)
+		mac.Write([]byte(input))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		digest := hash.New()
+		digest.Write([]byte(input))
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, key, hash, digest.Sum(nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return input + "." + b64(signature)
+}
+
+func claims(extra map[string]any) map[string]any {
+	c := map[string]any{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix(), "scope": "images:extract"}
+	for k, v := range extra {
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+	}
+	return c
+}
+
+func authenticate(j *JWT, token string) (*Principal, error) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return j.Authenticate(r)
+}
+
+func TestJWTSignature(t *testing.T) {
+	j := testJWT(t)
+	hs := map[string]any{"alg": "HS256", "kid": "hmac"}
+	rs := map[string]any{"alg": "RS256", "kid": "rsa"}
+	otherRSA, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := sign(t, hs, claims(nil), testSecret)
+	parts := strings.Split(valid, ".")
+	tampered, _ := json.Marshal(claims(map[string]any{"sub": "mallory"}))
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"HS256", valid, true},
+		{"RS256", sign(t, rs, claims(nil), testRSA), true},
+		{"RS512", sign(t, map[string]any{"alg": "RS512"}, claims(nil), testRSA), true},
+		{"no kid", sign(t, map[string]any{"alg": "HS256"}, claims(nil), testSecret), true},
+		{"wrong secret", sign(t, hs, claims(nil), []byte("fedcba9876543210fedcba9876543210")), false},
+		{"wrong RSA key", sign(t, rs, claims(nil), otherRSA), false},
+		{"tampered claims", parts[0] + "." + b64(tampered) + "." + parts[2], false},
+		{"no signature", parts[0] + "." + parts[1] + ".", false},
+		{"unknown kid", sign(t, map[string]any{"alg": "HS256", "kid": "other"}, claims(nil), testSecret), false},
+		{"alg not allowed for the key", sign(t, map[string]any{"alg": "HS512", "kid": "hmac"}, claims(nil), testSecret), false},
+		{"alg none", sign(t, map[string]any{"alg": "none"}, claims(nil), nil), false},
+		{"malformed", "not.a-token", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := authenticate(j, tt.token)
+			if tt.ok && (err != nil || p.Name != "alice") {
+				t.Errorf("Authenticate() = %v, %v, want alice", p, err)
+			}
+			if !tt.ok && err == nil {
+				t.Errorf("Authenticate() accepted the token as %v", p)
+			}
+		})
+	}
+}
+
+// TestJWTAlgConfusion signs HS256 tokens with the RSA public key as the
+// HMAC secret, which verifiers that let the token pick the algorithm for a
+// key accept.
+func TestJWTAlgConfusion(t *testing.T) {
+	j := testJWT(t)
+	for name, secret := range map[string][]byte{
+		"modulus":  testRSA.N.Bytes(),
+		"jwk n":    []byte(b64(testRSA.N.Bytes())),
+		"exponent": big.NewInt(int64(testRSA.E)).Bytes(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			for _, header := range []map[string]any{
+				{"alg": "HS256", "kid": "rsa"},
+				{"alg": "HS256"},
+			} {
+				if p, err := authenticate(j, sign(t, header, claims(nil), secret)); err == nil {
+					t.Errorf("HS256 token signed with the RSA key accepted as %v", p)
+				}
+			}
+		})
+	}
+
+	// An RS256 header over an HMAC signature fails too
+	hmacSigned := strings.Split(sign(t, map[string]any{"alg": "HS256", "kid": "hmac"}, claims(nil), testSecret), ".")
+	header, _ := json.Marshal(map[string]any{"alg": "RS256", "kid": "hmac"})
+	if p, err := authenticate(j, b64(header)+"."+hmacSigned[1]+"."+hmacSigned[2]); err == nil {
+		t.Errorf("RS256 token with an HMAC signature accepted as %v", p)
+	}
+}
+
+func TestJWTTimes(t *testing.T) {
+	j := testJWT(t)
+	now := time.Now()
+	tests := []struct {
+		name   string
+		claims map[string]any
+		ok     bool
+	}{
+		{"valid", claims(nil), true},
+		{"expired", claims(map[string]any{"exp": now.Add(-time.Hour).Unix()}), false},
+		{"expired within leeway", claims(map[string]any{"exp": now.Add(-30 * time.Second).Unix()}), true},
+		{"no exp", claims(map[string]any{"exp": nil}), false},
+		{"not valid yet", claims(map[string]any{"nbf": now.Add(time.Hour).Unix()}), false},
+		{"nbf within leeway", claims(map[string]any{"nbf": now.Add(30 * time.Second).Unix()}), true},
+		{"nbf past", claims(map[string]any{"nbf": now.Add(-time.Hour).Unix()}), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := authenticate(j, sign(t, map[string]any{"alg": "HS256"}, tt.claims, testSecret))
+			if tt.ok != (err == nil) {
+				t.Errorf("Authenticate() error = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+
+	j.AllowNoExpiry = true
+	if _, err := authenticate(j, sign(t, map[string]any{"alg": "HS256"}, claims(map[string]any{"exp": nil}), testSecret)); err != nil {
+		t.Errorf("token without exp refused with AllowNoExpiry: %v", err)
+	}
+}
+
+func TestJWTClaims(t *testing.T) {
+	j := testJWT(t)
+	j.Issuer, j.Audience = "https://issuer.example", "gonovella"
+	base := map[string]any{"iss": "https://issuer.example", "aud": "gonovella"}
+	with := func(extra map[string]any) map[string]any {
+		c := claims(base)
+		for k, v := range extra {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	tests := []struct {
+		name   string
+		claims map[string]any
+		ok     bool
+	}{
+		{"valid", with(nil), true},
+		{"audience list", with(map[string]any{"aud": []string{"other", "gonovella"}}), true},
+		{"wrong issuer", with(map[string]any{"iss": "https://evil.example"}), false},
+		{"wrong audience", with(map[string]any{"aud": "other"}), false},
+		{"no audience", with(map[string]any{"aud": nil}), false},
+		{"no subject", with(map[string]any{"sub": nil}), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := authenticate(j, sign(t, map[string]any{"alg": "HS256"}, tt.claims, testSecret))
+			if tt.ok != (err == nil) {
+				t.Errorf("Authenticate() error = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestJWTScopes(t *testing.T) {
+	j := testJWT(t)
+	a := New(j)
+	handler := a.Require("images:extract")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := FromContext(r.Context())
+		w.Write([]byte(p.Name))
+	}))
+	tests := []struct {
+		name   string
+		claims map[string]any
+		status int
+	}{
+		{"scope claim", claims(nil), http.StatusOK},
+		{"one of several scopes", claims(map[string]any{"scope": "usage:read images:extract"}), http.StatusOK},
+		{"scp list", claims(map[string]any{"scope": nil, "scp": []string{"images:extract"}}), http.StatusOK},
+		{"scp string", claims(map[string]any{"scope": nil, "scp": "usage:read images:extract"}), http.StatusOK},
+		{"other scope", claims(map[string]any{"scope": "usage:read"}), http.StatusForbidden},
+		{"scope prefix", claims(map[string]any{"scope": "images"}), http.StatusForbidden},
+		{"no scope", claims(map[string]any{"scope": nil}), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Authorization", "Bearer "+sign(t, map[string]any{"alg": "HS256"}, tt.claims, testSecret))
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.status == http.StatusForbidden && !strings.Contains(w.Header().Get("WWW-Authenticate"), `error="insufficient_scope"`) {
+				t.Errorf("WWW-Authenticate = %q, want insufficient_scope", w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status without a token = %d, want 401", w.Code)
+	}
+}
+
+func TestLoadJWKS(t *testing.T) {
+	tests := []struct {
+		name string
+		key  map[string]string
+		ok   bool
+	}{
+		{"32 byte secret", map[string]string{"kty": "oct", "k": b64(testSecret)}, true},
+		{"padded 31 byte secret", map[string]string{"kty": "oct", "k": base64.URLEncoding.EncodeToString(testSecret[:31])}, false},
+		{"short secret", map[string]string{"kty": "oct", "k": b64([]byte("secret"))}, false},
+		{"empty secret", map[string]string{"kty": "oct"}, false},
+		{"bad base64", map[string]string{"kty": "oct", "k": "!!!"}, false},
+		{"RSA", map[string]string{"kty": "RSA", "n": b64(testRSA.N.Bytes()), "e": "AQAB"}, true},
+		{"unsupported type", map[string]string{"kty": "EC"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := writeJWKS(t, tt.key)
+			if tt.ok != (err == nil) {
+				t.Errorf("LoadJWKS() error = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
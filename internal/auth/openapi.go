@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Route is an endpoint and the scope it requires.
+type Route struct {
+	Pattern string // http.ServeMux pattern such as "POST /extract-image-info"
+	Scope   string
+	Handler http.Handler
+}
+
+// Handle registers routes on mux, each behind Require(route.Scope).
+func (a *Authenticator) Handle(mux *http.ServeMux, routes []Route) {
+	for _, route := range routes {
+		mux.Handle(route.Pattern, a.Require(route.Scope)(route.Handler))
+	}
+}
+
+// Document adds security schemes matching a's methods to an OpenAPI
+// document and marks each operation served by one of routes with its
+// security requirement and scope, so Swagger UI can authorize.
+func (a *Authenticator) Document(spec []byte, routes []Route) ([]byte, error) {
+	if a == nil {
+		return spec, nil
+	}
+
+	var doc map[string]any
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return nil, fmt.Errorf("error parsing OpenAPI document: %w", err)
+	}
+
+	schemes := map[string]any{}
+	var requirements []any
+	if a.apiKeys {
+		schemes["ApiKeyAuth"] = map[string]any{"type": "apiKey", "in": "header", "name": "X-API-Key"}
+		requirements = append(requirements, map[string]any{"ApiKeyAuth": []any{}})
+	}
+	if a.jwt {
+		schemes["BearerAuth"] = map[string]any{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"}
+		requirements = append(requirements, map[string]any{"BearerAuth": []any{}})
+	}
+	components, _ := doc["components"].(map[string]any)
+	if components == nil {
+		components = map[string]any{}
+		doc["components"] = components
+	}
+	components["securitySchemes"] = schemes
+
+	paths, _ := doc["paths"].(map[string]any)
+	for path, item := range paths {
+		operations, _ := item.(map[string]any)
+		for method, op := range operations {
+			operation, ok := op.(map[string]any)
+			if !ok {
+				continue
+			}
+			route, ok := matchRoute(routes, strings.ToUpper(method), path)
+			if !ok {
+				continue
+			}
+			operation["security"] = requirements
+			if route.Scope != "" {
+				operation["x-required-scopes"] = []string{route.Scope}
+				description, _ := operation["description"].(string)
+				operation["description"] = strings.TrimSpace(description + "\n\nRequires the `" + route.Scope + "` scope.")
+			}
+		}
+	}
+
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// matchRoute finds the route serving method and path. Patterns ending in a
+// slash match every path below them, as they do in http.ServeMux.
+func matchRoute(routes []Route, method, path string) (Route, bool) {
+	for _, route := range routes {
+		routeMethod, routePath, ok := strings.Cut(route.Pattern, " ")
+		if !ok {
+			routeMethod, routePath = "", route.Pattern
+		}
+		if routeMethod != "" && routeMethod != method {
+			continue
+		}
+		if routePath == path || (strings.HasSuffix(routePath, "/") && strings.HasPrefix(path, routePath)) {
+			return route, true
+		}
+	}
+	return Route{}, false
+}
@@ -0,0 +1,250 @@
+// Package batch runs image extraction over many files with a worker pool,
+// a rate limit on upstream calls and a checkpoint that lets an interrupted
+// run resume where it stopped.
+package batch
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"ubuntuhive.tech/gonovella/internal/ratelimit"
+	"ubuntuhive.tech/gonovella/internal/usage"
+)
+
+// Extensions are the image files a directory walk picks up.
+var Extensions = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true}
+
+// Job is an image to process.
+type Job struct {
+	Path   string
+	Image  []byte
+	SHA256 string
+}
+
+// Result is the outcome of one image, as written to NDJSON and sidecars.
+type Result struct {
+	Path   string       `json:"path"`
+	SHA256 string       `json:"sha256"`
+	Info   string       `json:"info,omitempty"`
+	Model  string       `json:"model,omitempty"`
+	Usage  *usage.Usage `json:"usage,omitempty"`
+	Cached bool         `json:"cached,omitempty"`
+	Error  string       `json:"error,omitempty"`
+	Time   time.Time    `json:"time"`
+}
+
+// Summary counts what a run did with its files.
+type Summary struct {
+	Processed int // results emitted without error
+	Skipped   int // already in the checkpoint, or a duplicate of another file
+	Failed    int
+}
+
+// Options configure Run.
+type Options struct {
+	Concurrency int
+	// Prompt is part of the checkpoint key, so that changing it processes
+	// every image again.
+	Prompt     string
+	Checkpoint *Checkpoint
+}
+
+// Files returns the files named by roots, sorted and without duplicates.
+// Directories are walked for images with one of the Extensions and glob
+// patterns are expanded; other files are taken as they are.
+func Files(roots []string) ([]string, error) {
+	seen := map[string]bool{}
+	var files []string
+	add := func(path string) {
+		if !seen[path] {
+			seen[path] = true
+			files = append(files, path)
+		}
+	}
+	for _, root := range roots {
+		matches := []string{root}
+		if strings.ContainsAny(root, "*?[") {
+			var err error
+			if matches, err = filepath.Glob(root); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %w", root, err)
+			}
+		}
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, err
+			}
+			if !info.IsDir() {
+				add(match)
+				continue
+			}
+			err = filepath.WalkDir(match, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if !d.IsDir() && Extensions[strings.ToLower(filepath.Ext(path))] {
+					add(path)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// Key identifies an image and prompt pair in the checkpoint.
+func Key(imageSHA256, prompt string) string {
+	sum := sha256.Sum256([]byte(imageSHA256 + "\n" + prompt))
+	return hex.EncodeToString(sum[:])
+}
+
+// Run processes files on Concurrency workers. Files whose image and prompt
+// the checkpoint holds, or that repeat an image already taken up by this
+// run, are skipped. emit receives every result, one at a time; successful
+// ones are then recorded in the checkpoint. When ctx is cancelled no new
+// files are started and the results of the interrupted ones are dropped,
+// so that a rerun picks them up.
+func Run(ctx context.Context, files []string, options Options, process func(context.Context, Job) Result, emit func(Result) error) (Summary, error) {
+	workers := max(options.Concurrency, 1)
+	jobs := make(chan string)
+	var (
+		mu      sync.Mutex
+		summary Summary
+		taken   = map[string]bool{}
+		failure error
+		wg      sync.WaitGroup
+	)
+
+	// finish emits a result and records it, stopping the run on errors
+	// from emit or the checkpoint.
+	finish := func(key string, r Result) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failure != nil {
+			return
+		}
+		if err := emit(r); err != nil {
+			failure = err
+			return
+		}
+		if r.Error != "" {
+			summary.Failed++
+			delete(taken, key)
+			return
+		}
+		summary.Processed++
+		if err := options.Checkpoint.Record(key, r); err != nil {
+			failure = err
+		}
+	}
+
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range jobs {
+				image, err := os.ReadFile(path)
+				if err != nil {
+					finish("", Result{Path: path, Error: err.Error(), Time: time.Now()})
+					continue
+				}
+				sum := sha256.Sum256(image)
+				job := Job{Path: path, Image: image, SHA256: hex.EncodeToString(sum[:])}
+				key := Key(job.SHA256, options.Prompt)
+
+				mu.Lock()
+				skip := taken[key] || options.Checkpoint.Done(key)
+				if skip {
+					summary.Skipped++
+				}
+				taken[key] = true
+				mu.Unlock()
+				if skip {
+					continue
+				}
+
+				r := process(ctx, job)
+				if ctx.Err() != nil {
+					continue
+				}
+				r.Path, r.SHA256 = job.Path, job.SHA256
+				if r.Time.IsZero() {
+					r.Time = time.Now()
+				}
+				finish(key, r)
+			}
+		}()
+	}
+
+feed:
+	for _, path := range files {
+		mu.Lock()
+		stop := failure != nil
+		mu.Unlock()
+		if stop {
+			break
+		}
+		select {
+		case jobs <- path:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if failure != nil {
+		return summary, failure
+	}
+	return summary, ctx.Err()
+}
+
+// Limiter spaces out upstream calls across all workers. A nil *Limiter
+// does not limit.
+type Limiter struct {
+	rate  ratelimit.Rate
+	store *ratelimit.Memory
+}
+
+// NewLimiter allows requests calls per minute, or returns nil when requests
+// is not positive.
+func NewLimiter(requests int) *Limiter {
+	if requests <= 0 {
+		return nil
+	}
+	return &Limiter{
+		rate:  ratelimit.Rate{Requests: requests, Per: time.Minute, Burst: 1},
+		store: ratelimit.NewMemory(),
+	}
+}
+
+// Wait blocks until a call is allowed or ctx is done.
+func (l *Limiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	for {
+		ok, retryAfter, err := l.store.Take("batch", l.rate, time.Now())
+		if err != nil || ok {
+			return err
+		}
+		select {
+		case <-time.After(retryAfter):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package batch
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+type checkpointEntry struct {
+	Key  string    `json:"key"`
+	Path string    `json:"path"`
+	Time time.Time `json:"time"`
+}
+
+// Checkpoint records the images a batch has processed, one NDJSON line per
+// image, so that a rerun skips them. A nil *Checkpoint records nothing.
+type Checkpoint struct {
+	file *os.File
+	done map[string]bool
+}
+
+// OpenCheckpoint reads the checkpoint at path, creating it if needed, and
+// appends to it from then on. A truncated last line, left by an
+// interrupted write, is ignored.
+func OpenCheckpoint(path string) (*Checkpoint, error) {
+	c := &Checkpoint{done: map[string]bool{}}
+	file, err := os.Open(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("error reading checkpoint: %w", err)
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var entry checkpointEntry
+			if json.Unmarshal(scanner.Bytes(), &entry) == nil && entry.Key != "" {
+				c.done[entry.Key] = true
+			}
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("error reading checkpoint: %w", err)
+		}
+	}
+
+	if c.file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return nil, fmt.Errorf("error opening checkpoint: %w", err)
+	}
+	return c, nil
+}
+
+// Done reports whether key was processed by this or an earlier run.
+func (c *Checkpoint) Done(key string) bool {
+	return c != nil && c.done[key]
+}
+
+// Record marks key as processed. Callers serialise calls.
+func (c *Checkpoint) Record(key string, r Result) error {
+	if c == nil {
+		return nil
+	}
+	line, err := json.Marshal(checkpointEntry{Key: key, Path: r.Path, Time: r.Time})
+	if err != nil {
+		return err
+	}
+	if _, err := c.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("error writing checkpoint: %w", err)
+	}
+	c.done[key] = true
+	return nil
+}
+
+// Close closes the checkpoint file.
+func (c *Checkpoint) Close() error {
+	if c == nil {
+		return nil
+	}
+	return c.file.Close()
+}
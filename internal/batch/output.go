@@ -0,0 +1,50 @@
+package batch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// WriteNDJSON writes r as one JSON line.
+func WriteNDJSON(w io.Writer, r Result) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
+
+// SidecarPath returns the sidecar file of the image at path, which keeps
+// the image extension so that photo.jpg and photo.png do not collide.
+func SidecarPath(path, format string) string {
+	return path + "." + format
+}
+
+// WriteSidecar writes a successful result next to its image, as markdown
+// (format "md") or JSON (format "json").
+func WriteSidecar(r Result, format string) error {
+	if r.Error != "" {
+		return nil
+	}
+	var data []byte
+	switch format {
+	case "md":
+		data = []byte(strings.TrimRight(r.Info, "\n") + "\n")
+	case "json":
+		var err error
+		if data, err = json.MarshalIndent(r, "", "  "); err != nil {
+			return err
+		}
+		data = append(data, '\n')
+	default:
+		return fmt.Errorf("unknown sidecar format %q (want md or json)", format)
+	}
+	if err := os.WriteFile(SidecarPath(r.Path, format), data, 0644); err != nil {
+		return fmt.Errorf("error writing sidecar: %w", err)
+	}
+	return nil
+}
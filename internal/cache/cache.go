@@ -0,0 +1,74 @@
+// Package cache stores extraction results addressed by the content that
+// produced them: the image bytes, the prompt, the model and its generation
+// parameters. Identical requests are answered without calling the model.
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Cache is implemented by the memory and disk backends.
+type Cache interface {
+	// Get returns the stored value for key, if present and not expired.
+	Get(key string) (string, bool)
+
+	// Set stores value under key.
+	Set(key, value string) error
+}
+
+// Key returns the content address for an extraction request.
+func Key(image []byte, prompt, model string, params map[string]any) string {
+	h := sha256.New()
+	sum := sha256.Sum256(image)
+	h.Write(sum[:])
+	fmt.Fprintf(h, "\x00%s\x00%s\x00", prompt, model)
+
+	// Sort the parameters so the key does not depend on map order
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value, _ := json.Marshal(params[name])
+		fmt.Fprintf(h, "%s=%s\x00", name, value)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// DecodeDataURL returns the bytes embedded in a base64 data URL.
+func DecodeDataURL(url string) ([]byte, error) {
+	_, data, ok := strings.Cut(url, ";base64,")
+	if !ok {
+		return nil, fmt.Errorf("not a base64 data URL")
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(data))
+}
+
+// New returns the backend named by kind: "memory", "disk" or "off".
+// Size bounds the memory backend and dir locates the disk backend.
+func New(kind string, size int, dir string, ttl time.Duration) (Cache, error) {
+	switch kind {
+	case "memory", "":
+		return NewLRU(size, ttl), nil
+	case "disk":
+		return NewDisk(dir, ttl)
+	case "off":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown cache backend: %q", kind)
+	}
+}
+
+// expired reports whether an entry created at t is older than ttl.
+// A zero ttl never expires.
+func expired(t time.Time, ttl time.Duration) bool {
+	return ttl > 0 && time.Since(t) >= ttl
+}
@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type diskEntry struct {
+	Value     string    `json:"value"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Disk is a cache that keeps one JSON file per entry in a directory, so
+// results survive across CLI invocations and server restarts.
+type Disk struct {
+	dir string
+	ttl time.Duration
+}
+
+// NewDisk returns a disk cache rooted at dir, creating it if needed.
+func NewDisk(dir string, ttl time.Duration) (*Disk, error) {
+	if dir == "" {
+		base, err := os.UserCacheDir()
+		if err != nil {
+			return nil, fmt.Errorf("error locating cache directory: %w", err)
+		}
+		dir = filepath.Join(base, "gonovella", "imgi")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating cache directory: %w", err)
+	}
+	return &Disk{dir: dir, ttl: ttl}, nil
+}
+
+func (c *Disk) path(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+func (c *Disk) Get(key string) (string, bool) {
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return "", false
+	}
+	var entry diskEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return "", false
+	}
+	if expired(entry.CreatedAt, c.ttl) {
+		os.Remove(c.path(key))
+		return "", false
+	}
+	return entry.Value, true
+}
+
+func (c *Disk) Set(key, value string) error {
+	data, err := json.Marshal(diskEntry{Value: value, CreatedAt: time.Now()})
+	if err != nil {
+		return fmt.Errorf("error encoding cache entry: %w", err)
+	}
+
+	// Write to a temporary file first so readers never see a partial entry
+	tmp, err := os.CreateTemp(c.dir, key+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error writing cache entry: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error writing cache entry: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error writing cache entry: %w", err)
+	}
+	return os.Rename(tmp.Name(), c.path(key))
+}
@@ -0,0 +1,207 @@
+// Package chat holds a multi-turn conversation about images with the
+// upstream chain: a REPL that streams each answer, keeps the history so
+// that an image is sent once and followed up on, and saves the
+// conversation as a JSON transcript.
+package chat
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"time"
+
+	"ubuntuhive.tech/gonovella/internal/upstream"
+	"ubuntuhive.tech/gonovella/internal/usage"
+)
+
+const help = `Type a question to ask about the images, or a command:
+  /image add FILE  attach an image to the next question
+  /model [NAME]    show or switch the model
+  /save [FILE]     save the transcript, to FILE from then on
+  /load FILE       continue the conversation saved in FILE
+  /help            show this help
+  /quit            leave (or Ctrl-D)
+Ctrl-C stops an answer; at the prompt it leaves.`
+
+// Session is a conversation in progress.
+type Session struct {
+	Chain      *upstream.Chain
+	MaxTokens  int
+	Prices     usage.PriceTable
+	Transcript *Transcript
+
+	// Path is where the transcript is saved after every answer; empty
+	// saves only on /save FILE.
+	Path string
+
+	In  io.Reader
+	Out io.Writer
+
+	pending []string // image URLs sent with the next question
+}
+
+// Attach sends the image file at path with the next question, unless the
+// conversation already has it.
+func (s *Session) Attach(path string) error {
+	image, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading image: %w", err)
+	}
+	url := fmt.Sprintf("data:%s;base64,%s", http.DetectContentType(image), base64.StdEncoding.EncodeToString(image))
+	if slices.Contains(s.Transcript.Images(), url) || slices.Contains(s.pending, url) {
+		return nil
+	}
+	s.pending = append(s.pending, url)
+	return nil
+}
+
+// Run reads questions and commands until the input ends, /quit or ctx is
+// done. Failed answers and commands are reported and the session goes on.
+func (s *Session) Run(ctx context.Context) error {
+	lines := bufio.NewScanner(s.In)
+	lines.Buffer(make([]byte, 64*1024), 1024*1024)
+	for {
+		fmt.Fprint(s.Out, "> ")
+		if !lines.Scan() {
+			fmt.Fprintln(s.Out)
+			return lines.Err()
+		}
+		line := strings.TrimSpace(lines.Text())
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "/") {
+			s.ask(ctx, line)
+		} else if quit, err := s.command(line); quit {
+			return nil
+		} else if err != nil {
+			fmt.Fprintln(s.Out, "error:", err)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// ask streams the answer to question. Ctrl-C stops the answer, which is
+// then left out of the history along with the question.
+func (s *Session) ask(ctx context.Context, question string) {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	message := upstream.UserMessage(question, s.pending...)
+	request := upstream.Request{
+		Model:     s.Transcript.Model,
+		MaxTokens: s.MaxTokens,
+		Messages:  append(slices.Clone(s.Transcript.Messages), message),
+	}
+	chain := s.Chain
+	if s.Transcript.Model != "" {
+		chain = chain.WithModel(s.Transcript.Model)
+	}
+	result, err := chain.Stream(ctx, request, func(content string) error {
+		_, err := fmt.Fprint(s.Out, content)
+		return err
+	})
+	fmt.Fprintln(s.Out)
+	if errors.Is(err, context.Canceled) {
+		fmt.Fprintln(s.Out, "(stopped)")
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(s.Out, "error:", err)
+		return
+	}
+
+	s.Prices.Apply(&result.Usage, result.Model)
+	fmt.Fprintf(s.Out, "[%s/%s, %s]\n", result.Provider, result.Model, result.Usage)
+	t := s.Transcript
+	t.Messages = append(t.Messages, message, upstream.AssistantMessage(result.Text))
+	t.Usage.PromptTokens += result.Usage.PromptTokens
+	t.Usage.CompletionTokens += result.Usage.CompletionTokens
+	t.Usage.TotalTokens += result.Usage.TotalTokens
+	t.Usage.CostUSD += result.Usage.CostUSD
+	s.pending = nil
+	if s.Path != "" {
+		if err := s.save(s.Path); err != nil {
+			fmt.Fprintln(s.Out, "error:", err)
+		}
+	}
+}
+
+// command runs a /command and reports whether it ends the session.
+func (s *Session) command(line string) (bool, error) {
+	name, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+	switch name {
+	case "/quit", "/exit":
+		return true, nil
+	case "/help":
+		fmt.Fprintln(s.Out, help)
+	case "/image":
+		sub, path, _ := strings.Cut(arg, " ")
+		if sub != "add" || strings.TrimSpace(path) == "" {
+			return false, errors.New("usage: /image add FILE")
+		}
+		if err := s.Attach(strings.TrimSpace(path)); err != nil {
+			return false, err
+		}
+		fmt.Fprintf(s.Out, "%d image(s) will be sent with the next question\n", len(s.pending))
+	case "/model":
+		if arg != "" {
+			s.Transcript.Model = arg
+		}
+		fmt.Fprintln(s.Out, "model:", s.model())
+	case "/save":
+		path := arg
+		if path == "" {
+			path = s.Path
+		}
+		if path == "" {
+			return false, errors.New("usage: /save FILE")
+		}
+		if err := s.save(path); err != nil {
+			return false, err
+		}
+		s.Path = path
+		fmt.Fprintln(s.Out, "saved to", path)
+	case "/load":
+		if arg == "" {
+			return false, errors.New("usage: /load FILE")
+		}
+		t, err := Load(arg)
+		if err != nil {
+			return false, err
+		}
+		s.Transcript, s.Path, s.pending = t, arg, nil
+		fmt.Fprintf(s.Out, "loaded %d messages, model %s\n", len(t.Messages), s.model())
+	default:
+		return false, fmt.Errorf("unknown command %s; /help lists them", name)
+	}
+	return false, nil
+}
+
+// model names the model asked for, or the models of the chain's routes.
+func (s *Session) model() string {
+	if s.Transcript.Model != "" {
+		return s.Transcript.Model
+	}
+	var models []string
+	for _, route := range s.Chain.Routes {
+		models = append(models, route.Model)
+	}
+	return strings.Join(models, ", ")
+}
+
+func (s *Session) save(path string) error {
+	s.Transcript.Updated = time.Now().UTC()
+	return s.Transcript.Save(path)
+}
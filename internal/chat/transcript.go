@@ -0,0 +1,87 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"ubuntuhive.tech/gonovella/internal/upstream"
+	"ubuntuhive.tech/gonovella/internal/usage"
+)
+
+// Transcript is a conversation as saved to JSON. Images are kept in the
+// user messages that first sent them, as data URLs.
+type Transcript struct {
+	Model    string             `json:"model,omitempty"`
+	Messages []upstream.Message `json:"messages"`
+	Usage    usage.Usage        `json:"usage"`
+	Created  time.Time          `json:"created"`
+	Updated  time.Time          `json:"updated"`
+}
+
+// NewTranscript starts an empty conversation with model.
+func NewTranscript(model string) *Transcript {
+	now := time.Now().UTC()
+	return &Transcript{Model: model, Messages: []upstream.Message{}, Created: now, Updated: now}
+}
+
+// Load reads the transcript at path.
+func Load(path string) (*Transcript, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading transcript: %w", err)
+	}
+	var t Transcript
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("error parsing transcript %s: %w", path, err)
+	}
+	for i, m := range t.Messages {
+		if m.Role != "system" && m.Role != "user" && m.Role != "assistant" {
+			return nil, fmt.Errorf("transcript %s: message %d has unknown role %q", path, i+1, m.Role)
+		}
+	}
+	if t.Messages == nil {
+		t.Messages = []upstream.Message{}
+	}
+	return &t, nil
+}
+
+// Save writes the transcript to path, replacing the file only once it is
+// complete.
+func (t *Transcript) Save(path string) error {
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".transcript-*")
+	if err != nil {
+		return fmt.Errorf("error saving transcript: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error saving transcript: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error saving transcript: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error saving transcript: %w", err)
+	}
+	return nil
+}
+
+// Images returns the image URLs sent so far, in order.
+func (t *Transcript) Images() []string {
+	var images []string
+	for _, m := range t.Messages {
+		for _, p := range m.Content {
+			if p.ImageURL != nil {
+				images = append(images, p.ImageURL.URL)
+			}
+		}
+	}
+	return images
+}
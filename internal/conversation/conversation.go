@@ -0,0 +1,131 @@
+// Package conversation keeps the history of multi-turn conversations about
+// images on the server, in memory or in SQLite, and turns it into the
+// upstream messages of the next turn.
+package conversation
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"ubuntuhive.tech/gonovella/internal/upstream"
+	"ubuntuhive.tech/gonovella/internal/usage"
+)
+
+var (
+	// ErrNotFound is returned for unknown conversations.
+	ErrNotFound = errors.New("conversation not found")
+
+	// ErrConflict is returned by Append when the conversation got other
+	// messages since it was read.
+	ErrConflict = errors.New("conversation changed while the message was answered")
+)
+
+// Part types.
+const (
+	PartText  = "text"
+	PartImage = "image"
+)
+
+// Part is a piece of a message: text, or an image as a base64 data URL.
+type Part struct {
+	Type  string `json:"type"`
+	Text  string `json:"text,omitempty"`
+	Image string `json:"image,omitempty"`
+}
+
+// Message is a turn of a conversation.
+type Message struct {
+	Role    string       `json:"role"`
+	Content []Part       `json:"content"`
+	Model   string       `json:"model,omitempty"`
+	Usage   *usage.Usage `json:"usage,omitempty"`
+	Created time.Time    `json:"created"`
+}
+
+// Conversation is a history of messages. Only its owner, the caller that
+// started it, may read it or add to it.
+type Conversation struct {
+	ID       string    `json:"id"`
+	Owner    string    `json:"-"`
+	System   string    `json:"system,omitempty"`
+	Messages []Message `json:"messages"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+}
+
+// New starts a conversation of owner with a fresh id.
+func New(owner, system string) *Conversation {
+	now := time.Now().UTC()
+	return &Conversation{
+		ID:       uuid.NewString(),
+		Owner:    owner,
+		System:   system,
+		Messages: []Message{},
+		Created:  now,
+		Updated:  now,
+	}
+}
+
+// Upstream returns the history followed by next as upstream messages,
+// after the system prompt if there is one.
+func (c *Conversation) Upstream(next ...Message) []upstream.Message {
+	var messages []upstream.Message
+	if c.System != "" {
+		messages = append(messages, upstream.SystemMessage(c.System))
+	}
+	for _, m := range append(c.Messages[:len(c.Messages):len(c.Messages)], next...) {
+		if m.Role == "assistant" {
+			messages = append(messages, upstream.AssistantMessage(Text(m.Content)))
+			continue
+		}
+		parts := []upstream.Part{}
+		for _, p := range m.Content {
+			if p.Type == PartImage {
+				parts = append(parts, upstream.Part{Type: "image_url", ImageURL: &upstream.ImageURL{URL: p.Image}})
+			} else {
+				parts = append(parts, upstream.Part{Type: "text", Text: p.Text})
+			}
+		}
+		messages = append(messages, upstream.Message{Role: m.Role, Content: parts})
+	}
+	return messages
+}
+
+// Text joins the text parts of content.
+func Text(content []Part) string {
+	var text string
+	for _, p := range content {
+		if p.Type == PartText {
+			text += p.Text
+		}
+	}
+	return text
+}
+
+// Store keeps conversations.
+type Store interface {
+	// Create stores a new conversation.
+	Create(c *Conversation) error
+
+	// Get returns the conversation with id, or ErrNotFound.
+	Get(id string) (*Conversation, error)
+
+	// Append adds messages to the conversation with id, which must still
+	// have n messages; otherwise it returns ErrConflict and adds nothing.
+	Append(id string, n int, messages ...Message) error
+}
+
+// Open returns the backend named by kind: "memory", or "sqlite" with the
+// database at path.
+func Open(kind, path string) (Store, error) {
+	switch kind {
+	case "memory", "":
+		return NewMemory(), nil
+	case "sqlite":
+		return OpenSQLite(path)
+	default:
+		return nil, fmt.Errorf("unknown conversation store: %q", kind)
+	}
+}
@@ -0,0 +1,55 @@
+package conversation
+
+import (
+	"slices"
+	"sync"
+)
+
+// Memory keeps conversations for the life of the process.
+type Memory struct {
+	mu            sync.Mutex
+	conversations map[string]*Conversation
+}
+
+// NewMemory returns an empty store.
+func NewMemory() *Memory {
+	return &Memory{conversations: map[string]*Conversation{}}
+}
+
+func (m *Memory) Create(c *Conversation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	copied := *c
+	copied.Messages = slices.Clone(c.Messages)
+	m.conversations[c.ID] = &copied
+	return nil
+}
+
+func (m *Memory) Get(id string) (*Conversation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.conversations[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	copied := *c
+	copied.Messages = slices.Clone(c.Messages)
+	return &copied, nil
+}
+
+func (m *Memory) Append(id string, n int, messages ...Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.conversations[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if len(c.Messages) != n {
+		return ErrConflict
+	}
+	c.Messages = append(c.Messages, messages...)
+	if len(messages) > 0 {
+		c.Updated = messages[len(messages)-1].Created
+	}
+	return nil
+}
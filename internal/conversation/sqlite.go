@@ -0,0 +1,184 @@
+package conversation
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS conversations (
+	id      TEXT PRIMARY KEY,
+	owner   TEXT NOT NULL,
+	system  TEXT NOT NULL DEFAULT '',
+	created TEXT NOT NULL,
+	updated TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS messages (
+	conversation_id TEXT NOT NULL REFERENCES conversations (id) ON DELETE CASCADE,
+	seq             INTEGER NOT NULL,
+	role            TEXT NOT NULL,
+	content         TEXT NOT NULL,
+	model           TEXT NOT NULL DEFAULT '',
+	usage           TEXT,
+	created         TEXT NOT NULL,
+	PRIMARY KEY (conversation_id, seq)
+);`
+
+// SQLite keeps conversations in a database file, one row per message with
+// its parts as JSON.
+type SQLite struct {
+	db *sql.DB
+}
+
+// OpenSQLite opens the database at path, creating it and its tables if
+// needed.
+func OpenSQLite(path string) (*SQLite, error) {
+	if path == "" {
+		return nil, fmt.Errorf("conversation database path is empty")
+	}
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)")
+	if err != nil {
+		return nil, fmt.Errorf("error opening conversation database: %w", err)
+	}
+	// A single connection serialises writers, which SQLite would anyway
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating conversation tables: %w", err)
+	}
+	return &SQLite{db: db}, nil
+}
+
+// Close closes the database.
+func (s *SQLite) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLite) Create(c *Conversation) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`INSERT INTO conversations (id, owner, system, created, updated) VALUES (?, ?, ?, ?, ?)`,
+		c.ID, c.Owner, c.System, formatTime(c.Created), formatTime(c.Updated))
+	if err != nil {
+		return fmt.Errorf("error storing conversation: %w", err)
+	}
+	if err := insertMessages(tx, c.ID, 0, c.Messages); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLite) Get(id string) (*Conversation, error) {
+	c := &Conversation{ID: id, Messages: []Message{}}
+	var created, updated string
+	err := s.db.QueryRow(`SELECT owner, system, created, updated FROM conversations WHERE id = ?`, id).
+		Scan(&c.Owner, &c.System, &created, &updated)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading conversation: %w", err)
+	}
+	c.Created, c.Updated = parseTime(created), parseTime(updated)
+
+	rows, err := s.db.Query(`SELECT role, content, model, usage, created FROM messages WHERE conversation_id = ? ORDER BY seq`, id)
+	if err != nil {
+		return nil, fmt.Errorf("error reading conversation: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			m              Message
+			content        string
+			usageJSON      sql.NullString
+			messageCreated string
+		)
+		if err := rows.Scan(&m.Role, &content, &m.Model, &usageJSON, &messageCreated); err != nil {
+			return nil, fmt.Errorf("error reading conversation: %w", err)
+		}
+		if err := json.Unmarshal([]byte(content), &m.Content); err != nil {
+			return nil, fmt.Errorf("error reading conversation %s: %w", id, err)
+		}
+		if usageJSON.Valid {
+			if err := json.Unmarshal([]byte(usageJSON.String), &m.Usage); err != nil {
+				return nil, fmt.Errorf("error reading conversation %s: %w", id, err)
+			}
+		}
+		m.Created = parseTime(messageCreated)
+		c.Messages = append(c.Messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading conversation: %w", err)
+	}
+	return c, nil
+}
+
+func (s *SQLite) Append(id string, n int, messages ...Message) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var count int
+	err = tx.QueryRow(`SELECT (SELECT COUNT(*) FROM messages WHERE conversation_id = ?) FROM conversations WHERE id = ?`, id, id).Scan(&count)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("error reading conversation: %w", err)
+	}
+	if count != n {
+		return ErrConflict
+	}
+	if err := insertMessages(tx, id, n, messages); err != nil {
+		return err
+	}
+	if len(messages) > 0 {
+		updated := formatTime(messages[len(messages)-1].Created)
+		if _, err := tx.Exec(`UPDATE conversations SET updated = ? WHERE id = ?`, updated, id); err != nil {
+			return fmt.Errorf("error storing conversation: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// insertMessages stores messages as those after the first n.
+func insertMessages(tx *sql.Tx, id string, n int, messages []Message) error {
+	for i, m := range messages {
+		content, err := json.Marshal(m.Content)
+		if err != nil {
+			return err
+		}
+		var usageJSON sql.NullString
+		if m.Usage != nil {
+			data, err := json.Marshal(m.Usage)
+			if err != nil {
+				return err
+			}
+			usageJSON = sql.NullString{String: string(data), Valid: true}
+		}
+		_, err = tx.Exec(`INSERT INTO messages (conversation_id, seq, role, content, model, usage, created) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			id, n+i, m.Role, string(content), m.Model, usageJSON, formatTime(m.Created))
+		if err != nil {
+			return fmt.Errorf("error storing message: %w", err)
+		}
+	}
+	return nil
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func parseTime(s string) time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, s)
+	return t
+}
@@ -0,0 +1,109 @@
+// Package convert translates documents between JSON, YAML, TOML, CUE and
+// NDJSON. Documents are decoded into yaml.v3 nodes, which keep key order and
+// comments, and encoded from there into the target format.
+package convert
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Format names a document format.
+type Format string
+
+const (
+	JSON   Format = "json"
+	YAML   Format = "yaml"
+	TOML   Format = "toml"
+	CUE    Format = "cue"
+	NDJSON Format = "ndjson"
+)
+
+// Formats lists the supported formats.
+var Formats = []Format{JSON, YAML, TOML, CUE, NDJSON}
+
+// Options control the encoded output.
+type Options struct {
+	// Indent is the number of spaces per nesting level, 2 when zero.
+	Indent int
+	// Compact writes JSON on one line and YAML in flow style.
+	Compact bool
+}
+
+// ParseFormat returns the format named by name, accepting the usual aliases.
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(strings.TrimPrefix(name, ".")) {
+	case "json":
+		return JSON, nil
+	case "yaml", "yml":
+		return YAML, nil
+	case "toml":
+		return TOML, nil
+	case "cue":
+		return CUE, nil
+	case "ndjson", "jsonl":
+		return NDJSON, nil
+	}
+	return "", fmt.Errorf("unknown format %q (want one of json, yaml, toml, cue or ndjson)", name)
+}
+
+// FormatOf infers the format of path from its extension.
+func FormatOf(path string) (Format, error) {
+	if path == "" || path == "-" {
+		return "", fmt.Errorf("cannot infer the format of standard input or output")
+	}
+	ext := filepath.Ext(path)
+	if ext == "" {
+		return "", fmt.Errorf("cannot infer the format of %s without an extension", path)
+	}
+	return ParseFormat(ext)
+}
+
+// Convert reads documents in format from from r and writes them to w in
+// format to. name is used in error messages.
+func Convert(r io.Reader, w io.Writer, name string, from, to Format, options Options) error {
+	docs, err := Decode(r, name, from)
+	if err != nil {
+		return err
+	}
+	return Encode(w, docs, to, options)
+}
+
+// Decode reads all documents in r. Each document is a yaml.DocumentNode.
+func Decode(r io.Reader, name string, format Format) ([]*yaml.Node, error) {
+	switch format {
+	case JSON, NDJSON:
+		return decodeJSON(r)
+	case YAML:
+		return decodeYAML(r)
+	case TOML:
+		return decodeTOML(r, name)
+	case CUE:
+		return decodeCUE(r, name)
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+// Encode writes docs to w in format.
+func Encode(w io.Writer, docs []*yaml.Node, format Format, options Options) error {
+	if options.Indent <= 0 {
+		options.Indent = 2
+	}
+	switch format {
+	case JSON:
+		return encodeJSON(w, docs, options)
+	case NDJSON:
+		return encodeNDJSON(w, docs)
+	case YAML:
+		return encodeYAML(w, docs, options)
+	case TOML:
+		return encodeTOML(w, docs)
+	case CUE:
+		return encodeCUE(w, docs, options)
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
@@ -0,0 +1,194 @@
+package convert
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"regexp"
+
+	"cuelang.org/go/cue"
+	"cuelang.org/go/cue/ast"
+	"cuelang.org/go/cue/cuecontext"
+	"cuelang.org/go/cue/format"
+	"cuelang.org/go/cue/token"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ctx        = cuecontext.New()
+	identifier = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+	keywords   = map[string]bool{
+		"true": true, "false": true, "null": true, "if": true, "for": true, "in": true,
+		"let": true, "import": true, "package": true, "div": true, "mod": true, "quo": true, "rem": true,
+	}
+)
+
+// decodeCUE evaluates a CUE file, which must be concrete data. Definitions
+// and hidden fields are left out; field comments are kept.
+func decodeCUE(r io.Reader, name string) ([]*yaml.Node, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	v := ctx.CompileBytes(data, cue.Filename(name))
+	if err := v.Validate(cue.Concrete(true)); err != nil {
+		return nil, fmt.Errorf("invalid CUE data: %w", err)
+	}
+	n, err := valueNode(v)
+	if err != nil {
+		return nil, err
+	}
+	return []*yaml.Node{document(n)}, nil
+}
+
+func valueNode(v cue.Value) (*yaml.Node, error) {
+	switch v.Kind() {
+	case cue.StructKind:
+		n := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		fields, err := v.Fields()
+		if err != nil {
+			return nil, err
+		}
+		for fields.Next() {
+			k := scalar("!!str", fields.Selector().Unquoted())
+			var lines []string
+			for _, doc := range fields.Value().Doc() {
+				lines = append(lines, comments(doc.Text())...)
+			}
+			k.HeadComment = comment(lines)
+			value, err := valueNode(fields.Value())
+			if err != nil {
+				return nil, err
+			}
+			n.Content = append(n.Content, k, value)
+		}
+		return n, nil
+	case cue.ListKind:
+		n := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		items, err := v.List()
+		if err != nil {
+			return nil, err
+		}
+		for items.Next() {
+			item, err := valueNode(items.Value())
+			if err != nil {
+				return nil, err
+			}
+			n.Content = append(n.Content, item)
+		}
+		return n, nil
+	case cue.NullKind:
+		return scalar("!!null", "null"), nil
+	case cue.BoolKind:
+		b, err := v.Bool()
+		return scalar("!!bool", fmt.Sprint(b)), err
+	case cue.IntKind, cue.FloatKind:
+		text, err := v.MarshalJSON()
+		tag := "!!float"
+		if v.Kind() == cue.IntKind {
+			tag = "!!int"
+		}
+		return scalar(tag, string(text)), err
+	case cue.StringKind:
+		s, err := v.String()
+		return scalar("!!str", s), err
+	case cue.BytesKind:
+		b, err := v.Bytes()
+		return scalar("!!binary", base64.StdEncoding.EncodeToString(b)), err
+	}
+	return nil, fmt.Errorf("%s: cannot convert a value of kind %s", v.Path(), v.Kind())
+}
+
+// encodeCUE writes a single document as CUE, turning YAML comments into CUE
+// comments.
+func encodeCUE(w io.Writer, docs []*yaml.Node, options Options) error {
+	if len(docs) != 1 {
+		return fmt.Errorf("CUE holds a single document, got %d; convert to YAML or NDJSON instead", len(docs))
+	}
+	expr, err := cueExpr(content(docs[0]))
+	if err != nil {
+		return err
+	}
+	file := &ast.File{}
+	if s, ok := expr.(*ast.StructLit); ok {
+		file.Decls = s.Elts
+	} else {
+		file.Decls = []ast.Decl{&ast.EmbedDecl{Expr: expr}}
+	}
+	out, err := format.Node(file, format.UseSpaces(options.Indent), format.TabIndent(false))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+func cueExpr(n *yaml.Node) (ast.Expr, error) {
+	switch n.Kind {
+	case yaml.MappingNode:
+		s := &ast.StructLit{}
+		for i := 0; i < len(n.Content); i += 2 {
+			k, err := key(n.Content[i])
+			if err != nil {
+				return nil, err
+			}
+			v, err := cueExpr(resolve(n.Content[i+1]))
+			if err != nil {
+				return nil, err
+			}
+			field := &ast.Field{Label: cueLabel(k), Value: v}
+			if lines := comments(n.Content[i].HeadComment); lines != nil {
+				ast.AddComment(field, cueComment(lines, true))
+			}
+			if lines := comments(n.Content[i+1].LineComment + n.Content[i].LineComment); lines != nil {
+				ast.AddComment(field, cueComment(lines, false))
+			}
+			s.Elts = append(s.Elts, field)
+		}
+		return s, nil
+	case yaml.SequenceNode:
+		var elts []ast.Expr
+		for _, c := range n.Content {
+			v, err := cueExpr(resolve(c))
+			if err != nil {
+				return nil, err
+			}
+			elts = append(elts, v)
+		}
+		return ast.NewList(elts...), nil
+	case yaml.ScalarNode:
+		switch n.ShortTag() {
+		case "!!null":
+			return ast.NewNull(), nil
+		case "!!bool":
+			b, err := boolean(n)
+			return ast.NewBool(b), err
+		case "!!int":
+			text, err := number(n)
+			return ast.NewLit(token.INT, text), err
+		case "!!float":
+			text, err := number(n)
+			return ast.NewLit(token.FLOAT, text), err
+		}
+		return ast.NewString(n.Value), nil
+	}
+	return nil, fmt.Errorf("line %d: unsupported YAML node", n.Line)
+}
+
+func cueLabel(name string) ast.Label {
+	if identifier.MatchString(name) && !keywords[name] {
+		return ast.NewIdent(name)
+	}
+	return ast.NewString(name)
+}
+
+func cueComment(lines []string, doc bool) *ast.CommentGroup {
+	cg := &ast.CommentGroup{Doc: doc, Line: !doc}
+	if !doc {
+		cg.Position = 4
+	}
+	for _, line := range lines {
+		cg.List = append(cg.List, &ast.Comment{Text: "// " + line})
+	}
+	return cg
+}
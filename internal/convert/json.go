@@ -0,0 +1,207 @@
+package convert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// decodeJSON reads a stream of JSON values, which covers NDJSON as well.
+// Object keys keep their order.
+func decodeJSON(r io.Reader) ([]*yaml.Node, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	var docs []*yaml.Node
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return docs, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid JSON at offset %d: %w", dec.InputOffset(), err)
+		}
+		n, err := jsonValue(dec, tok)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JSON at offset %d: %w", dec.InputOffset(), err)
+		}
+		docs = append(docs, document(n))
+	}
+}
+
+func jsonValue(dec *json.Decoder, tok json.Token) (*yaml.Node, error) {
+	switch t := tok.(type) {
+	case json.Delim:
+		n := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		if t == '{' {
+			n = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		}
+		for dec.More() {
+			if n.Kind == yaml.MappingNode {
+				k, err := dec.Token()
+				if err != nil {
+					return nil, unexpectedEOF(err)
+				}
+				n.Content = append(n.Content, scalar("!!str", k.(string)))
+			}
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			v, err := jsonValue(dec, tok)
+			if err != nil {
+				return nil, err
+			}
+			n.Content = append(n.Content, v)
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		return n, nil
+	case string:
+		return scalar("!!str", t), nil
+	case json.Number:
+		if strings.ContainsAny(string(t), ".eE") {
+			return scalar("!!float", string(t)), nil
+		}
+		return scalar("!!int", string(t)), nil
+	case bool:
+		return scalar("!!bool", strconv.FormatBool(t)), nil
+	case nil:
+		return scalar("!!null", "null"), nil
+	}
+	return nil, fmt.Errorf("unexpected token %v", tok)
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func encodeJSON(w io.Writer, docs []*yaml.Node, options Options) error {
+	indent := strings.Repeat(" ", options.Indent)
+	if options.Compact {
+		indent = ""
+	}
+	for _, doc := range docs {
+		var buf bytes.Buffer
+		if err := writeJSON(&buf, content(doc), indent, ""); err != nil {
+			return err
+		}
+		buf.WriteByte('\n')
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeNDJSON writes one document per line. A single array document is
+// split into its elements, so that JSON arrays convert to NDJSON streams.
+func encodeNDJSON(w io.Writer, docs []*yaml.Node) error {
+	values := make([]*yaml.Node, len(docs))
+	for i, doc := range docs {
+		values[i] = content(doc)
+	}
+	if len(values) == 1 && values[0].Kind == yaml.SequenceNode {
+		values = values[0].Content
+	}
+	for _, v := range values {
+		var buf bytes.Buffer
+		if err := writeJSON(&buf, resolve(v), "", ""); err != nil {
+			return err
+		}
+		buf.WriteByte('\n')
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeJSON writes n on one line when indent is empty, and indented by
+// prefix plus indent per level otherwise.
+func writeJSON(buf *bytes.Buffer, n *yaml.Node, indent, prefix string) error {
+	open, close := byte('['), byte(']')
+	switch n.Kind {
+	case yaml.ScalarNode:
+		return writeJSONScalar(buf, n)
+	case yaml.MappingNode:
+		open, close = '{', '}'
+	case yaml.SequenceNode:
+	default:
+		return fmt.Errorf("line %d: unsupported YAML node", n.Line)
+	}
+
+	buf.WriteByte(open)
+	step := 1
+	if n.Kind == yaml.MappingNode {
+		step = 2
+	}
+	for i := 0; i < len(n.Content); i += step {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if indent != "" {
+			buf.WriteString("\n" + prefix + indent)
+		}
+		v := n.Content[i]
+		if n.Kind == yaml.MappingNode {
+			k, err := key(n.Content[i])
+			if err != nil {
+				return err
+			}
+			buf.WriteString(quote(k))
+			buf.WriteByte(':')
+			if indent != "" {
+				buf.WriteByte(' ')
+			}
+			v = n.Content[i+1]
+		}
+		if err := writeJSON(buf, resolve(v), indent, prefix+indent); err != nil {
+			return err
+		}
+	}
+	if indent != "" && len(n.Content) > 0 {
+		buf.WriteString("\n" + prefix)
+	}
+	buf.WriteByte(close)
+	return nil
+}
+
+func writeJSONScalar(buf *bytes.Buffer, n *yaml.Node) error {
+	switch n.ShortTag() {
+	case "!!null":
+		buf.WriteString("null")
+	case "!!bool":
+		b, err := boolean(n)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(strconv.FormatBool(b))
+	case "!!int", "!!float":
+		text, err := number(n)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(text)
+	default:
+		buf.WriteString(quote(n.Value))
+	}
+	return nil
+}
+
+// quote returns s as a JSON string without escaping HTML characters.
+func quote(s string) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
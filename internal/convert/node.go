@@ -0,0 +1,107 @@
+package convert
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var jsonNumber = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+func document(n *yaml.Node) *yaml.Node {
+	return &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{n}}
+}
+
+func scalar(tag, value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: value}
+}
+
+// content returns the root of a document, following aliases.
+func content(n *yaml.Node) *yaml.Node {
+	if n.Kind == yaml.DocumentNode {
+		if len(n.Content) == 0 {
+			return scalar("!!null", "null")
+		}
+		n = n.Content[0]
+	}
+	return resolve(n)
+}
+
+func resolve(n *yaml.Node) *yaml.Node {
+	for n.Kind == yaml.AliasNode && n.Alias != nil {
+		n = n.Alias
+	}
+	return n
+}
+
+// key returns the text of a mapping key, which must be a scalar.
+func key(n *yaml.Node) (string, error) {
+	n = resolve(n)
+	if n.Kind != yaml.ScalarNode {
+		return "", fmt.Errorf("line %d: only scalar mapping keys can be converted", n.Line)
+	}
+	return n.Value, nil
+}
+
+// number returns the JSON text of an !!int or !!float scalar.
+func number(n *yaml.Node) (string, error) {
+	if jsonNumber.MatchString(n.Value) {
+		return n.Value, nil
+	}
+	if n.ShortTag() == "!!int" {
+		var i int64
+		if err := n.Decode(&i); err == nil {
+			return strconv.FormatInt(i, 10), nil
+		}
+		var u uint64
+		if err := n.Decode(&u); err == nil {
+			return strconv.FormatUint(u, 10), nil
+		}
+	}
+	var f float64
+	if err := n.Decode(&f); err != nil {
+		return "", fmt.Errorf("line %d: %w", n.Line, err)
+	}
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return "", fmt.Errorf("line %d: %s has no JSON representation", n.Line, n.Value)
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64), nil
+}
+
+// boolean returns the value of a !!bool scalar, which YAML spells many ways.
+func boolean(n *yaml.Node) (bool, error) {
+	var b bool
+	if err := n.Decode(&b); err != nil {
+		return false, fmt.Errorf("line %d: %w", n.Line, err)
+	}
+	return b, nil
+}
+
+// comments returns the text of a YAML comment without the leading #.
+func comments(text string) []string {
+	if text == "" {
+		return nil
+	}
+	var lines []string
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		line = strings.TrimPrefix(strings.TrimSpace(line), "#")
+		lines = append(lines, strings.TrimPrefix(line, " "))
+	}
+	return lines
+}
+
+// comment formats lines as a YAML comment.
+func comment(lines []string) string {
+	for i, line := range lines {
+		if line == "" {
+			lines[i] = "#"
+		} else {
+			lines[i] = "# " + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,238 @@
+package convert
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strings"
+
+	"cuelang.org/go/encoding/toml"
+	"gopkg.in/yaml.v3"
+)
+
+var bareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// decodeTOML reads a TOML document, keeping the order of its keys.
+func decodeTOML(r io.Reader, name string) ([]*yaml.Node, error) {
+	expr, err := toml.NewDecoder(name, r).Decode()
+	if err != nil {
+		return nil, fmt.Errorf("invalid TOML: %w", err)
+	}
+	v := ctx.BuildExpr(expr)
+	if err := v.Err(); err != nil {
+		return nil, fmt.Errorf("invalid TOML: %w", err)
+	}
+	n, err := valueNode(v)
+	if err != nil {
+		return nil, err
+	}
+	return []*yaml.Node{document(n)}, nil
+}
+
+// encodeTOML writes a single mapping document as TOML. Key order and head
+// comments are kept; TOML has no null, so null values are an error.
+func encodeTOML(w io.Writer, docs []*yaml.Node) error {
+	if len(docs) != 1 {
+		return fmt.Errorf("TOML holds a single document, got %d; convert to YAML or NDJSON instead", len(docs))
+	}
+	root := content(docs[0])
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("a TOML document must be a table, not a %s", kind(root))
+	}
+	var out bytes.Buffer
+	if err := writeTable(&out, nil, root); err != nil {
+		return err
+	}
+	_, err := w.Write(bytes.TrimLeft(out.Bytes(), "\n"))
+	return err
+}
+
+// writeTable writes the plain keys of m, then its sub tables and arrays of
+// tables under their dotted headers.
+func writeTable(out *bytes.Buffer, path []string, m *yaml.Node) error {
+	for i := 0; i < len(m.Content); i += 2 {
+		v := resolve(m.Content[i+1])
+		if isTable(v) || isTableArray(v) {
+			continue
+		}
+		k, err := key(m.Content[i])
+		if err != nil {
+			return err
+		}
+		writeComment(out, m.Content[i].HeadComment)
+		value, err := tomlValue(v, append(path, k))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s = %s", tomlKey(k), value)
+		if lines := comments(v.LineComment + m.Content[i].LineComment); lines != nil {
+			fmt.Fprintf(out, " # %s", strings.Join(lines, " "))
+		}
+		out.WriteByte('\n')
+	}
+	for i := 0; i < len(m.Content); i += 2 {
+		v := resolve(m.Content[i+1])
+		if !isTable(v) && !isTableArray(v) {
+			continue
+		}
+		k, err := key(m.Content[i])
+		if err != nil {
+			return err
+		}
+		sub := append(append([]string(nil), path...), k)
+		header := make([]string, len(sub))
+		for j, s := range sub {
+			header[j] = tomlKey(s)
+		}
+		tables, format := []*yaml.Node{v}, "[%s]\n"
+		if isTableArray(v) {
+			tables, format = v.Content, "[[%s]]\n"
+		}
+		for j, t := range tables {
+			out.WriteByte('\n')
+			if j == 0 {
+				writeComment(out, m.Content[i].HeadComment)
+			}
+			fmt.Fprintf(out, format, strings.Join(header, "."))
+			if err := writeTable(out, sub, resolve(t)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writeComment(out *bytes.Buffer, text string) {
+	for _, line := range comments(text) {
+		if line == "" {
+			out.WriteString("#\n")
+		} else {
+			fmt.Fprintf(out, "# %s\n", line)
+		}
+	}
+}
+
+func isTable(n *yaml.Node) bool {
+	return n.Kind == yaml.MappingNode
+}
+
+func isTableArray(n *yaml.Node) bool {
+	if n.Kind != yaml.SequenceNode || len(n.Content) == 0 {
+		return false
+	}
+	for _, c := range n.Content {
+		if resolve(c).Kind != yaml.MappingNode {
+			return false
+		}
+	}
+	return true
+}
+
+// tomlValue returns n as an inline TOML value.
+func tomlValue(n *yaml.Node, path []string) (string, error) {
+	switch n.Kind {
+	case yaml.MappingNode:
+		var fields []string
+		for i := 0; i < len(n.Content); i += 2 {
+			k, err := key(n.Content[i])
+			if err != nil {
+				return "", err
+			}
+			v, err := tomlValue(resolve(n.Content[i+1]), append(path, k))
+			if err != nil {
+				return "", err
+			}
+			fields = append(fields, tomlKey(k)+" = "+v)
+		}
+		if len(fields) == 0 {
+			return "{}", nil
+		}
+		return "{ " + strings.Join(fields, ", ") + " }", nil
+	case yaml.SequenceNode:
+		var items []string
+		for _, c := range n.Content {
+			v, err := tomlValue(resolve(c), path)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, v)
+		}
+		return "[" + strings.Join(items, ", ") + "]", nil
+	case yaml.ScalarNode:
+		switch n.ShortTag() {
+		case "!!null":
+			return "", fmt.Errorf("%s: TOML has no null value", strings.Join(path, "."))
+		case "!!bool":
+			b, err := boolean(n)
+			return fmt.Sprint(b), err
+		case "!!int":
+			return number(n)
+		case "!!float":
+			var f float64
+			if err := n.Decode(&f); err == nil {
+				switch {
+				case math.IsNaN(f):
+					return "nan", nil
+				case math.IsInf(f, 1):
+					return "inf", nil
+				case math.IsInf(f, -1):
+					return "-inf", nil
+				}
+			}
+			return number(n)
+		}
+		return tomlString(n.Value), nil
+	}
+	return "", fmt.Errorf("%s: unsupported YAML node", strings.Join(path, "."))
+}
+
+func tomlKey(k string) string {
+	if bareKey.MatchString(k) {
+		return k
+	}
+	return tomlString(k)
+}
+
+// tomlString quotes s as a TOML basic string.
+func tomlString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&b, `\u%04X`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func kind(n *yaml.Node) string {
+	switch n.Kind {
+	case yaml.SequenceNode:
+		return "list"
+	case yaml.ScalarNode:
+		return "scalar"
+	}
+	return "mapping"
+}
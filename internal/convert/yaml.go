@@ -0,0 +1,52 @@
+package convert
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"gopkg.in/yaml.v3"
+)
+
+// decodeYAML reads every document of a YAML stream.
+func decodeYAML(r io.Reader) ([]*yaml.Node, error) {
+	dec := yaml.NewDecoder(r)
+	var docs []*yaml.Node
+	for {
+		var doc yaml.Node
+		err := dec.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			return docs, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid YAML: %w", err)
+		}
+		docs = append(docs, &doc)
+	}
+}
+
+// encodeYAML writes docs as a YAML stream separated by ---. Compact output
+// uses flow style, which drops comments.
+func encodeYAML(w io.Writer, docs []*yaml.Node, options Options) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(options.Indent)
+	for _, doc := range docs {
+		if options.Compact {
+			flow(doc)
+		}
+		if err := enc.Encode(doc); err != nil {
+			return err
+		}
+	}
+	return enc.Close()
+}
+
+func flow(n *yaml.Node) {
+	if n.Kind == yaml.MappingNode || n.Kind == yaml.SequenceNode {
+		n.Style = yaml.FlowStyle
+	}
+	n.HeadComment, n.LineComment, n.FootComment = "", "", ""
+	for _, c := range n.Content {
+		flow(c)
+	}
+}
@@ -0,0 +1,179 @@
+// Package cors answers CORS preflights and decorates responses, JSON and
+// server-sent events alike, with the headers a route's policy allows.
+package cors
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Policy is the CORS policy of a route.
+type Policy struct {
+	AllowedOrigins   []string      `yaml:"allowed_origins"` // "*" allows any origin
+	AllowedMethods   []string      `yaml:"allowed_methods"`
+	AllowedHeaders   []string      `yaml:"allowed_headers"`
+	ExposedHeaders   []string      `yaml:"exposed_headers"`
+	AllowCredentials bool          `yaml:"allow_credentials"`
+	MaxAge           time.Duration `yaml:"max_age"`
+}
+
+// DefaultPolicy lets any origin call the API without credentials.
+var DefaultPolicy = Policy{
+	AllowedOrigins: []string{"*"},
+	AllowedMethods: []string{"GET", "POST"},
+	AllowedHeaders: []string{"Content-Type", "Authorization", "X-API-Key", "Idempotency-Key", "Cache-Control", "traceparent", "X-Request-ID"},
+	ExposedHeaders: []string{"X-Request-ID", "X-Cache", "Idempotent-Replayed", "Retry-After", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset"},
+	MaxAge:         time.Hour,
+}
+
+// Config maps URL paths to policies, for example:
+//
+//	default:
+//	  allowed_origins: ["http://localhost:3000"]
+//	  allowed_methods: [GET, POST]
+//	  allowed_headers: [Content-Type, Authorization, X-API-Key]
+//	  max_age: 1h
+//	routes:
+//	  /extract-image-info:
+//	    allowed_origins: ["https://app.example.com"]
+//	    allow_credentials: true
+type Config struct {
+	Default Policy            `yaml:"default"`
+	Routes  map[string]Policy `yaml:"routes"`
+
+	preflights map[string]bool // paths with an OPTIONS route registered
+}
+
+// LoadConfig reads a YAML policy file. An empty path returns DefaultPolicy
+// for every route.
+func LoadConfig(path string) (*Config, error) {
+	if path == "" {
+		return &Config{Default: DefaultPolicy}, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CORS config: %w", err)
+	}
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("error parsing CORS config: %w", err)
+	}
+	for path, p := range config.Routes {
+		if p.AllowCredentials && slices.Contains(p.AllowedOrigins, "*") {
+			return nil, fmt.Errorf("CORS route %s: credentials cannot be allowed for any origin", path)
+		}
+	}
+	if config.Default.AllowCredentials && slices.Contains(config.Default.AllowedOrigins, "*") {
+		return nil, fmt.Errorf("CORS default: credentials cannot be allowed for any origin")
+	}
+	return &config, nil
+}
+
+// For returns the policy of path.
+func (c *Config) For(path string) Policy {
+	if p, ok := c.Routes[path]; ok {
+		return p
+	}
+	return c.Default
+}
+
+// Handle registers handler for pattern behind the policy of its path, and
+// an OPTIONS route answering preflights for that path.
+func (c *Config) Handle(mux *http.ServeMux, pattern string, handler http.Handler) {
+	method, path, ok := strings.Cut(pattern, " ")
+	if !ok {
+		method, path = "", pattern
+	}
+	policy := c.For(path)
+	mux.Handle(pattern, policy.Handler(handler))
+
+	// Routes registered without a method already receive OPTIONS requests
+	if method == "" || c.preflights[path] {
+		return
+	}
+	if c.preflights == nil {
+		c.preflights = make(map[string]bool)
+	}
+	c.preflights[path] = true
+	mux.Handle("OPTIONS "+path, policy.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})))
+}
+
+// Handler applies p to next. Preflight requests (OPTIONS with an
+// Access-Control-Request-Method header) are answered here and never reach
+// next, so the route must be registered without a method, or an OPTIONS
+// route must be registered alongside it.
+func (p Policy) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		if origin == "" || !p.allowsOrigin(origin) {
+			if preflight {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if slices.Contains(p.AllowedOrigins, "*") && !p.AllowCredentials {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if p.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			if len(p.ExposedHeaders) > 0 {
+				h.Set("Access-Control-Expose-Headers", strings.Join(p.ExposedHeaders, ", "))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+		method := r.Header.Get("Access-Control-Request-Method")
+		if !slices.Contains(p.AllowedMethods, method) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		for _, header := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+			if header = strings.TrimSpace(header); header != "" && !p.allowsHeader(header) {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		h.Set("Access-Control-Allow-Methods", strings.Join(p.AllowedMethods, ", "))
+		if len(p.AllowedHeaders) > 0 {
+			h.Set("Access-Control-Allow-Headers", strings.Join(p.AllowedHeaders, ", "))
+		}
+		if p.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func (p Policy) allowsOrigin(origin string) bool {
+	return slices.Contains(p.AllowedOrigins, "*") || slices.Contains(p.AllowedOrigins, origin)
+}
+
+func (p Policy) allowsHeader(header string) bool {
+	return slices.ContainsFunc(p.AllowedHeaders, func(allowed string) bool {
+		return allowed == "*" || strings.EqualFold(allowed, header)
+	})
+}
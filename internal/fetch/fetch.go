@@ -0,0 +1,207 @@
+// Package fetch downloads images from http and https URLs within size and
+// time limits. On the server the hosts are allow-listed and addresses in
+// loopback, private, link-local and other special ranges are refused when
+// connecting, so that a URL cannot reach internal services, not even by a
+// redirect or a DNS answer that changes between lookups.
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	// ErrHost is returned for URLs whose host is not allow-listed.
+	ErrHost = errors.New("host not allowed")
+
+	// ErrAddress is returned for hosts resolving to a refused address.
+	ErrAddress = errors.New("address not allowed")
+
+	// ErrTooLarge is returned for responses over the size limit.
+	ErrTooLarge = errors.New("image too large")
+)
+
+// maxRedirects bounds the redirects followed for a URL.
+const maxRedirects = 5
+
+// Refused ranges besides the loopback, link-local, multicast, private and
+// unspecified ones that netip.Addr's methods report
+var refused = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // this network
+	netip.MustParsePrefix("100.64.0.0/10"),  // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),  // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),    // reserved
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64, embeds IPv4 addresses
+	netip.MustParsePrefix("64:ff9b:1::/48"), // local NAT64
+	netip.MustParsePrefix("100::/64"),       // discard
+	netip.MustParsePrefix("2001::/32"),      // Teredo
+	netip.MustParsePrefix("2001:db8::/32"),  // documentation
+	netip.MustParsePrefix("2002::/16"),      // 6to4
+	netip.MustParsePrefix("fec0::/10"),      // site-local
+}
+
+// Fetcher downloads images. Its zero value allows every host on a public
+// address, with no size limit and no timeout; the CLI allows private
+// addresses too, and New makes the fetcher of the server.
+type Fetcher struct {
+	// Hosts allowed, as host names or *.domain for the subdomains of
+	// domain; empty allows every host.
+	Hosts []string
+
+	// AllowPrivate lets URLs reach loopback, private and other special
+	// addresses.
+	AllowPrivate bool
+
+	MaxBytes int64         // largest image accepted; 0 for no limit
+	Timeout  time.Duration // for the whole download; 0 for none
+
+	once   sync.Once
+	client *http.Client
+}
+
+// New returns a fetcher for the server, limited to hosts and public
+// addresses.
+func New(hosts []string, maxBytes int64, timeout time.Duration) *Fetcher {
+	return &Fetcher{Hosts: hosts, MaxBytes: maxBytes, Timeout: timeout}
+}
+
+// Fetch downloads the image at rawURL.
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image URL: %w", err)
+	}
+	if err := f.check(u); err != nil {
+		return nil, err
+	}
+	if f.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image URL: %w", err)
+	}
+	req.Header.Set("Accept", "image/*")
+
+	resp, err := f.httpClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching image: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching image: %s", resp.Status)
+	}
+	if f.MaxBytes > 0 && resp.ContentLength > f.MaxBytes {
+		return nil, fmt.Errorf("%w: %d bytes, at most %d", ErrTooLarge, resp.ContentLength, f.MaxBytes)
+	}
+
+	body := io.Reader(resp.Body)
+	if f.MaxBytes > 0 {
+		body = io.LimitReader(resp.Body, f.MaxBytes+1)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching image: %w", err)
+	}
+	if f.MaxBytes > 0 && int64(len(data)) > f.MaxBytes {
+		return nil, fmt.Errorf("%w: over %d bytes", ErrTooLarge, f.MaxBytes)
+	}
+	return data, nil
+}
+
+// check allows http and https URLs to allow-listed hosts.
+func (f *Fetcher) check(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid image URL: scheme %q, want http or https", u.Scheme)
+	}
+	if u.User != nil {
+		return errors.New("invalid image URL: credentials are not allowed")
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "" {
+		return errors.New("invalid image URL: no host")
+	}
+	if len(f.Hosts) == 0 {
+		return nil
+	}
+	for _, allowed := range f.Hosts {
+		allowed = strings.ToLower(allowed)
+		if domain, ok := strings.CutPrefix(allowed, "*."); ok {
+			if strings.HasSuffix(host, "."+domain) {
+				return nil
+			}
+		} else if host == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrHost, host)
+}
+
+// httpClient checks every redirect like the URL itself, and every address
+// connected to; proxies are not used, since they would connect instead.
+func (f *Fetcher) httpClient() *http.Client {
+	f.once.Do(f.newClient)
+	return f.client
+}
+
+func (f *Fetcher) newClient() {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		MaxIdleConns:          16,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	if f.AllowPrivate {
+		transport.Proxy = http.ProxyFromEnvironment
+	} else {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return fmt.Errorf("%w: %s", ErrAddress, address)
+			}
+			if Refused(addrPort.Addr()) {
+				return fmt.Errorf("%w: %s", ErrAddress, addrPort.Addr())
+			}
+			return nil
+		}
+	}
+	f.client = &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			return f.check(req.URL)
+		},
+	}
+}
+
+// Refused reports whether addr is loopback, private, link-local or in
+// another range a server must not fetch from.
+func Refused(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return true
+	}
+	for _, prefix := range refused {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
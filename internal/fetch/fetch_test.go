@@ -0,0 +1,127 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRefused(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"0.0.0.0", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:10.1.2.3", true},
+		{"fd00::1", true},
+		{"fe80::1", true},
+		{"64:ff9b::a01:203", true},
+		{"2002:a01:203::1", true},
+		{"224.0.0.1", true},
+		{"93.184.216.34", false},
+		{"2606:4700::1111", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := Refused(netip.MustParseAddr(tt.addr)); got != tt.want {
+				t.Errorf("Refused(%s) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+// publicHost stands for a host on a public address; requests to it are
+// sent to the test server, bypassing the address check.
+const publicHost = "public.example"
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestFetch(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/image":
+			w.Write([]byte("image"))
+		case "/big":
+			w.Write([]byte(strings.Repeat("x", 100)))
+		case "/redirect-private":
+			http.Redirect(w, r, server.URL+"/image", http.StatusFound)
+		case "/redirect-metadata":
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+		case "/redirect-host":
+			http.Redirect(w, r, "http://other.example/image", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+
+	tests := []struct {
+		name    string
+		fetcher *Fetcher
+		url     string
+		wantErr error // nil for a successful fetch
+		errText string
+	}{
+		{"loopback", New(nil, 0, 0), server.URL + "/image", ErrAddress, ""},
+		{"loopback by name", New(nil, 0, 0), "http://localhost:" + target.Port() + "/image", ErrAddress, ""},
+		{"private", New(nil, 0, 0), "http://10.255.255.1/image", ErrAddress, ""},
+		{"link-local metadata", New(nil, 0, 0), "http://169.254.169.254/latest/meta-data/", ErrAddress, ""},
+		{"loopback allowed", &Fetcher{AllowPrivate: true}, server.URL + "/image", nil, ""},
+		{"public", New(nil, 0, 0), "http://" + publicHost + "/image", nil, ""},
+		{"redirect to loopback", New(nil, 0, 0), "http://" + publicHost + "/redirect-private", ErrAddress, ""},
+		{"redirect to metadata", New(nil, 0, 0), "http://" + publicHost + "/redirect-metadata", ErrAddress, ""},
+		{"redirect to another host", New([]string{publicHost}, 0, 0), "http://" + publicHost + "/redirect-host", ErrHost, ""},
+		{"host not allowed", New([]string{"images.example"}, 0, 0), "http://" + publicHost + "/image", ErrHost, ""},
+		{"subdomain allowed", New([]string{"*.example"}, 0, 0), "http://" + publicHost + "/image", nil, ""},
+		{"scheme", New(nil, 0, 0), "file:///etc/passwd", nil, "scheme"},
+		{"credentials", New(nil, 0, 0), "http://user:pass@" + publicHost + "/image", nil, "credentials"},
+		{"too large", New(nil, 10, 0), "http://" + publicHost + "/big", ErrTooLarge, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := tt.fetcher.httpClient()
+			checked := client.Transport
+			client.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				if r.URL.Host != publicHost {
+					return checked.RoundTrip(r)
+				}
+				r = r.Clone(r.Context())
+				r.URL.Host = target.Host
+				return http.DefaultTransport.RoundTrip(r)
+			})
+
+			data, err := tt.fetcher.Fetch(context.Background(), tt.url)
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Fetch() error = %v, want %v", err, tt.wantErr)
+				}
+			case tt.errText != "":
+				if err == nil || !strings.Contains(err.Error(), tt.errText) {
+					t.Errorf("Fetch() error = %v, want one about %s", err, tt.errText)
+				}
+			case err != nil || string(data) != "image":
+				t.Errorf("Fetch() = %q, %v, want the image", data, err)
+			}
+		})
+	}
+}
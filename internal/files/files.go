@@ -0,0 +1,125 @@
+// Package files keeps images uploaded ahead of the extraction requests
+// that refer to them by id. Files live in memory until they expire, within
+// a byte limit per owner and one for the whole store.
+package files
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrNotFound is returned for unknown and expired files.
+	ErrNotFound = errors.New("file not found")
+
+	// ErrOwnerFull is returned when a file would take its owner over
+	// MaxOwnerBytes.
+	ErrOwnerFull = errors.New("too many bytes of files stored")
+
+	// ErrFull is returned when a file would take the store over MaxBytes.
+	ErrFull = errors.New("file storage full")
+)
+
+// sweepEvery is how often Get drops expired files; Add always does.
+const sweepEvery = time.Minute
+
+// File is an uploaded image. Only its owner, the caller that uploaded it,
+// may refer to it.
+type File struct {
+	ID          string    `json:"id"`
+	Owner       string    `json:"-"`
+	ContentType string    `json:"content_type"`
+	Size        int       `json:"size"`
+	Created     time.Time `json:"created"`
+	Expires     time.Time `json:"expires"`
+	Data        []byte    `json:"-"`
+}
+
+// Store keeps files for TTL after their upload.
+type Store struct {
+	TTL           time.Duration
+	MaxOwnerBytes int64 // of the unexpired files of each owner; 0 for no limit
+	MaxBytes      int64 // of all unexpired files; 0 for no limit
+
+	mu     sync.Mutex
+	files  map[string]*File
+	owners map[string]int64 // bytes stored by owner
+	size   int64
+	swept  time.Time
+}
+
+// NewStore returns an empty store keeping files for ttl, without byte
+// limits.
+func NewStore(ttl time.Duration) *Store {
+	return &Store{TTL: ttl, files: map[string]*File{}, owners: map[string]int64{}}
+}
+
+// Add stores data of owner under a fresh id, dropping expired files. It
+// returns ErrOwnerFull or ErrFull when the file does not fit.
+func (s *Store) Add(owner, contentType string, data []byte) (*File, error) {
+	now := time.Now().UTC()
+	f := &File{
+		ID:          uuid.NewString(),
+		Owner:       owner,
+		ContentType: contentType,
+		Size:        len(data),
+		Created:     now,
+		Expires:     now.Add(s.TTL),
+		Data:        data,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+	size := int64(len(data))
+	if s.MaxOwnerBytes > 0 && s.owners[owner]+size > s.MaxOwnerBytes {
+		return nil, ErrOwnerFull
+	}
+	if s.MaxBytes > 0 && s.size+size > s.MaxBytes {
+		return nil, ErrFull
+	}
+	s.files[f.ID] = f
+	s.owners[owner] += size
+	s.size += size
+	return f, nil
+}
+
+// Get returns the file with id, or ErrNotFound.
+func (s *Store) Get(id string) (*File, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.swept) >= sweepEvery {
+		s.sweep(now)
+	}
+	f, ok := s.files[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if now.After(f.Expires) {
+		s.remove(f)
+		return nil, ErrNotFound
+	}
+	return f, nil
+}
+
+// sweep drops the files expired at now.
+func (s *Store) sweep(now time.Time) {
+	s.swept = now
+	for _, f := range s.files {
+		if now.After(f.Expires) {
+			s.remove(f)
+		}
+	}
+}
+
+func (s *Store) remove(f *File) {
+	delete(s.files, f.ID)
+	s.size -= int64(f.Size)
+	if s.owners[f.Owner] -= int64(f.Size); s.owners[f.Owner] <= 0 {
+		delete(s.owners, f.Owner)
+	}
+}
@@ -0,0 +1,111 @@
+// Package idempotency remembers extraction results by the key the caller
+// supplied, so a retried upload is answered from the stored result instead
+// of triggering a second upstream call.
+package idempotency
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrConflict is returned when a key is reused with a different payload.
+	ErrConflict = errors.New("idempotency key already used with a different payload")
+
+	// ErrInFlight is returned when a request with the same key is still running.
+	ErrInFlight = errors.New("a request with this idempotency key is still in progress")
+)
+
+// Record is the stored outcome of a request.
+type Record struct {
+	Fingerprint string
+	Result      string
+	Done        bool
+	CreatedAt   time.Time
+}
+
+// Store keeps records in memory until they expire.
+type Store struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	records map[string]*Record
+}
+
+// NewStore returns a store whose records expire after ttl.
+func NewStore(ttl time.Duration) *Store {
+	return &Store{
+		ttl:     ttl,
+		records: make(map[string]*Record),
+	}
+}
+
+// Fingerprint hashes the parts of a payload that make two requests "the same".
+func Fingerprint(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Begin reserves key for a request with the given fingerprint.
+//
+// It returns the completed record when the request is a replay, nil when the
+// caller should go ahead and do the work, or an error when the key is busy
+// or was used for a different payload.
+func (s *Store) Begin(key, fingerprint string) (*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if rec, ok := s.records[key]; ok && now.Sub(rec.CreatedAt) < s.ttl {
+		if rec.Fingerprint != fingerprint {
+			return nil, ErrConflict
+		}
+		if !rec.Done {
+			return nil, ErrInFlight
+		}
+		replay := *rec
+		return &replay, nil
+	}
+
+	s.records[key] = &Record{
+		Fingerprint: fingerprint,
+		CreatedAt:   now,
+	}
+	s.evictExpired(now)
+	return nil, nil
+}
+
+// Complete stores the result for a key reserved with Begin.
+func (s *Store) Complete(key, result string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if rec, ok := s.records[key]; ok {
+		rec.Result = result
+		rec.Done = true
+	}
+}
+
+// Abort releases a key reserved with Begin so the request can be retried.
+func (s *Store) Abort(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if rec, ok := s.records[key]; ok && !rec.Done {
+		delete(s.records, key)
+	}
+}
+
+func (s *Store) evictExpired(now time.Time) {
+	for key, rec := range s.records {
+		if now.Sub(rec.CreatedAt) >= s.ttl {
+			delete(s.records, key)
+		}
+	}
+}
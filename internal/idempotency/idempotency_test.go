@@ -0,0 +1,67 @@
+package idempotency
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBegin(t *testing.T) {
+	// Each test reserves key "k" for payload "a" first, then runs its step
+	// and begins again with second
+	tests := []struct {
+		name       string
+		step       func(s *Store)
+		second     string
+		wantErr    error
+		wantReplay string // result replayed, "" when the caller goes ahead
+	}{
+		{"in flight", func(s *Store) {}, "a", ErrInFlight, ""},
+		{"in flight, other payload", func(s *Store) {}, "b", ErrConflict, ""},
+		{"replay", func(s *Store) { s.Complete("k", "result") }, "a", nil, "result"},
+		{"conflict", func(s *Store) { s.Complete("k", "result") }, "b", ErrConflict, ""},
+		{"retry after abort", func(s *Store) { s.Abort("k") }, "a", nil, ""},
+		{"other payload after abort", func(s *Store) { s.Abort("k") }, "b", nil, ""},
+		{"abort after complete", func(s *Store) { s.Complete("k", "result"); s.Abort("k") }, "a", nil, "result"},
+		{"other key", func(s *Store) { s.Begin("other", Fingerprint("a")) }, "a", ErrInFlight, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewStore(time.Hour)
+			if replay, err := s.Begin("k", Fingerprint("a")); replay != nil || err != nil {
+				t.Fatalf("first Begin() = %v, %v, want to go ahead", replay, err)
+			}
+			tt.step(s)
+
+			replay, err := s.Begin("k", Fingerprint(tt.second))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Begin() error = %v, want %v", err, tt.wantErr)
+			}
+			switch {
+			case tt.wantReplay == "" && replay != nil:
+				t.Errorf("Begin() replayed %q, want to go ahead", replay.Result)
+			case tt.wantReplay != "" && (replay == nil || replay.Result != tt.wantReplay):
+				t.Errorf("Begin() = %v, want a replay of %q", replay, tt.wantReplay)
+			}
+		})
+	}
+}
+
+func TestBeginExpired(t *testing.T) {
+	s := NewStore(time.Nanosecond)
+	s.Begin("k", Fingerprint("a"))
+	s.Complete("k", "result")
+	time.Sleep(time.Millisecond)
+	if replay, err := s.Begin("k", Fingerprint("b")); replay != nil || err != nil {
+		t.Errorf("Begin() of an expired key = %v, %v, want to go ahead", replay, err)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	if Fingerprint("ab", "c") == Fingerprint("a", "bc") {
+		t.Error("Fingerprint() does not separate its parts")
+	}
+	if Fingerprint("a", "b") != Fingerprint("a", "b") {
+		t.Error("Fingerprint() is not stable")
+	}
+}
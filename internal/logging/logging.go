@@ -0,0 +1,166 @@
+// Package logging configures log/slog for the demo servers and the CLI:
+// JSON or text output, a minimum level, sampling of chatty records and
+// redaction of image blobs, credentials and configured PII fields. Servers
+// get a logger per request that carries the request's id.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"ubuntuhive.tech/gonovella/internal/requestid"
+)
+
+// Config chooses how records are written.
+type Config struct {
+	Format string     // "json" or "text"
+	Level  slog.Level // records below it are dropped
+	Sample float64    // fraction of records below warn kept, 0 or 1 keeps all
+	Redact []string   // extra attribute keys whose values are hidden
+}
+
+// ConfigFromEnv reads LOG_FORMAT, LOG_LEVEL, LOG_SAMPLE and LOG_REDACT, a
+// comma separated list of extra keys to redact, such as "email,phone".
+func ConfigFromEnv() (Config, error) {
+	config := Config{Format: os.Getenv("LOG_FORMAT")}
+	if level := os.Getenv("LOG_LEVEL"); level != "" {
+		if err := config.Level.UnmarshalText([]byte(level)); err != nil {
+			return config, fmt.Errorf("invalid LOG_LEVEL: %w", err)
+		}
+	}
+	if sample := os.Getenv("LOG_SAMPLE"); sample != "" {
+		rate, err := strconv.ParseFloat(sample, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return config, fmt.Errorf("invalid LOG_SAMPLE %q, want a number between 0 and 1", sample)
+		}
+		config.Sample = rate
+	}
+	for _, key := range strings.Split(os.Getenv("LOG_REDACT"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			config.Redact = append(config.Redact, key)
+		}
+	}
+	return config, nil
+}
+
+// New returns a logger writing to w as config says.
+func New(w io.Writer, config Config) (*slog.Logger, error) {
+	options := &slog.HandlerOptions{
+		Level:       config.Level,
+		ReplaceAttr: newRedactor(config.Redact).replace,
+	}
+	var handler slog.Handler
+	switch config.Format {
+	case "", "text":
+		handler = slog.NewTextHandler(w, options)
+	case "json":
+		handler = slog.NewJSONHandler(w, options)
+	default:
+		return nil, fmt.Errorf("unknown log format %q, want json or text", config.Format)
+	}
+	if config.Sample > 0 && config.Sample < 1 {
+		handler = &sampler{Handler: handler, rate: config.Sample}
+	}
+	return slog.New(handler), nil
+}
+
+// Setup makes a logger configured from the environment the default, for
+// slog and for the standard log package alike.
+func Setup(w io.Writer) error {
+	config, err := ConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	logger, err := New(w, config)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	log.SetFlags(0)
+	return nil
+}
+
+type loggerKey struct{}
+
+// From returns the logger of the request ctx belongs to, or the default.
+func From(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// With returns ctx carrying logger, for From to find.
+func With(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// Middleware gives every request a logger carrying the id the requestid
+// middleware assigned, and the trace id when the request is traced, and
+// logs each finished request.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		logger := slog.Default().With("request_id", requestid.FromContext(r.Context()))
+		if span := trace.SpanContextFromContext(r.Context()); span.IsValid() {
+			logger = logger.With("trace_id", span.TraceID().String())
+		}
+
+		rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+		r = r.WithContext(With(r.Context(), logger))
+		next.ServeHTTP(rec, r)
+
+		level := slog.LevelInfo
+		if rec.status >= 500 {
+			level = slog.LevelError
+		}
+		logger.Log(r.Context(), level, "request",
+			"method", r.Method,
+			"route", r.Pattern,
+			"status", rec.status,
+			"duration", time.Since(start),
+			"remote_addr", r.RemoteAddr,
+		)
+	})
+}
+
+// recorder remembers the status of a response.
+type recorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.wroteHeader = true
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	return rec.ResponseWriter.Write(b)
+}
+
+// Flush keeps streaming handlers working behind the middleware.
+func (rec *recorder) Flush() {
+	rec.wroteHeader = true
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rec *recorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
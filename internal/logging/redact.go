@@ -0,0 +1,92 @@
+package logging
+
+import (
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Redacted replaces hidden values.
+const Redacted = "[REDACTED]"
+
+// sensitiveKeys are always redacted, compared case-insensitively.
+var sensitiveKeys = []string{
+	"authorization",
+	"api_key",
+	"apikey",
+	"x-api-key",
+	"password",
+	"secret",
+	"token",
+	"access_token",
+	"refresh_token",
+}
+
+var (
+	// Base64 data URLs, such as image blobs, are summarised by their type
+	dataURL = regexp.MustCompile(`data:([\w/+.-]+);base64,\s*[A-Za-z0-9+/=]+`)
+
+	// Bearer tokens and provider style secret keys
+	bearer    = regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9._~+/=-]+`)
+	secretKey = regexp.MustCompile(`\bsk-[A-Za-z0-9_-]{6,}`)
+)
+
+type redactor struct {
+	keys map[string]bool
+}
+
+func newRedactor(extra []string) *redactor {
+	r := &redactor{keys: map[string]bool{"blob": true}}
+	for _, key := range append(sensitiveKeys, extra...) {
+		r.keys[strings.ToLower(key)] = true
+	}
+	return r
+}
+
+// replace is a slog ReplaceAttr hiding the values of sensitive keys and
+// scrubbing blobs and credentials out of any other string.
+func (r *redactor) replace(groups []string, a slog.Attr) slog.Attr {
+	if r.keys[strings.ToLower(a.Key)] {
+		// A blob keeps its media type when it is a data URL
+		if blob := a.Value.String(); strings.EqualFold(a.Key, "blob") && dataURL.MatchString(blob) {
+			return slog.String(a.Key, Scrub(blob))
+		}
+		return slog.String(a.Key, Redacted)
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, Scrub(a.Value.String()))
+	case slog.KindAny:
+		switch v := a.Value.Any().(type) {
+		case http.Header:
+			return slog.Any(a.Key, r.header(v))
+		case error:
+			return slog.String(a.Key, Scrub(v.Error()))
+		}
+	}
+	return a
+}
+
+// header copies h with the values of sensitive headers hidden.
+func (r *redactor) header(h http.Header) http.Header {
+	clean := make(http.Header, len(h))
+	for name, values := range h {
+		if r.keys[strings.ToLower(name)] {
+			clean[name] = []string{Redacted}
+		} else {
+			clean[name] = values
+		}
+	}
+	return clean
+}
+
+// Scrub replaces base64 data URLs with a short summary and hides bearer
+// tokens and secret keys found in s.
+func Scrub(s string) string {
+	s = dataURL.ReplaceAllStringFunc(s, func(m string) string {
+		return "data:" + dataURL.FindStringSubmatch(m)[1] + ";base64," + Redacted
+	})
+	s = bearer.ReplaceAllString(s, "Bearer "+Redacted)
+	return secretKey.ReplaceAllString(s, Redacted)
+}
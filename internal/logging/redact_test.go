@@ -0,0 +1,66 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestScrub(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain text", "a cat on a mat", "a cat on a mat"},
+		{"data url", "sent data:image/png;base64,iVBORw0KGgo= upstream", "sent data:image/png;base64,[REDACTED] upstream"},
+		{"bearer token", "Authorization: Bearer eyJhbGciOi.x-y_z", "Authorization: Bearer [REDACTED]"},
+		{"secret key", "key sk-proj_abc123XYZ rejected", "key [REDACTED] rejected"},
+		{"short sk- word", "sk-abc", "sk-abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Scrub(tt.in); got != tt.want {
+				t.Errorf("Scrub(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	tests := []struct {
+		name    string
+		attr    slog.Attr
+		want    string
+		notWant string
+	}{
+		{"api key", slog.String("api_key", "hunter2"), `"api_key":"[REDACTED]"`, "hunter2"},
+		{"key case", slog.String("Password", "hunter2"), `"Password":"[REDACTED]"`, "hunter2"},
+		{"extra key", slog.String("email", "a@example.com"), `"email":"[REDACTED]"`, "a@example.com"},
+		{"blob", slog.String("blob", "data:image/jpeg;base64,/9j/4AAQ"), `"blob":"data:image/jpeg;base64,[REDACTED]"`, "/9j/4AAQ"},
+		{"blob without data url", slog.String("blob", "raw bytes"), `"blob":"[REDACTED]"`, "raw bytes"},
+		{"string value", slog.String("msg", "calling with sk-abcdef123456"), `"msg":"calling with [REDACTED]"`, "sk-abcdef123456"},
+		{"error value", slog.Any("error", errors.New("bad key sk-abcdef123456")), `"error":"bad key [REDACTED]"`, "sk-abcdef123456"},
+		{"header", slog.Any("headers", http.Header{"X-Api-Key": {"sk-abcdef123456"}, "Accept": {"image/png"}}), `"X-Api-Key":["[REDACTED]"]`, "sk-abcdef123456"},
+		{"other key", slog.String("prompt", "describe"), `"prompt":"describe"`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			logger, err := New(&out, Config{Format: "json", Redact: []string{"email"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			logger.Info("test", tt.attr)
+			if !strings.Contains(out.String(), tt.want) {
+				t.Errorf("log = %s, want %s", out.String(), tt.want)
+			}
+			if tt.notWant != "" && strings.Contains(out.String(), tt.notWant) {
+				t.Errorf("log = %s, leaks %s", out.String(), tt.notWant)
+			}
+		})
+	}
+}
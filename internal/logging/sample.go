@@ -0,0 +1,29 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+)
+
+// sampler keeps a fraction of the records below warn. Warnings and errors
+// are always kept.
+type sampler struct {
+	slog.Handler
+	rate float64
+}
+
+func (s *sampler) Handle(ctx context.Context, record slog.Record) error {
+	if record.Level < slog.LevelWarn && rand.Float64() >= s.rate {
+		return nil
+	}
+	return s.Handler.Handle(ctx, record)
+}
+
+func (s *sampler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &sampler{Handler: s.Handler.WithAttrs(attrs), rate: s.rate}
+}
+
+func (s *sampler) WithGroup(name string) slog.Handler {
+	return &sampler{Handler: s.Handler.WithGroup(name), rate: s.rate}
+}
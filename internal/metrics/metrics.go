@@ -0,0 +1,165 @@
+// Package metrics exposes Prometheus metrics for the demo servers: request
+// counts and latencies by route and status, open server-sent event streams,
+// CUE validation failures by field, result cache lookups and the bytes
+// saved by image preprocessing. Upstream call metrics live with the
+// upstream client.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	cueerrors "cuelang.org/go/cue/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by route, method and status.",
+	}, []string{"route", "method", "status"})
+
+	latency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Time to serve HTTP requests, streams included, by route, method and status.",
+		Buckets: []float64{.005, .025, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"route", "method", "status"})
+
+	streams = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "http_sse_connections_active",
+		Help: "Server-sent event streams currently open, by route.",
+	}, []string{"route"})
+
+	validationFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "validation_failures_total",
+		Help: "CUE validation failures by schema and the top-level field failing.",
+	}, []string{"schema", "path"})
+
+	cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cache_lookups_total",
+		Help: "Result cache lookups by result (hit or miss).",
+	}, []string{"result"})
+
+	imageBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "image_preprocessed_bytes_total",
+		Help: "Bytes of preprocessed images by stage (original or sent).",
+	}, []string{"stage"})
+)
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Middleware counts and times every request next serves, labelled by the
+// ServeMux pattern that matched so the label set stays bounded. Responses
+// sent as text/event-stream count as open streams until they finish.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &recorder{ResponseWriter: w, status: http.StatusOK, request: r}
+		next.ServeHTTP(rec, r)
+
+		route := routeOf(r)
+		if rec.stream {
+			streams.WithLabelValues(rec.route).Dec()
+		}
+		status := strconv.Itoa(rec.status)
+		requests.WithLabelValues(route, r.Method, status).Inc()
+		latency.WithLabelValues(route, r.Method, status).Observe(time.Since(start).Seconds())
+	})
+}
+
+// routeOf returns the pattern the ServeMux matched r with.
+func routeOf(r *http.Request) string {
+	if r.Pattern == "" {
+		return "unmatched"
+	}
+	return r.Pattern
+}
+
+// recorder remembers the status of a response and whether it is a stream.
+type recorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	stream      bool
+	route       string // of the open stream
+	request     *http.Request
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.wroteHeader = true
+		rec.status = status
+		if strings.HasPrefix(rec.Header().Get("Content-Type"), "text/event-stream") {
+			rec.stream = true
+			rec.route = routeOf(rec.request)
+			streams.WithLabelValues(rec.route).Inc()
+		}
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// Flush keeps streaming handlers working behind the middleware.
+func (rec *recorder) Flush() {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rec *recorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// ValidationFailed counts each error of a CUE validation against schema,
+// by the top-level field it is about.
+func ValidationFailed(schema string, err error) {
+	for _, e := range cueerrors.Errors(err) {
+		validationFailures.WithLabelValues(schema, validationField(e)).Inc()
+	}
+}
+
+// validationField labels an error by the first element of its path only,
+// since deeper elements hold client-chosen map keys and list indices that
+// would make the label values unbounded. Fields the schema does not allow
+// are named by the client too, so they share one label.
+func validationField(e cueerrors.Error) string {
+	path := e.Path()
+	switch {
+	case len(path) == 0:
+		return "(root)"
+	case len(path) == 1 && strings.Contains(e.Error(), "field not allowed"):
+		return "(unknown field)"
+	}
+	return path[0]
+}
+
+// ImagePreprocessed counts the bytes of an image as received and as sent.
+func ImagePreprocessed(original, sent int) {
+	imageBytes.WithLabelValues("original").Add(float64(original))
+	imageBytes.WithLabelValues("sent").Add(float64(sent))
+}
+
+// CacheLookup counts a result cache hit or miss.
+func CacheLookup(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheLookups.WithLabelValues(result).Inc()
+}
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"slices"
+	"testing"
+
+	"cuelang.org/go/cue"
+	"cuelang.org/go/cue/cuecontext"
+	cueerrors "cuelang.org/go/cue/errors"
+)
+
+const testSchema = `
+import "strings"
+
+#Upload: {
+	prompt: string & strings.MinRunes(3)
+	vars?: [string]: string & strings.MaxRunes(3)
+	images?: [...{label: string & strings.MinRunes(1)}]
+}
+`
+
+func TestValidationField(t *testing.T) {
+	ctx := cuecontext.New()
+	schema := ctx.CompileString(testSchema).LookupPath(cue.ParsePath("#Upload"))
+	if err := schema.Err(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		data map[string]any
+		want string
+	}{
+		{"field", map[string]any{"prompt": "x"}, "prompt"},
+		{"map key", map[string]any{"prompt": "hello", "vars": map[string]any{"client-chosen-key": "too long"}}, "vars"},
+		{"list index", map[string]any{"prompt": "hello", "images": []any{map[string]any{"label": "a"}, map[string]any{"label": ""}}}, "images"},
+		{"unknown field", map[string]any{"prompt": "hello", "client-chosen-field": 1}, "(unknown field)"},
+		{"unknown nested field", map[string]any{"prompt": "hello", "images": []any{map[string]any{"label": "a", "extra": 1}}}, "images"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ctx.Encode(tt.data).Unify(schema).Validate(cue.Concrete(true))
+			if err == nil {
+				t.Fatal("validation passed")
+			}
+			var fields []string
+			for _, e := range cueerrors.Errors(err) {
+				fields = append(fields, validationField(e))
+			}
+			if len(fields) == 0 || slices.ContainsFunc(fields, func(f string) bool { return f != tt.want }) {
+				t.Errorf("fields = %q, want only %q", fields, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+// Package openapi generates OpenAPI specs from CUE sources and lints them.
+//
+// Definitions in the sources become components.schemas, as with
+// `cue def --out openapi`. Regular fields are the rest of the spec: info,
+// servers, tags, security, paths and components other than the generated
+// schemas. A $ref that is a bare schema name, such as ImageUpload or
+// #ImageUpload, points at #/components/schemas.
+package openapi
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"cuelang.org/go/cue"
+	"cuelang.org/go/cue/ast"
+	"cuelang.org/go/cue/cuecontext"
+	"cuelang.org/go/cue/parser"
+	cueopenapi "cuelang.org/go/encoding/openapi"
+	"gopkg.in/yaml.v3"
+	"ubuntuhive.tech/gonovella/internal/convert"
+)
+
+// Version is the OpenAPI version of generated specs unless the sources set
+// openapi.
+const Version = "3.0.0"
+
+var ctx = cuecontext.New()
+
+// order is the order of the top-level fields of a generated spec. Other
+// fields follow in source order.
+var order = []string{"openapi", "info", "servers", "tags", "security", "paths", "components"}
+
+// Generate builds a spec from the CUE files at paths, which are unified as
+// if they were one package.
+func Generate(paths []string) (*yaml.Node, error) {
+	schemaFile, apiFile, err := load(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	schemaValue := ctx.BuildFile(schemaFile)
+	if err := schemaValue.Err(); err != nil {
+		return nil, fmt.Errorf("invalid CUE: %w", err)
+	}
+	data, err := cueopenapi.Gen(schemaValue, &cueopenapi.Config{Version: Version})
+	if err != nil {
+		return nil, fmt.Errorf("error generating schemas: %w", err)
+	}
+	generated, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	apiValue := ctx.BuildFile(apiFile)
+	if err := apiValue.Validate(cue.Concrete(true)); err != nil {
+		return nil, fmt.Errorf("invalid CUE: %w", err)
+	}
+	if data, err = apiValue.MarshalJSON(); err != nil {
+		return nil, fmt.Errorf("invalid CUE: %w", err)
+	}
+	api, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	for _, key := range order {
+		switch value := lookup(api, key); {
+		case key == "openapi" && value == nil:
+			set(spec, key, lookup(generated, key))
+		case key == "info" && value == nil:
+			set(spec, key, lookup(generated, key))
+		case key == "paths" && value == nil:
+			set(spec, key, &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"})
+		case key == "components":
+			set(spec, key, components(lookup(generated, key), value))
+		case value != nil:
+			set(spec, key, value)
+		}
+	}
+	for i := 0; i < len(api.Content); i += 2 {
+		if lookup(spec, api.Content[i].Value) == nil {
+			set(spec, api.Content[i].Value, api.Content[i+1])
+		}
+	}
+	expandRefs(spec)
+	return &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{spec}}, nil
+}
+
+// load parses the files and splits them into one file of definitions, for
+// the schema generator, which rejects regular fields, and one of everything
+// else. Definitions go into both so that regular fields may use them.
+func load(paths []string) (schemas, api *ast.File, err error) {
+	schemas, api = &ast.File{}, &ast.File{}
+	imports := &ast.ImportDecl{}
+	seen := map[string]bool{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading CUE source: %w", err)
+		}
+		file, err := parser.ParseFile(path, data, parser.ParseComments)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid CUE: %w", err)
+		}
+		for _, decl := range file.Decls {
+			switch d := decl.(type) {
+			case *ast.Package:
+			case *ast.ImportDecl:
+				for _, spec := range d.Specs {
+					if !seen[spec.Path.Value] {
+						seen[spec.Path.Value] = true
+						imports.Specs = append(imports.Specs, spec)
+					}
+				}
+			case *ast.Field:
+				api.Decls = append(api.Decls, d)
+				if name, _, _ := ast.LabelName(d.Label); strings.HasPrefix(name, "#") || strings.HasPrefix(name, "_") {
+					schemas.Decls = append(schemas.Decls, d)
+				}
+			default:
+				api.Decls = append(api.Decls, d)
+				schemas.Decls = append(schemas.Decls, d)
+			}
+		}
+	}
+	if len(imports.Specs) > 0 {
+		schemas.Decls = append([]ast.Decl{imports}, schemas.Decls...)
+		api.Decls = append([]ast.Decl{imports}, api.Decls...)
+	}
+	return schemas, api, nil
+}
+
+// components merges the components of the sources into the generated ones.
+// Schemas written out in the sources replace generated schemas of the same
+// name.
+func components(generated, api *yaml.Node) *yaml.Node {
+	merged := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	schemas := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	for _, source := range []*yaml.Node{generated, api} {
+		if s := lookup(source, "schemas"); s != nil {
+			for i := 0; i < len(s.Content); i += 2 {
+				set(schemas, s.Content[i].Value, s.Content[i+1])
+			}
+		}
+	}
+	if len(schemas.Content) > 0 {
+		set(merged, "schemas", schemas)
+	}
+	if api != nil {
+		for i := 0; i < len(api.Content); i += 2 {
+			if api.Content[i].Value != "schemas" {
+				set(merged, api.Content[i].Value, api.Content[i+1])
+			}
+		}
+	}
+	return merged
+}
+
+// expandRefs rewrites $ref values that name a schema into references to
+// components.schemas.
+func expandRefs(n *yaml.Node) {
+	if n.Kind == yaml.MappingNode {
+		for i := 0; i < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			if k.Value == "$ref" && v.Kind == yaml.ScalarNode && !strings.ContainsAny(v.Value, "/.") {
+				v.Value = "#/components/schemas/" + strings.TrimPrefix(v.Value, "#")
+			}
+		}
+	}
+	for _, c := range n.Content {
+		expandRefs(c)
+	}
+}
+
+func decode(data []byte) (*yaml.Node, error) {
+	docs, err := convert.Decode(bytes.NewReader(data), "spec", convert.JSON)
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) != 1 || docs[0].Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("expected a single JSON object")
+	}
+	return docs[0].Content[0], nil
+}
+
+// lookup returns the value of key in the mapping m, or nil.
+func lookup(m *yaml.Node, key string) *yaml.Node {
+	if m == nil || m.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// set replaces the value of key in the mapping m, or appends it.
+func set(m *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			m.Content[i+1] = value
+			return
+		}
+	}
+	m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
@@ -0,0 +1,321 @@
+package openapi
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Severities of findings. Errors make a spec invalid or unusable, warnings
+// make it harder to use.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Rules a finding can come from.
+const (
+	RuleDescription     = "missing-description"
+	RuleUnusedComponent = "unused-component"
+	RuleUnresolvedRef   = "unresolved-ref"
+	RuleUUIDPattern     = "uuid-id-pattern"
+)
+
+// Finding is one problem in a spec. Pointer is the JSON pointer of the
+// offending value.
+type Finding struct {
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	Pointer  string `json:"pointer"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Message  string `json:"message"`
+}
+
+var (
+	methods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+	// sections of components that are referenced with $ref.
+	sections = []string{"schemas", "responses", "parameters", "examples", "requestBodies", "headers", "links", "callbacks"}
+
+	idName = regexp.MustCompile(`^(id|.*_id|.*[a-z]Id)$`)
+
+	// A UUID id pattern accepts uuid and rejects all of notUUIDs.
+	uuid     = "123e4567-e89b-12d3-a456-426614174000"
+	notUUIDs = []string{
+		"123e4567e89b12d3a456426614174000abcd",
+		"------------------------------------",
+		"zzzzzzzz-zzzz-zzzz-zzzz-zzzzzzzzzzzz",
+		"123e4567 e89b 12d3 a456 426614174000",
+		"123e4567-e89b-12d3-a456-42661417400",
+		"123e4567-e89b-12d3-a456-4266141740000",
+	}
+)
+
+// Lint checks the spec in doc, a document parsed with yaml.v3 so that
+// findings carry lines, for missing descriptions, unused components,
+// unresolved local $refs and id properties whose pattern is not a UUID.
+func Lint(doc *yaml.Node) []Finding {
+	root := doc
+	if root.Kind == yaml.DocumentNode && len(root.Content) > 0 {
+		root = root.Content[0]
+	}
+	l := &linter{root: root, refs: map[string][]string{}}
+	l.walk(root, "")
+	l.descriptions()
+	l.unused()
+	sort.SliceStable(l.findings, func(i, j int) bool {
+		if l.findings[i].Line != l.findings[j].Line {
+			return l.findings[i].Line < l.findings[j].Line
+		}
+		return l.findings[i].Column < l.findings[j].Column
+	})
+	return l.findings
+}
+
+type linter struct {
+	root     *yaml.Node
+	findings []Finding
+	// refs maps each local $ref target to the pointers of the $refs.
+	refs map[string][]string
+}
+
+func (l *linter) add(rule, severity, pointer string, n *yaml.Node, format string, args ...any) {
+	l.findings = append(l.findings, Finding{
+		Rule:     rule,
+		Severity: severity,
+		Pointer:  pointer,
+		Line:     n.Line,
+		Column:   n.Column,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// walk records every $ref, reports the unresolved ones and checks the
+// patterns of id properties.
+func (l *linter) walk(n *yaml.Node, pointer string) {
+	switch n.Kind {
+	case yaml.MappingNode:
+		for i := 0; i < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			p := pointer + "/" + escape(k.Value)
+			if k.Value == "$ref" && v.Kind == yaml.ScalarNode {
+				l.ref(v, p)
+				continue
+			}
+			if k.Value == "properties" && v.Kind == yaml.MappingNode {
+				for j := 0; j < len(v.Content); j += 2 {
+					if idName.MatchString(v.Content[j].Value) {
+						l.idPattern(v.Content[j+1], p+"/"+escape(v.Content[j].Value), v.Content[j].Value)
+					}
+				}
+			}
+			l.walk(v, p)
+		}
+	case yaml.SequenceNode:
+		for i, c := range n.Content {
+			l.walk(c, fmt.Sprintf("%s/%d", pointer, i))
+		}
+	}
+}
+
+func (l *linter) ref(v *yaml.Node, pointer string) {
+	target, ok := strings.CutPrefix(v.Value, "#")
+	if !ok {
+		return
+	}
+	l.refs[target] = append(l.refs[target], pointer)
+	if resolve(l.root, target) == nil {
+		l.add(RuleUnresolvedRef, SeverityError, pointer, v, "$ref %s does not resolve", v.Value)
+	}
+}
+
+func (l *linter) idPattern(schema *yaml.Node, pointer, name string) {
+	var patterns []*yaml.Node
+	if p := lookup(schema, "pattern"); p != nil {
+		patterns = append(patterns, p)
+	}
+	if all := lookup(schema, "allOf"); all != nil {
+		for _, s := range all.Content {
+			if p := lookup(s, "pattern"); p != nil {
+				patterns = append(patterns, p)
+			}
+		}
+	}
+	if len(patterns) == 0 {
+		return
+	}
+	var res []*regexp.Regexp
+	for _, p := range patterns {
+		re, err := regexp.Compile(p.Value)
+		if err != nil {
+			return
+		}
+		res = append(res, re)
+	}
+	matches := func(s string) bool {
+		for _, re := range res {
+			if !re.MatchString(s) {
+				return false
+			}
+		}
+		return true
+	}
+	bad := !matches(uuid)
+	for _, s := range notUUIDs {
+		bad = bad || matches(s)
+	}
+	if bad {
+		l.add(RuleUUIDPattern, SeverityWarning, pointer, patterns[0],
+			"%s pattern %s is not a UUID pattern; use format: uuid with ^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$", name, patterns[0].Value)
+	}
+}
+
+// descriptions reports operations without a summary or description, and
+// responses, parameters, component schemas and their properties without a
+// description. Responses require one.
+func (l *linter) descriptions() {
+	paths := lookup(l.root, "paths")
+	for i := 0; paths != nil && i < len(paths.Content); i += 2 {
+		path, item := paths.Content[i].Value, paths.Content[i+1]
+		for _, method := range methods {
+			op := lookup(item, method)
+			if op == nil {
+				continue
+			}
+			pointer := "/paths/" + escape(path) + "/" + method
+			if lookup(op, "summary") == nil && lookup(op, "description") == nil {
+				l.add(RuleDescription, SeverityWarning, pointer, op, "%s %s has no summary or description", strings.ToUpper(method), path)
+			}
+			l.parameters(lookup(op, "parameters"), pointer+"/parameters")
+			responses := lookup(op, "responses")
+			for j := 0; responses != nil && j < len(responses.Content); j += 2 {
+				response := responses.Content[j+1]
+				if lookup(response, "$ref") == nil && lookup(response, "description") == nil {
+					l.add(RuleDescription, SeverityError, pointer+"/responses/"+escape(responses.Content[j].Value), response,
+						"%s %s response %s has no description", strings.ToUpper(method), path, responses.Content[j].Value)
+				}
+			}
+		}
+		l.parameters(lookup(item, "parameters"), "/paths/"+escape(path)+"/parameters")
+	}
+
+	schemas := lookup(lookup(l.root, "components"), "schemas")
+	for i := 0; schemas != nil && i < len(schemas.Content); i += 2 {
+		name, schema := schemas.Content[i].Value, schemas.Content[i+1]
+		pointer := "/components/schemas/" + escape(name)
+		if lookup(schema, "description") == nil && lookup(schema, "$ref") == nil {
+			l.add(RuleDescription, SeverityWarning, pointer, schemas.Content[i], "schema %s has no description", name)
+		}
+		properties := lookup(schema, "properties")
+		for j := 0; properties != nil && j < len(properties.Content); j += 2 {
+			property := properties.Content[j+1]
+			if lookup(property, "description") == nil && lookup(property, "$ref") == nil {
+				l.add(RuleDescription, SeverityWarning, pointer+"/properties/"+escape(properties.Content[j].Value), properties.Content[j],
+					"property %s.%s has no description", name, properties.Content[j].Value)
+			}
+		}
+	}
+}
+
+func (l *linter) parameters(list *yaml.Node, pointer string) {
+	if list == nil {
+		return
+	}
+	for i, p := range list.Content {
+		if lookup(p, "$ref") == nil && lookup(p, "description") == nil {
+			name := "?"
+			if n := lookup(p, "name"); n != nil {
+				name = n.Value
+			}
+			l.add(RuleDescription, SeverityWarning, fmt.Sprintf("%s/%d", pointer, i), p, "parameter %s has no description", name)
+		}
+	}
+}
+
+// unused reports components no $ref outside of themselves points at, and
+// security schemes no security requirement names.
+func (l *linter) unused() {
+	components := lookup(l.root, "components")
+	for _, section := range sections {
+		entries := lookup(components, section)
+		for i := 0; entries != nil && i < len(entries.Content); i += 2 {
+			pointer := "/components/" + section + "/" + escape(entries.Content[i].Value)
+			used := false
+			for _, from := range l.refs[pointer] {
+				if from != pointer && !strings.HasPrefix(from, pointer+"/") {
+					used = true
+					break
+				}
+			}
+			if !used {
+				l.add(RuleUnusedComponent, SeverityWarning, pointer, entries.Content[i], "%s %s is never referenced", section, entries.Content[i].Value)
+			}
+		}
+	}
+
+	schemes := lookup(components, "securitySchemes")
+	if schemes == nil {
+		return
+	}
+	named := map[string]bool{}
+	requirements := []*yaml.Node{lookup(l.root, "security")}
+	paths := lookup(l.root, "paths")
+	for i := 0; paths != nil && i < len(paths.Content); i += 2 {
+		for _, method := range methods {
+			requirements = append(requirements, lookup(lookup(paths.Content[i+1], method), "security"))
+		}
+	}
+	for _, list := range requirements {
+		if list == nil {
+			continue
+		}
+		for _, requirement := range list.Content {
+			for j := 0; j < len(requirement.Content); j += 2 {
+				named[requirement.Content[j].Value] = true
+			}
+		}
+	}
+	for i := 0; i < len(schemes.Content); i += 2 {
+		if name := schemes.Content[i].Value; !named[name] {
+			l.add(RuleUnusedComponent, SeverityWarning, "/components/securitySchemes/"+escape(name), schemes.Content[i], "security scheme %s is never required", name)
+		}
+	}
+}
+
+// resolve follows the JSON pointer from root.
+func resolve(root *yaml.Node, pointer string) *yaml.Node {
+	if pointer == "" {
+		return root
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil
+	}
+	n := root
+	for _, token := range strings.Split(pointer[1:], "/") {
+		token = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+		switch n.Kind {
+		case yaml.MappingNode:
+			n = lookup(n, token)
+		case yaml.SequenceNode:
+			var i int
+			if _, err := fmt.Sscan(token, &i); err != nil || i < 0 || i >= len(n.Content) {
+				return nil
+			}
+			n = n.Content[i]
+		default:
+			return nil
+		}
+		if n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+func escape(token string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(token)
+}
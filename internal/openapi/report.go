@@ -0,0 +1,48 @@
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// WriteText writes one file:line:column line per finding.
+func WriteText(w io.Writer, file string, findings []Finding) error {
+	for _, f := range findings {
+		if _, err := fmt.Fprintf(w, "%s:%d:%d: %s: %s (%s)\n", file, f.Line, f.Column, f.Severity, f.Message, f.Rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteJSON writes the findings as a JSON array.
+func WriteJSON(w io.Writer, file string, findings []Finding) error {
+	type entry struct {
+		File string `json:"file"`
+		Finding
+	}
+	entries := []entry{}
+	for _, f := range findings {
+		entries = append(entries, entry{File: file, Finding: f})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(entries)
+}
+
+// WriteGitHub writes GitHub Actions workflow commands, which annotate the
+// spec in a pull request.
+func WriteGitHub(w io.Writer, file string, findings []Finding) error {
+	escape := strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A")
+	property := strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C")
+	for _, f := range findings {
+		_, err := fmt.Fprintf(w, "::%s file=%s,line=%d,col=%d,title=%s::%s\n",
+			f.Severity, property.Replace(file), f.Line, f.Column, property.Replace(f.Rule), escape.Replace(f.Message))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
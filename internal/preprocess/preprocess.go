@@ -0,0 +1,256 @@
+// Package preprocess prepares images before they are sent upstream: it
+// decodes them, turns them upright by their EXIF orientation, drops their
+// metadata, downsizes them to a maximum dimension and re-encodes them as
+// JPEG or PNG. Very large images can also be cut into tiles that keep
+// their detail, sent along with the downsized whole.
+package preprocess
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+	"ubuntuhive.tech/gonovella/internal/prompt"
+)
+
+const (
+	// DefaultMaxPixels refuses images that would take too much memory to
+	// decode: each pixel takes 4 bytes, in a few copies while processing.
+	DefaultMaxPixels = 40_000_000
+
+	// maxGrid bounds the tiles along each side of an image.
+	maxGrid = 4
+)
+
+// Formats images are re-encoded to.
+const (
+	FormatAuto = "auto" // PNG for PNG and GIF images, JPEG otherwise
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+)
+
+// Options of the preprocessing.
+type Options struct {
+	MaxDimension int    // longest side of the image sent; 0 keeps the size
+	Format       string // FormatAuto, FormatJPEG or FormatPNG
+	Quality      int    // JPEG quality, 1 to 100
+	TileAbove    int    // longest side over which images are also cut into tiles; 0 never tiles
+	MaxPixels    int    // largest image accepted, in pixels; 0 for DefaultMaxPixels
+}
+
+// String describes the options that change the images sent, for cache
+// keys.
+func (o Options) String() string {
+	return fmt.Sprintf("max=%d format=%s quality=%d tiles=%d", o.MaxDimension, o.Format, o.Quality, o.TileAbove)
+}
+
+// Size describes an encoded image.
+type Size struct {
+	Type   string `json:"type"`
+	Bytes  int    `json:"bytes"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// Report compares an image as received with the image and tiles sent.
+type Report struct {
+	Original Size   `json:"original"`
+	Sent     Size   `json:"sent"`
+	Tiles    []Size `json:"tiles,omitempty"`
+}
+
+// SentBytes is the size of everything sent for the image.
+func (r Report) SentBytes() int {
+	n := r.Sent.Bytes
+	for _, t := range r.Tiles {
+		n += t.Bytes
+	}
+	return n
+}
+
+// Image is a preprocessed image, with its tiles if it was cut.
+type Image struct {
+	Data   []byte
+	Tiles  []Tile
+	Report Report
+}
+
+// Tile is a part of an image, at full resolution unless the image is too
+// large for 4 by 4 tiles. Rows and columns are numbered from 1.
+type Tile struct {
+	Data        []byte
+	Row, Column int
+}
+
+// Process preprocesses the encoded image data.
+func Process(data []byte, o Options) (Image, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return Image{}, fmt.Errorf("error decoding image: %w", err)
+	}
+	limit := o.MaxPixels
+	if limit <= 0 {
+		limit = DefaultMaxPixels
+	}
+	if config.Width*config.Height > limit {
+		return Image{}, fmt.Errorf("image too large to process: %dx%d", config.Width, config.Height)
+	}
+	decoded, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return Image{}, fmt.Errorf("error decoding image: %w", err)
+	}
+
+	orientation, _ := strconv.Atoi(prompt.EXIF(data)["Orientation"])
+	upright := orient(toRGBA(decoded), orientation)
+	bounds := upright.Bounds()
+	result := Image{Report: Report{Original: Size{
+		Type:   http.DetectContentType(data),
+		Bytes:  len(data),
+		Width:  bounds.Dx(),
+		Height: bounds.Dy(),
+	}}}
+
+	encoding := o.Format
+	if encoding == "" || encoding == FormatAuto {
+		encoding = FormatJPEG
+		if format == "png" || format == "gif" {
+			encoding = FormatPNG
+		}
+	}
+
+	whole := resize(upright, o.MaxDimension)
+	if result.Data, result.Report.Sent, err = encode(whole, encoding, o.Quality); err != nil {
+		return Image{}, err
+	}
+
+	if o.TileAbove <= 0 || longest(bounds) <= o.TileAbove {
+		return result, nil
+	}
+	tile := o.MaxDimension
+	if tile <= 0 {
+		tile = o.TileAbove
+	}
+	// Images too large for the grid are downsized to fit it
+	source := resize(upright, maxGrid*tile)
+	b := source.Bounds()
+	for y, row := b.Min.Y, 1; y < b.Max.Y; y, row = y+tile, row+1 {
+		for x, column := b.Min.X, 1; x < b.Max.X; x, column = x+tile, column+1 {
+			part := source.SubImage(image.Rect(x, y, min(x+tile, b.Max.X), min(y+tile, b.Max.Y)))
+			data, size, err := encode(part, encoding, o.Quality)
+			if err != nil {
+				return Image{}, err
+			}
+			result.Tiles = append(result.Tiles, Tile{Data: data, Row: row, Column: column})
+			result.Report.Tiles = append(result.Report.Tiles, size)
+		}
+	}
+	return result, nil
+}
+
+// toRGBA copies img to an RGBA image with its origin at 0,0.
+func toRGBA(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+	return rgba
+}
+
+// orient turns img upright by its EXIF orientation: 2 to 8 are mirrored
+// and rotated views, 1 and anything else already upright.
+func orient(img *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	out := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // rotated 180°
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // rotated 90° clockwise to be upright
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90° counterclockwise to be upright
+				dx, dy = y, w-1-x
+			}
+			copy(out.Pix[out.PixOffset(dx, dy):][:4], img.Pix[img.PixOffset(x, y):][:4])
+		}
+	}
+	return out
+}
+
+// resize downsizes img so that its longest side is at most limit.
+func resize(img *image.RGBA, limit int) *image.RGBA {
+	b := img.Bounds()
+	side := longest(b)
+	if limit <= 0 || side <= limit {
+		return img
+	}
+	w := max(1, b.Dx()*limit/side)
+	h := max(1, b.Dy()*limit/side)
+	out := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(out, out.Bounds(), img, b, draw.Src, nil)
+	return out
+}
+
+// encode writes img as a JPEG or a PNG. Transparent parts of JPEGs are
+// white.
+func encode(img image.Image, format string, quality int) ([]byte, Size, error) {
+	var buf bytes.Buffer
+	var err error
+	contentType := "image/png"
+	switch format {
+	case FormatPNG:
+		err = png.Encode(&buf, img)
+	case FormatJPEG:
+		contentType = "image/jpeg"
+		if o, ok := img.(interface{ Opaque() bool }); ok && !o.Opaque() {
+			img = flatten(img)
+		}
+		if quality < 1 || quality > 100 {
+			quality = jpeg.DefaultQuality
+		}
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	default:
+		return nil, Size{}, fmt.Errorf("unknown image format: %q", format)
+	}
+	if err != nil {
+		return nil, Size{}, fmt.Errorf("error encoding image: %w", err)
+	}
+	b := img.Bounds()
+	return buf.Bytes(), Size{Type: contentType, Bytes: buf.Len(), Width: b.Dx(), Height: b.Dy()}, nil
+}
+
+// flatten draws img over a white background.
+func flatten(img image.Image) image.Image {
+	b := img.Bounds()
+	out := image.NewRGBA(b)
+	draw.Draw(out, b, image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(out, b, img, b.Min, draw.Over)
+	return out
+}
+
+func longest(b image.Rectangle) int {
+	return max(b.Dx(), b.Dy())
+}
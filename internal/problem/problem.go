@@ -0,0 +1,41 @@
+// Package problem writes RFC 9457 problem details, the error format shared
+// by the middleware in front of the demo handlers.
+package problem
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"ubuntuhive.tech/gonovella/internal/requestid"
+)
+
+// Details is an application/problem+json document.
+type Details struct {
+	Type   string `json:"type,omitempty"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+
+	// RequestID correlates the problem with the logs
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Write sends a problem with the standard title for status.
+func Write(w http.ResponseWriter, status int, detail string) {
+	WriteDetails(w, Details{
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	})
+}
+
+// WriteDetails sends p, filling in the request id the requestid middleware
+// put on the response.
+func WriteDetails(w http.ResponseWriter, p Details) {
+	if p.RequestID == "" {
+		p.RequestID = w.Header().Get(requestid.Header)
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
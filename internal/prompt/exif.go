@@ -0,0 +1,250 @@
+package prompt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// EXIF tags by name, as templates see them in .EXIF.
+var (
+	tiffTags = map[uint16]string{
+		0x010E: "ImageDescription",
+		0x010F: "Make",
+		0x0110: "Model",
+		0x0112: "Orientation",
+		0x0131: "Software",
+		0x0132: "DateTime",
+		0x013B: "Artist",
+		0x8298: "Copyright",
+	}
+	exifTags = map[uint16]string{
+		0x829A: "ExposureTime",
+		0x829D: "FNumber",
+		0x8827: "ISOSpeedRatings",
+		0x9003: "DateTimeOriginal",
+		0x920A: "FocalLength",
+		0xA434: "LensModel",
+	}
+)
+
+const (
+	exifPointer = 0x8769
+	gpsPointer  = 0x8825
+)
+
+// Bytes per value of the TIFF field types read here; other types are skipped.
+var typeSizes = map[uint16]int64{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+
+// EXIF returns the EXIF metadata of a JPEG, PNG or WebP image: the tags
+// named in tiffTags and exifTags, and GPSLatitude, GPSLongitude and
+// GPSAltitude in decimal degrees and metres. It returns nil when the image
+// has no metadata or it cannot be read.
+func EXIF(image []byte) map[string]string {
+	block := exifBlock(image)
+	if len(block) < 8 {
+		return nil
+	}
+	t := tiff{data: block}
+	switch string(block[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil
+	}
+
+	tags := map[string]string{}
+	ifd0 := t.ifd(t.order.Uint32(block[4:]))
+	t.name(ifd0, tiffTags, tags)
+	if offset, ok := t.uint(ifd0[exifPointer]); ok {
+		t.name(t.ifd(offset), exifTags, tags)
+	}
+	if offset, ok := t.uint(ifd0[gpsPointer]); ok {
+		gps := t.ifd(offset)
+		if v, ok := t.degrees(gps[2], gps[1], "S"); ok {
+			tags["GPSLatitude"] = v
+		}
+		if v, ok := t.degrees(gps[4], gps[3], "W"); ok {
+			tags["GPSLongitude"] = v
+		}
+		if v := t.rationals(gps[6]); len(v) == 1 {
+			if ref := gps[5].value; len(ref) == 1 && ref[0] == 1 {
+				v[0] = -v[0]
+			}
+			tags["GPSAltitude"] = strconv.FormatFloat(v[0], 'f', 1, 64)
+		}
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	return tags
+}
+
+// exifBlock finds the TIFF structure holding the EXIF metadata: an APP1
+// segment of a JPEG, the eXIf chunk of a PNG or the EXIF chunk of a WebP.
+func exifBlock(image []byte) []byte {
+	header := []byte("Exif\x00\x00")
+	switch {
+	case bytes.HasPrefix(image, []byte{0xFF, 0xD8}):
+		for i := 2; i+4 <= len(image) && image[i] == 0xFF; {
+			marker := image[i+1]
+			if marker == 0xD9 || marker == 0xDA { // end of image, start of scan
+				return nil
+			}
+			// The length counts its own 2 bytes
+			length := int(binary.BigEndian.Uint16(image[i+2:]))
+			end := i + 2 + length
+			if length < 2 || end > len(image) {
+				return nil
+			}
+			if segment := image[i+4 : end]; marker == 0xE1 && bytes.HasPrefix(segment, header) {
+				return segment[len(header):]
+			}
+			i = end
+		}
+	case bytes.HasPrefix(image, []byte("\x89PNG\r\n\x1a\n")):
+		for i := 8; i+8 <= len(image); {
+			size := int64(binary.BigEndian.Uint32(image[i:]))
+			kind := string(image[i+4 : i+8])
+			if int64(i)+12+size > int64(len(image)) || kind == "IEND" {
+				return nil
+			}
+			if kind == "eXIf" {
+				return image[i+8 : i+8+int(size)]
+			}
+			i += 12 + int(size)
+		}
+	case len(image) >= 12 && string(image[:4]) == "RIFF" && string(image[8:12]) == "WEBP":
+		for i := 12; i+8 <= len(image); {
+			size := int64(binary.LittleEndian.Uint32(image[i+4:]))
+			if int64(i)+8+size > int64(len(image)) {
+				return nil
+			}
+			if string(image[i:i+4]) == "EXIF" {
+				return bytes.TrimPrefix(image[i+8:i+8+int(size)], header)
+			}
+			i += 8 + int(size) + int(size%2)
+		}
+	}
+	return nil
+}
+
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// field is the type and raw values of a TIFF tag.
+type field struct {
+	typ   uint16
+	value []byte
+}
+
+// ifd reads the image file directory at offset. Entries pointing outside
+// the data are skipped.
+func (t tiff) ifd(offset uint32) map[uint16]field {
+	b := t.data
+	if offset < 8 || int64(offset)+2 > int64(len(b)) {
+		return nil
+	}
+	fields := map[uint16]field{}
+	for i := range int(t.order.Uint16(b[offset:])) {
+		at := int64(offset) + 2 + 12*int64(i)
+		if at+12 > int64(len(b)) {
+			break
+		}
+		tag, typ, count := t.order.Uint16(b[at:]), t.order.Uint16(b[at+2:]), t.order.Uint32(b[at+4:])
+		size := typeSizes[typ] * int64(count)
+		start := at + 8
+		if size > 4 {
+			start = int64(t.order.Uint32(b[at+8:]))
+		}
+		if typeSizes[typ] == 0 || start+size > int64(len(b)) {
+			continue
+		}
+		fields[tag] = field{typ: typ, value: b[start : start+size]}
+	}
+	return fields
+}
+
+// name adds the fields of names to tags as text.
+func (t tiff) name(fields map[uint16]field, names map[uint16]string, tags map[string]string) {
+	for tag, f := range fields {
+		name, ok := names[tag]
+		if !ok {
+			continue
+		}
+		if text := t.text(f); text != "" {
+			tags[name] = text
+		}
+	}
+}
+
+// text formats the first value of f; ASCII fields are read whole.
+func (t tiff) text(f field) string {
+	switch f.typ {
+	case 2:
+		text, _, _ := strings.Cut(string(f.value), "\x00")
+		return strings.TrimSpace(text)
+	case 5, 10:
+		if v := t.rationals(f); len(v) > 0 {
+			return strconv.FormatFloat(v[0], 'f', -1, 64)
+		}
+	default:
+		if v, ok := t.uint(f); ok {
+			return strconv.FormatUint(uint64(v), 10)
+		}
+	}
+	return ""
+}
+
+// uint reads the first value of a BYTE, SHORT or LONG field.
+func (t tiff) uint(f field) (uint32, bool) {
+	switch {
+	case f.typ == 1 && len(f.value) >= 1:
+		return uint32(f.value[0]), true
+	case f.typ == 3 && len(f.value) >= 2:
+		return uint32(t.order.Uint16(f.value)), true
+	case (f.typ == 4 || f.typ == 9) && len(f.value) >= 4:
+		return t.order.Uint32(f.value), true
+	}
+	return 0, false
+}
+
+// rationals reads the values of a RATIONAL or SRATIONAL field.
+func (t tiff) rationals(f field) []float64 {
+	if f.typ != 5 && f.typ != 10 {
+		return nil
+	}
+	var values []float64
+	for i := 0; i+8 <= len(f.value); i += 8 {
+		num, den := t.order.Uint32(f.value[i:]), t.order.Uint32(f.value[i+4:])
+		if den == 0 {
+			return nil
+		}
+		if f.typ == 10 {
+			values = append(values, float64(int32(num))/float64(int32(den)))
+		} else {
+			values = append(values, float64(num)/float64(den))
+		}
+	}
+	return values
+}
+
+// degrees converts a GPS degrees, minutes and seconds field to decimal
+// degrees, negative when ref is negative.
+func (t tiff) degrees(f, ref field, negative string) (string, bool) {
+	v := t.rationals(f)
+	if len(v) != 3 {
+		return "", false
+	}
+	degrees := v[0] + v[1]/60 + v[2]/3600
+	if strings.HasPrefix(t.text(ref), negative) {
+		degrees = -degrees
+	}
+	return fmt.Sprintf("%.6f", degrees), true
+}
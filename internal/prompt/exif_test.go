@@ -0,0 +1,103 @@
+package prompt
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// tiffOrientation is a little-endian TIFF structure whose IFD0 holds an
+// Orientation of 6.
+var tiffOrientation = []byte{
+	'I', 'I', 0x2A, 0x00, 0x08, 0x00, 0x00, 0x00, // header, IFD0 at 8
+	0x01, 0x00, // 1 entry
+	0x12, 0x01, 0x03, 0x00, 0x01, 0x00, 0x00, 0x00, 0x06, 0x00, 0x00, 0x00, // Orientation SHORT 6
+	0x00, 0x00, 0x00, 0x00, // no next IFD
+}
+
+func jpegWith(segments ...[]byte) []byte {
+	image := []byte{0xFF, 0xD8}
+	for _, s := range segments {
+		image = append(image, s...)
+	}
+	return append(image, 0xFF, 0xD9)
+}
+
+func app1(data []byte) []byte {
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(data)+2))
+	return append(segment, data...)
+}
+
+func pngWith(kind string, size uint32, data []byte) []byte {
+	image := []byte("\x89PNG\r\n\x1a\n")
+	image = binary.BigEndian.AppendUint32(image, size)
+	image = append(image, kind...)
+	image = append(image, data...)
+	return append(image, 0, 0, 0, 0) // CRC, not checked
+}
+
+func webpWith(kind string, size uint32, data []byte) []byte {
+	image := []byte("RIFF\x00\x00\x00\x00WEBP")
+	image = append(image, kind...)
+	image = binary.LittleEndian.AppendUint32(image, size)
+	return append(image, data...)
+}
+
+func TestEXIF(t *testing.T) {
+	exif := append([]byte("Exif\x00\x00"), tiffOrientation...)
+	want := map[string]string{"Orientation": "6"}
+	tests := []struct {
+		name  string
+		image []byte
+		want  map[string]string
+	}{
+		{"empty", nil, nil},
+		{"not an image", []byte("hello"), nil},
+
+		{"jpeg", jpegWith(app1(exif)), want},
+		{"jpeg after other segments", jpegWith([]byte{0xFF, 0xE0, 0x00, 0x04, 'J', 'F'}, app1(exif)), want},
+		{"jpeg without exif", jpegWith([]byte{0xFF, 0xE0, 0x00, 0x04, 'J', 'F'}), nil},
+		{"jpeg segment length 0", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x00, 0x00, 0x00}, nil},
+		{"jpeg segment length 1", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x01, 0x00, 0x00}, nil},
+		{"jpeg segment past the end", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0xFF, 0xFF, 'E', 'x'}, nil},
+		{"jpeg truncated marker", []byte{0xFF, 0xD8, 0xFF}, nil},
+		{"jpeg truncated exif", jpegWith(app1(exif))[:20], nil},
+		{"jpeg short exif header", jpegWith(app1([]byte("Exif"))), nil},
+		{"jpeg exif without tiff", jpegWith(app1([]byte("Exif\x00\x00"))), nil},
+		{"jpeg bad byte order", jpegWith(app1([]byte("Exif\x00\x00XX*\x00\x08\x00\x00\x00"))), nil},
+		{"jpeg ifd past the end", jpegWith(app1([]byte("Exif\x00\x00II*\x00\xFF\xFF\xFF\xFF"))), nil},
+
+		{"png", pngWith("eXIf", uint32(len(tiffOrientation)), tiffOrientation), want},
+		{"png chunk past the end", pngWith("eXIf", 1<<31, tiffOrientation), nil},
+		{"png chunk size max", pngWith("eXIf", 0xFFFFFFFF, nil), nil},
+		{"png truncated", pngWith("eXIf", uint32(len(tiffOrientation)), tiffOrientation)[:14], nil},
+		{"png without exif", pngWith("IEND", 0, nil), nil},
+
+		{"webp", webpWith("EXIF", uint32(len(exif)), exif), want},
+		{"webp without exif header", webpWith("EXIF", uint32(len(tiffOrientation)), tiffOrientation), want},
+		{"webp chunk past the end", webpWith("EXIF", 1<<31, exif), nil},
+		{"webp chunk size max", webpWith("EXIF", 0xFFFFFFFF, nil), nil},
+		{"webp truncated", webpWith("EXIF", uint32(len(exif)), exif)[:18], nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := EXIF(tt.image); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("EXIF() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEXIFTruncations(t *testing.T) {
+	exif := append([]byte("Exif\x00\x00"), tiffOrientation...)
+	for _, image := range [][]byte{
+		jpegWith(app1(exif)),
+		pngWith("eXIf", uint32(len(tiffOrientation)), tiffOrientation),
+		webpWith("EXIF", uint32(len(exif)), exif),
+	} {
+		for n := range len(image) {
+			EXIF(image[:n]) // must not panic
+		}
+	}
+}
@@ -0,0 +1,258 @@
+// Package prompt renders the prompts of image extraction requests from
+// text/template templates, with variables, the image file name and its
+// EXIF metadata, and builds the chat messages that carry them: a system
+// prompt, few-shot example image/answer pairs and the images asked about.
+// The CLI and the demo servers share it, so a template means the same in
+// both.
+package prompt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"ubuntuhive.tech/gonovella/internal/upstream"
+)
+
+//go:embed templates/*.tmpl
+var library embed.FS
+
+// Functions available to templates besides the text/template builtins.
+var funcs = template.FuncMap{
+	// default returns value unless it is missing or empty, e.g.
+	// {{default "10" .Vars.count}}.
+	"default": func(fallback, value any) any {
+		if value == nil || value == "" {
+			return fallback
+		}
+		return value
+	},
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"trim":  strings.TrimSpace,
+	"join":  strings.Join,
+}
+
+// Template is a parsed prompt template. Its body renders the prompt, and
+// an optional {{define "system"}} block the system prompt.
+type Template struct {
+	Name   string
+	tmpl   *template.Template
+	source string
+}
+
+// Data is what a template renders.
+type Data struct {
+	Prompt string            // instructions given along with the template, if any
+	Vars   map[string]string // variables from --var flags or the request
+	File   File
+	EXIF   map[string]string // see EXIF for the names
+	Images int               // number of images asked about
+	Labels []string          // labels of the images, empty for unlabelled ones
+}
+
+// File names the image a prompt is about. It is empty for uploads.
+type File struct {
+	Path string // as given
+	Name string // base name, e.g. photo.jpg
+	Base string // base name without extension, e.g. photo
+	Ext  string // extension without the dot, e.g. jpg
+	Dir  string
+}
+
+// FileOf describes the image file at path.
+func FileOf(path string) File {
+	name := filepath.Base(path)
+	ext := filepath.Ext(name)
+	return File{
+		Path: path,
+		Name: name,
+		Base: strings.TrimSuffix(name, ext),
+		Ext:  strings.TrimPrefix(ext, "."),
+		Dir:  filepath.Dir(path),
+	}
+}
+
+// Example is a few-shot example: an image, as data URL, and the answer
+// expected for it.
+type Example struct {
+	Image  string `json:"image"`
+	Answer string `json:"answer"`
+}
+
+// Names lists the templates of the library.
+func Names() []string {
+	entries, _ := library.ReadDir("templates")
+	var names []string
+	for _, e := range entries {
+		names = append(names, strings.TrimSuffix(e.Name(), ".tmpl"))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Named returns the library template called name.
+func Named(name string) (*Template, error) {
+	text, err := library.ReadFile("templates/" + name + ".tmpl")
+	if err != nil {
+		return nil, fmt.Errorf("unknown template %q (want one of %s)", name, strings.Join(Names(), ", "))
+	}
+	return Parse(name, string(text))
+}
+
+// Load parses the template file at path.
+func Load(path string) (*Template, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading template: %w", err)
+	}
+	return Parse(filepath.Base(path), string(text))
+}
+
+// Parse parses text as a template called name.
+func Parse(name, text string) (*Template, error) {
+	tmpl, err := template.New(name).Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing template: %w", err)
+	}
+	return &Template{Name: name, tmpl: tmpl, source: text}, nil
+}
+
+// Execute renders the system prompt, empty when the template defines none,
+// and the prompt, both without surrounding whitespace.
+func (t *Template) Execute(data Data) (system, prompt string, err error) {
+	var b bytes.Buffer
+	if s := t.tmpl.Lookup("system"); s != nil {
+		if err := s.Execute(&b, data); err != nil {
+			return "", "", fmt.Errorf("error rendering template: %w", err)
+		}
+		system = strings.TrimSpace(b.String())
+		b.Reset()
+	}
+	if err := t.tmpl.Execute(&b, data); err != nil {
+		return "", "", fmt.Errorf("error rendering template: %w", err)
+	}
+	return system, strings.TrimSpace(b.String()), nil
+}
+
+// Spec is how a request asks about its images: an optional template with
+// its variables, a system prompt replacing the template's and few-shot
+// examples. CLI flags and upload fields both fill one in.
+type Spec struct {
+	Template *Template
+	Vars     map[string]string
+	System   string
+	Examples []Example
+}
+
+// Render renders the spec for data. Without a template the prompt is
+// data.Prompt as it is.
+func (s Spec) Render(data Data) (Rendered, error) {
+	r := Rendered{System: s.System, Prompt: data.Prompt, Examples: s.Examples}
+	if s.Template == nil {
+		return r, nil
+	}
+	data.Vars = s.Vars
+	system, prompt, err := s.Template.Execute(data)
+	if err != nil {
+		return Rendered{}, err
+	}
+	if r.System == "" {
+		r.System = system
+	}
+	r.Prompt = prompt
+	return r, nil
+}
+
+// Key identifies the spec and prompt, before rendering, for checkpoints.
+// It is the prompt itself when the spec is empty.
+func (s Spec) Key(prompt string) string {
+	if s.Template == nil && s.System == "" && len(s.Examples) == 0 {
+		return prompt
+	}
+	h := sha256.New()
+	if s.Template != nil {
+		fmt.Fprintf(h, "%s\x00%s\x00", s.Template.Name, s.Template.source)
+	}
+	names := make([]string, 0, len(s.Vars))
+	for name := range s.Vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h, "%s=%s\x00", name, s.Vars[name])
+	}
+	return prompt + "\x00" + hex.EncodeToString(Rendered{System: s.System, Examples: s.Examples}.sum(h))
+}
+
+// Rendered is a prompt ready to send.
+type Rendered struct {
+	System   string
+	Prompt   string
+	Examples []Example
+}
+
+// Image is an image asked about, as a URL. Its label, if any, names it in
+// the message, e.g. before or page 2.
+type Image struct {
+	URL   string
+	Label string
+}
+
+// Messages asks the prompt about images. The system prompt, if any, comes
+// first, then each example as the prompt about its image answered by the
+// assistant.
+func (r Rendered) Messages(images ...string) []upstream.Message {
+	labeled := make([]Image, len(images))
+	for i, url := range images {
+		labeled[i] = Image{URL: url}
+	}
+	return r.LabeledMessages(labeled...)
+}
+
+// LabeledMessages is Messages for images that may have labels. A labelled
+// image follows a text part naming it by number and label, so that the
+// prompt and the answer can refer to it.
+func (r Rendered) LabeledMessages(images ...Image) []upstream.Message {
+	var messages []upstream.Message
+	if r.System != "" {
+		messages = append(messages, upstream.SystemMessage(r.System))
+	}
+	for _, e := range r.Examples {
+		messages = append(messages, upstream.UserMessage(r.Prompt, e.Image), upstream.AssistantMessage(e.Answer))
+	}
+	message := upstream.UserMessage(r.Prompt)
+	for i, image := range images {
+		if image.Label != "" {
+			message.Content = append(message.Content, upstream.Part{Type: "text", Text: fmt.Sprintf("Image %d: %s", i+1, image.Label)})
+		}
+		message.Content = append(message.Content, upstream.Part{Type: "image_url", ImageURL: &upstream.ImageURL{URL: image.URL}})
+	}
+	return append(messages, message)
+}
+
+// Key stands for the prompt in result cache keys and idempotency
+// fingerprints. It is the prompt itself when there is no system prompt and
+// no example, so that plain prompts keep their cached results.
+func (r Rendered) Key() string {
+	if r.System == "" && len(r.Examples) == 0 {
+		return r.Prompt
+	}
+	return r.Prompt + "\x00" + hex.EncodeToString(r.sum(sha256.New()))
+}
+
+func (r Rendered) sum(h hash.Hash) []byte {
+	fmt.Fprintf(h, "%s\x00", r.System)
+	for _, e := range r.Examples {
+		fmt.Fprintf(h, "%s\x00%s\x00", e.Image, e.Answer)
+	}
+	return h.Sum(nil)
+}
@@ -0,0 +1,75 @@
+// Package quota gives API keys daily and monthly request and token budgets.
+// Callers over a soft limit are warned, callers over a hard limit get 429
+// with RateLimit-* headers until the period resets. Usage is persisted in a
+// local JSON file so restarts do not hand out fresh budgets.
+package quota
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Limits caps a period. Zero means unlimited.
+type Limits struct {
+	Requests int `yaml:"requests" json:"requests"`
+	Tokens   int `yaml:"tokens" json:"tokens"`
+}
+
+// Key is one API key and its budget.
+type Key struct {
+	Name    string `yaml:"name"`
+	Key     string `yaml:"key"`
+	Admin   bool   `yaml:"admin"`
+	Daily   Limits `yaml:"daily"`
+	Monthly Limits `yaml:"monthly"`
+
+	// SoftPercent is the share of a limit after which responses carry a
+	// warning. Zero defaults to 80.
+	SoftPercent int `yaml:"soft_percent"`
+}
+
+// Config is the keys file, for example:
+//
+//	keys:
+//	  - name: frontend
+//	    key: sk-local-frontend
+//	    scopes: [images:extract]
+//	    daily: {requests: 500, tokens: 2000000}
+//	    monthly: {tokens: 30000000}
+//	  - name: ops
+//	    key: sk-local-ops
+//	    scopes: [usage:read, usage:admin]
+//	    admin: true
+//
+// The scopes are read by the auth package, which shares this file.
+type Config struct {
+	Keys []Key `yaml:"keys"`
+}
+
+// LoadConfig reads a keys file.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading keys file: %w", err)
+	}
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("error parsing keys file: %w", err)
+	}
+	seen := make(map[string]bool)
+	for i, k := range config.Keys {
+		if k.Name == "" || k.Key == "" {
+			return nil, fmt.Errorf("keys file entry %d needs a name and a key", i+1)
+		}
+		if seen[k.Name] {
+			return nil, fmt.Errorf("keys file has duplicate name %q", k.Name)
+		}
+		seen[k.Name] = true
+		if k.SoftPercent == 0 {
+			config.Keys[i].SoftPercent = 80
+		}
+	}
+	return &config, nil
+}
@@ -0,0 +1,236 @@
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"ubuntuhive.tech/gonovella/internal/auth"
+	"ubuntuhive.tech/gonovella/internal/logging"
+	"ubuntuhive.tech/gonovella/internal/problem"
+)
+
+// Manager enforces the budgets of the configured keys.
+type Manager struct {
+	keys   map[string]Key // by secret
+	byName map[string]Key
+	store  *Store
+	now    func() time.Time
+}
+
+// New returns a manager for the keys in config, persisting usage in store.
+func New(config *Config, store *Store) *Manager {
+	m := &Manager{
+		keys:   make(map[string]Key),
+		byName: make(map[string]Key),
+		store:  store,
+		now:    time.Now,
+	}
+	for _, k := range config.Keys {
+		m.keys[k.Key] = k
+		m.byName[k.Name] = k
+	}
+	return m
+}
+
+type callerKey struct{}
+
+type caller struct {
+	name    string
+	manager *Manager
+}
+
+// Caller returns the name of the key that made the request, or "" when
+// quotas are not enforced.
+func Caller(ctx context.Context) string {
+	if c, ok := ctx.Value(callerKey{}).(caller); ok {
+		return c.name
+	}
+	return ""
+}
+
+// Record charges tokens to the key that made the request.
+func Record(ctx context.Context, tokens int) {
+	c, ok := ctx.Value(callerKey{}).(caller)
+	if !ok || tokens == 0 {
+		return
+	}
+	_, err := c.manager.store.update(c.name, c.manager.now(), func(u *Usage) {
+		u.Day.Tokens += tokens
+		u.Month.Tokens += tokens
+	})
+	if err != nil {
+		logging.From(ctx).Error("quota store failed", "error", err)
+	}
+}
+
+// check is one limit measured against current usage.
+type check struct {
+	window  string
+	kind    string
+	limit   int
+	used    int
+	seconds int // until the window resets
+}
+
+func (c check) remaining() int {
+	return max(c.limit-c.used, 0)
+}
+
+// checks lists the limits of k that are set, measured against u.
+func checks(k Key, u Usage, now time.Time) []check {
+	day := int(u.Day.Start.AddDate(0, 0, 1).Sub(now).Seconds())
+	month := int(u.Month.Start.AddDate(0, 1, 0).Sub(now).Seconds())
+	all := []check{
+		{"daily", "requests", k.Daily.Requests, u.Day.Requests, day},
+		{"daily", "tokens", k.Daily.Tokens, u.Day.Tokens, day},
+		{"monthly", "requests", k.Monthly.Requests, u.Month.Requests, month},
+		{"monthly", "tokens", k.Monthly.Tokens, u.Month.Tokens, month},
+	}
+	var set []check
+	for _, c := range all {
+		if c.limit > 0 {
+			set = append(set, c)
+		}
+	}
+	return set
+}
+
+// Middleware identifies the caller and admits the request if none of its
+// hard limits has been reached. Callers authenticated by the auth package
+// are looked up by name and are unlimited when they have no budget; other
+// callers are identified by their X-API-Key header.
+func (m *Manager) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			key Key
+			ok  bool
+		)
+		if p, authenticated := auth.FromContext(r.Context()); authenticated {
+			if key, ok = m.byName[p.Name]; !ok {
+				key, ok = Key{Name: p.Name, SoftPercent: 80}, true
+			}
+		} else {
+			key, ok = m.keys[r.Header.Get("X-API-Key")]
+		}
+		if !ok {
+			problem.Write(w, http.StatusUnauthorized, "missing or unknown API key")
+			return
+		}
+
+		var (
+			tightest *check
+			exceeded bool
+		)
+		_, err := m.store.update(key.Name, m.now(), func(u *Usage) {
+			for _, c := range checks(key, *u, m.now()) {
+				if c.used >= c.limit {
+					tightest, exceeded = &c, true
+					return
+				}
+				if tightest == nil || c.remaining()*tightest.limit < tightest.remaining()*c.limit {
+					tightest = &c
+				}
+			}
+			u.Day.Requests++
+			u.Month.Requests++
+			if tightest != nil && tightest.kind == "requests" {
+				tightest.used++
+			}
+		})
+		if err != nil {
+			logging.From(r.Context()).Error("quota store failed", "error", err)
+		}
+
+		if tightest != nil {
+			w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d;comment=%q", tightest.limit, tightest.seconds, tightest.window+" "+tightest.kind))
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(tightest.limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(tightest.remaining()))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(tightest.seconds))
+		}
+		if exceeded {
+			logging.From(r.Context()).Warn("quota exceeded", "key", key.Name, "window", tightest.window, "kind", tightest.kind, "limit", tightest.limit)
+			w.Header().Set("Retry-After", strconv.Itoa(tightest.seconds))
+			problem.Write(w, http.StatusTooManyRequests, fmt.Sprintf("%s %s quota of %d exhausted", tightest.window, tightest.kind, tightest.limit))
+			return
+		}
+		if tightest != nil && tightest.used*100 >= tightest.limit*key.SoftPercent {
+			logging.From(r.Context()).Info("quota soft limit passed", "key", key.Name, "percent", key.SoftPercent, "window", tightest.window, "kind", tightest.kind)
+			w.Header().Set("X-Quota-Warning", fmt.Sprintf("%d of %d %s %s used", tightest.used, tightest.limit, tightest.window, tightest.kind))
+		}
+
+		ctx := context.WithValue(r.Context(), callerKey{}, caller{name: key.Name, manager: m})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Status is a key's usage as reported by the admin endpoint.
+type Status struct {
+	Name    string `json:"name"`
+	Usage   Usage  `json:"usage"`
+	Daily   Limits `json:"daily"`
+	Monthly Limits `json:"monthly"`
+}
+
+// AdminHandler serves, for callers presenting an admin key or granted the
+// usage:admin scope:
+//
+//	GET  /admin/usage               usage of every key
+//	GET  /admin/usage/{name}        usage of one key
+//	POST /admin/usage/{name}/reset  zero the current periods of one key
+func (m *Manager) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/usage", func(w http.ResponseWriter, r *http.Request) {
+		usage := m.store.snapshot(m.now())
+		report := make([]Status, 0, len(m.byName))
+		for name, k := range m.byName {
+			report = append(report, Status{Name: name, Usage: usage[name], Daily: k.Daily, Monthly: k.Monthly})
+		}
+		sort.Slice(report, func(i, j int) bool { return report[i].Name < report[j].Name })
+		writeJSON(w, report)
+	})
+	mux.HandleFunc("GET /admin/usage/{name}", func(w http.ResponseWriter, r *http.Request) {
+		k, ok := m.byName[r.PathValue("name")]
+		if !ok {
+			problem.Write(w, http.StatusNotFound, "unknown key name")
+			return
+		}
+		writeJSON(w, Status{Name: k.Name, Usage: m.store.snapshot(m.now())[k.Name], Daily: k.Daily, Monthly: k.Monthly})
+	})
+	mux.HandleFunc("POST /admin/usage/{name}/reset", func(w http.ResponseWriter, r *http.Request) {
+		k, ok := m.byName[r.PathValue("name")]
+		if !ok {
+			problem.Write(w, http.StatusNotFound, "unknown key name")
+			return
+		}
+		usage, err := m.store.update(k.Name, m.now(), func(u *Usage) {
+			u.Day = Counter{Start: u.Day.Start}
+			u.Month = Counter{Start: u.Month.Start}
+		})
+		if err != nil {
+			problem.Write(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		logging.From(r.Context()).Info("quota usage reset", "key", k.Name)
+		writeJSON(w, Status{Name: k.Name, Usage: usage, Daily: k.Daily, Monthly: k.Monthly})
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p, ok := auth.FromContext(r.Context()); !ok || !p.HasScope("usage:admin") {
+			if key, ok := m.keys[r.Header.Get("X-API-Key")]; !ok || !key.Admin {
+				problem.Write(w, http.StatusForbidden, "admin key required")
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
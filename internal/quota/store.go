@@ -0,0 +1,124 @@
+package quota
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Counter is the usage of one period.
+type Counter struct {
+	Start    time.Time `json:"start"`
+	Requests int       `json:"requests"`
+	Tokens   int       `json:"tokens"`
+}
+
+// Usage is the usage of one key in the current day and month.
+type Usage struct {
+	Day   Counter `json:"day"`
+	Month Counter `json:"month"`
+}
+
+// Store keeps usage per key name in a JSON file. An empty path keeps it in
+// memory only.
+type Store struct {
+	mu    sync.Mutex
+	path  string
+	usage map[string]*Usage
+}
+
+// OpenStore loads the store at path, starting empty if it does not exist.
+func OpenStore(path string) (*Store, error) {
+	s := &Store{path: path, usage: make(map[string]*Usage)}
+	if path == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading quota store: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.usage); err != nil {
+		return nil, fmt.Errorf("error parsing quota store: %w", err)
+	}
+	return s, nil
+}
+
+// update applies fn to the usage of name, rolling periods over first, and
+// persists the result.
+func (s *Store) update(name string, now time.Time, fn func(*Usage)) (Usage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.usage[name]
+	if !ok {
+		u = &Usage{}
+		s.usage[name] = u
+	}
+	roll(u, now)
+	fn(u)
+	return *u, s.save()
+}
+
+// snapshot returns the usage of every key.
+func (s *Store) snapshot(now time.Time) map[string]Usage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make(map[string]Usage, len(s.usage))
+	for name, u := range s.usage {
+		roll(u, now)
+		out[name] = *u
+	}
+	return out
+}
+
+// save writes the store atomically. Callers hold s.mu.
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.usage, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding quota store: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error writing quota store: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error writing quota store: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error writing quota store: %w", err)
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// roll starts new periods once the current ones are over.
+func roll(u *Usage, now time.Time) {
+	if day := dayStart(now); !u.Day.Start.Equal(day) {
+		u.Day = Counter{Start: day}
+	}
+	if month := monthStart(now); !u.Month.Start.Equal(month) {
+		u.Month = Counter{Start: month}
+	}
+}
+
+func dayStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
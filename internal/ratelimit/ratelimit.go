@@ -0,0 +1,227 @@
+// Package ratelimit throttles each client with token buckets, keyed by the
+// authenticated caller or the client IP, and caps how many streams a client
+// may hold open at once.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"ubuntuhive.tech/gonovella/internal/auth"
+	"ubuntuhive.tech/gonovella/internal/logging"
+	"ubuntuhive.tech/gonovella/internal/problem"
+)
+
+// Rate allows Requests per Per, in bursts of up to Burst requests.
+type Rate struct {
+	Requests int           `yaml:"requests"`
+	Per      time.Duration `yaml:"per"`
+	Burst    int           `yaml:"burst"` // defaults to Requests
+}
+
+func (r Rate) burst() int {
+	if r.Burst > 0 {
+		return r.Burst
+	}
+	return r.Requests
+}
+
+func (r Rate) perSecond() float64 {
+	return float64(r.Requests) / r.Per.Seconds()
+}
+
+// Config sets the limits of every client, usually loaded from a YAML file:
+//
+//	trusted_proxies: [127.0.0.1, 10.0.0.0/8]
+//	requests: {requests: 60, per: 1m, burst: 10}
+//	streams: {requests: 10, per: 1m, burst: 3}
+//	max_streams: 2
+//
+// Requests limits non-streaming requests and Streams streaming ones.
+// X-Forwarded-For is only believed when the connection comes from one of
+// TrustedProxies.
+type Config struct {
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	Requests       Rate     `yaml:"requests"`
+	Streams        Rate     `yaml:"streams"`
+	MaxStreams     int      `yaml:"max_streams"`
+}
+
+// DefaultConfig applies when no config file is given.
+var DefaultConfig = Config{
+	Requests:   Rate{Requests: 60, Per: time.Minute, Burst: 10},
+	Streams:    Rate{Requests: 20, Per: time.Minute, Burst: 5},
+	MaxStreams: 3,
+}
+
+// LoadConfig reads a YAML config file. An empty path returns DefaultConfig.
+func LoadConfig(path string) (*Config, error) {
+	if path == "" {
+		config := DefaultConfig
+		return &config, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading rate limit config: %w", err)
+	}
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("error parsing rate limit config: %w", err)
+	}
+	for name, rate := range map[string]Rate{"requests": config.Requests, "streams": config.Streams} {
+		if rate.Requests <= 0 || rate.Per <= 0 {
+			return nil, fmt.Errorf("rate limit %s needs positive requests and per", name)
+		}
+	}
+	return &config, nil
+}
+
+// Limiter enforces a Config against a Store.
+type Limiter struct {
+	config  Config
+	store   Store
+	proxies []netip.Prefix
+	now     func() time.Time
+
+	// IsStream reports whether a request asks for a stream. By default a
+	// request is a stream when it accepts text/event-stream.
+	IsStream func(r *http.Request) bool
+}
+
+// New returns a limiter for config keeping its state in store.
+func New(config *Config, store Store) (*Limiter, error) {
+	l := &Limiter{
+		config:   *config,
+		store:    store,
+		now:      time.Now,
+		IsStream: acceptsEventStream,
+	}
+	for _, proxy := range config.TrustedProxies {
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(proxy)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		l.proxies = append(l.proxies, prefix.Masked())
+	}
+	return l, nil
+}
+
+// FromEnv configures an in-memory limiter from the RATE_LIMITS config file,
+// falling back to DefaultConfig.
+func FromEnv() (*Limiter, error) {
+	config, err := LoadConfig(os.Getenv("RATE_LIMITS"))
+	if err != nil {
+		return nil, err
+	}
+	return New(config, NewMemory())
+}
+
+func acceptsEventStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// Middleware admits a request if its client has a token left in the bucket
+// for its kind of request and, for streams, fewer than MaxStreams open.
+// Otherwise it answers 429 with Retry-After. A failing store lets requests
+// through rather than taking the API down with it.
+func (l *Limiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := l.Client(r)
+		stream := l.IsStream(r)
+
+		kind, rate := "requests", l.config.Requests
+		if stream {
+			kind, rate = "streams", l.config.Streams
+		}
+		ok, wait, err := l.store.Take(kind+":"+client, rate, l.now())
+		if err != nil {
+			logging.From(r.Context()).Error("rate limit store failed", "error", err)
+		} else if !ok {
+			tooManyRequests(w, wait, fmt.Sprintf("rate limit of %d %s per %s exceeded", rate.Requests, kind, rate.Per))
+			return
+		}
+
+		if stream && l.config.MaxStreams > 0 {
+			ok, err := l.store.Acquire("open:"+client, l.config.MaxStreams)
+			if err != nil {
+				logging.From(r.Context()).Error("rate limit store failed", "error", err)
+			} else if !ok {
+				tooManyRequests(w, time.Second, fmt.Sprintf("at most %d concurrent streams allowed", l.config.MaxStreams))
+				return
+			} else {
+				defer func() {
+					if err := l.store.Release("open:" + client); err != nil {
+						logging.From(r.Context()).Error("rate limit store failed", "error", err)
+					}
+				}()
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration, detail string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	problem.Write(w, http.StatusTooManyRequests, detail)
+}
+
+// Client identifies who made r: the principal the auth package
+// authenticated, by an API key or a token, else the client IP. Credentials
+// nobody verified are ignored, since a client could send new ones with
+// every request to get a fresh bucket each time.
+func (l *Limiter) Client(r *http.Request) string {
+	if p, ok := auth.FromContext(r.Context()); ok {
+		return "principal:" + p.Name
+	}
+	return "ip:" + l.ClientIP(r)
+}
+
+// ClientIP returns the address of the client. Walking X-Forwarded-For from
+// the right, it skips trusted proxies and returns the first address that
+// is not one, so clients cannot spoof their way past the limits.
+func (l *Limiter) ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !l.trusted(addr) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop
+		if !l.trusted(hop) {
+			break
+		}
+	}
+	return addr.Unmap().String()
+}
+
+func (l *Limiter) trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range l.proxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
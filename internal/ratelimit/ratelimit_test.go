@@ -0,0 +1,145 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ubuntuhive.tech/gonovella/internal/auth"
+)
+
+func newLimiter(t *testing.T, config Config) *Limiter {
+	t.Helper()
+	l, err := New(&config, NewMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestClientIP(t *testing.T) {
+	l := newLimiter(t, Config{TrustedProxies: []string{"10.0.0.0/8", "192.0.2.1"}})
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{"direct", "203.0.113.5:1234", nil, "203.0.113.5"},
+		{"untrusted peer spoofing", "203.0.113.5:1234", []string{"198.51.100.7"}, "203.0.113.5"},
+		{"trusted proxy", "10.1.2.3:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"single trusted address", "192.0.2.1:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"trusted proxy without header", "10.1.2.3:1234", nil, "10.1.2.3"},
+		{"chain of trusted proxies", "10.1.2.3:1234", []string{"198.51.100.7, 10.9.9.9"}, "198.51.100.7"},
+		{"spoofed leftmost hop", "10.1.2.3:1234", []string{"1.1.1.1, 198.51.100.7"}, "198.51.100.7"},
+		{"several headers", "10.1.2.3:1234", []string{"1.1.1.1", "198.51.100.7, 10.9.9.9"}, "198.51.100.7"},
+		{"all hops trusted", "10.1.2.3:1234", []string{"10.8.8.8, 10.9.9.9"}, "10.8.8.8"},
+		{"garbage hop", "10.1.2.3:1234", []string{"198.51.100.7, nonsense"}, "10.1.2.3"},
+		{"mapped ipv4", "[::ffff:10.1.2.3]:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"ipv6 client", "10.1.2.3:1234", []string{"2001:db8::1"}, "2001:db8::1"},
+		{"no port", "203.0.113.5", nil, "203.0.113.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, v := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := l.ClientIP(r); got != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientIPWithoutTrustedProxies(t *testing.T) {
+	l := newLimiter(t, Config{})
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+	if got := l.ClientIP(r); got != "127.0.0.1" {
+		t.Errorf("ClientIP() = %q, want the peer address", got)
+	}
+}
+
+func TestClient(t *testing.T) {
+	l := newLimiter(t, Config{})
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.RemoteAddr = "203.0.113.5:1234"
+	if got := l.Client(r); got != "ip:203.0.113.5" {
+		t.Errorf("Client() = %q, want the IP", got)
+	}
+
+	// Keys nobody verified do not get buckets of their own
+	r.Header.Set("X-API-Key", "sk-made-up")
+	if got := l.Client(r); got != "ip:203.0.113.5" {
+		t.Errorf("Client() with an unverified key = %q, want the IP", got)
+	}
+
+	// Callers the auth package authenticated are limited by name
+	path := filepath.Join(t.TempDir(), "keys.yaml")
+	keysFile := "keys:\n  - name: frontend\n    key: sk-local-frontend\n"
+	if err := os.WriteFile(path, []byte(keysFile), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := auth.LoadAPIKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	handler := auth.New(keys).Require("")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = l.Client(r)
+	}))
+	r.Header.Set("X-API-Key", "sk-local-frontend")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if got != "principal:frontend" {
+		t.Errorf("Client() of an authenticated caller = %q, want principal:frontend", got)
+	}
+}
+
+func TestNewRejectsInvalidProxy(t *testing.T) {
+	if _, err := New(&Config{TrustedProxies: []string{"not-an-address"}}, NewMemory()); err == nil {
+		t.Error("New() accepted an invalid trusted proxy")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	l := newLimiter(t, Config{
+		Requests:   Rate{Requests: 1, Per: time.Minute},
+		Streams:    Rate{Requests: 10, Per: time.Minute},
+		MaxStreams: 1,
+	})
+	handler := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(stream bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.RemoteAddr = "203.0.113.5:1234"
+		if stream {
+			r.Header.Set("Accept", "text/event-stream")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve(false); w.Code != http.StatusOK {
+		t.Fatalf("first request: status %d", w.Code)
+	}
+	w := serve(false)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request: status %d, want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Retry-After = %q, want 60", got)
+	}
+
+	// Streams have a bucket of their own, and release their slot when done
+	for i := range 2 {
+		if w := serve(true); w.Code != http.StatusOK {
+			t.Fatalf("stream %d: status %d", i+1, w.Code)
+		}
+	}
+}
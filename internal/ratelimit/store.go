@@ -0,0 +1,103 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Store keeps token buckets and stream counts. Memory keeps them in the
+// process; a Redis-compatible store lets several instances share them.
+type Store interface {
+	// Take removes a token from the bucket at key, refilled at rate. When
+	// the bucket is empty it reports how long until the next token.
+	Take(key string, rate Rate, now time.Time) (ok bool, retryAfter time.Duration, err error)
+
+	// Acquire counts a stream against key unless limit are already open.
+	Acquire(key string, limit int) (bool, error)
+
+	// Release ends a stream counted by Acquire.
+	Release(key string) error
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time // when the bucket will have refilled completely
+}
+
+// Memory is an in-process Store.
+type Memory struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	streams map[string]int
+	swept   time.Time
+}
+
+// NewMemory returns an empty in-process store.
+func NewMemory() *Memory {
+	return &Memory{
+		buckets: make(map[string]*bucket),
+		streams: make(map[string]int),
+	}
+}
+
+func (m *Memory) Take(key string, rate Rate, now time.Time) (bool, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sweep(now)
+	capacity := float64(rate.burst())
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, last: now}
+		m.buckets[key] = b
+	}
+	perSecond := rate.perSecond()
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		b.full = now.Add(time.Duration((capacity - b.tokens) / perSecond * float64(time.Second)))
+		return true, 0, nil
+	}
+	wait := time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+	return false, wait, nil
+}
+
+func (m *Memory) Acquire(key string, limit int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.streams[key] >= limit {
+		return false, nil
+	}
+	m.streams[key]++
+	return true, nil
+}
+
+func (m *Memory) Release(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.streams[key] <= 1 {
+		delete(m.streams, key)
+	} else {
+		m.streams[key]--
+	}
+	return nil
+}
+
+// sweep drops, once a minute, the buckets that have refilled completely,
+// since a missing bucket starts out full anyway.
+func (m *Memory) sweep(now time.Time) {
+	if now.Sub(m.swept) < time.Minute {
+		return
+	}
+	m.swept = now
+	for key, b := range m.buckets {
+		if !now.Before(b.full) {
+			delete(m.buckets, key)
+		}
+	}
+}
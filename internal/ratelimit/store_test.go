@@ -0,0 +1,81 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryTake(t *testing.T) {
+	m := NewMemory()
+	rate := Rate{Requests: 60, Per: time.Minute, Burst: 3}
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := range 3 {
+		if ok, _, _ := m.Take("a", rate, now); !ok {
+			t.Fatalf("take %d of the burst refused", i+1)
+		}
+	}
+	ok, wait, err := m.Take("a", rate, now)
+	if err != nil || ok {
+		t.Fatalf("take past the burst = %v, %v, want refused", ok, err)
+	}
+	if wait != time.Second {
+		t.Errorf("wait = %s, want 1s", wait)
+	}
+
+	// Other keys have buckets of their own
+	if ok, _, _ := m.Take("b", rate, now); !ok {
+		t.Error("take of another key refused")
+	}
+
+	// A token comes back every second, up to the burst
+	if ok, _, _ := m.Take("a", rate, now.Add(500*time.Millisecond)); ok {
+		t.Error("take before a token refilled allowed")
+	}
+	if ok, _, _ := m.Take("a", rate, now.Add(time.Second)); !ok {
+		t.Error("take after a token refilled refused")
+	}
+	later := now.Add(time.Hour)
+	for i := range 3 {
+		if ok, _, _ := m.Take("a", rate, later); !ok {
+			t.Fatalf("take %d after refilling refused", i+1)
+		}
+	}
+	if ok, _, _ := m.Take("a", rate, later); ok {
+		t.Error("bucket refilled past its burst")
+	}
+}
+
+func TestMemoryTakeDefaultBurst(t *testing.T) {
+	m := NewMemory()
+	rate := Rate{Requests: 2, Per: time.Minute}
+	now := time.Now()
+	for i := range 2 {
+		if ok, _, _ := m.Take("a", rate, now); !ok {
+			t.Fatalf("take %d refused", i+1)
+		}
+	}
+	ok, wait, _ := m.Take("a", rate, now)
+	if ok {
+		t.Fatal("take past the requests allowed")
+	}
+	if wait != 30*time.Second {
+		t.Errorf("wait = %s, want 30s", wait)
+	}
+}
+
+func TestMemoryAcquire(t *testing.T) {
+	m := NewMemory()
+	for i := range 2 {
+		if ok, _ := m.Acquire("a", 2); !ok {
+			t.Fatalf("stream %d refused", i+1)
+		}
+	}
+	if ok, _ := m.Acquire("a", 2); ok {
+		t.Fatal("stream over the limit allowed")
+	}
+	m.Release("a")
+	if ok, _ := m.Acquire("a", 2); !ok {
+		t.Error("stream after a release refused")
+	}
+}
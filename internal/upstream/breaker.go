@@ -0,0 +1,116 @@
+package upstream
+
+import (
+	"sync"
+	"time"
+)
+
+// State is the state of a circuit breaker.
+type State string
+
+const (
+	StateClosed   State = "closed"    // calls flow normally
+	StateOpen     State = "open"      // calls fail fast
+	StateHalfOpen State = "half-open" // one trial call decides
+)
+
+// Breaker stops calling the provider after repeated failures and lets a
+// single trial call through once the cool-down has passed.
+type Breaker struct {
+	mu        sync.Mutex
+	threshold int
+	coolDown  time.Duration
+	failures  int
+	state     State
+	openedAt  time.Time
+	trial     bool
+
+	// OnStateChange, when set, is called after every transition.
+	OnStateChange func(from, to State)
+}
+
+// NewBreaker returns a breaker that opens after threshold consecutive
+// failures and stays open for coolDown.
+func NewBreaker(threshold int, coolDown time.Duration) *Breaker {
+	return &Breaker{
+		threshold: threshold,
+		coolDown:  coolDown,
+		state:     StateClosed,
+	}
+}
+
+// State returns the current state.
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Allow reports whether a call may go ahead and, when it may not, how long
+// until the breaker will let a trial call through.
+func (b *Breaker) Allow() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case StateOpen:
+		if wait := b.coolDown - time.Since(b.openedAt); wait > 0 {
+			return false, wait
+		}
+		b.transition(StateHalfOpen)
+		b.trial = true
+		return true, 0
+	case StateHalfOpen:
+		// Only the trial call is allowed until it reports back
+		if b.trial {
+			return false, b.coolDown
+		}
+		b.trial = true
+		return true, 0
+	}
+	return true, 0
+}
+
+// Success records a successful call and closes the breaker.
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.trial = false
+	if b.state != StateClosed {
+		b.transition(StateClosed)
+	}
+}
+
+// Release gives back a trial call that ended without a verdict, such as
+// one cancelled by the caller.
+func (b *Breaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+}
+
+// Failure records a failed call, opening the breaker once the threshold is
+// reached or when the half-open trial fails.
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.trial = false
+	if b.state == StateHalfOpen || b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		if b.state != StateOpen {
+			b.transition(StateOpen)
+		}
+	}
+}
+
+func (b *Breaker) transition(to State) {
+	from := b.state
+	b.state = to
+	if b.OnStateChange != nil {
+		b.OnStateChange(from, to)
+	}
+}
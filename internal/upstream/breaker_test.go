@@ -0,0 +1,67 @@
+package upstream
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	// Steps: F records a failure, S a success, R releases the trial, A
+	// expects Allow to let a call through and D expects it to refuse one
+	tests := []struct {
+		name        string
+		coolDown    time.Duration
+		steps       string
+		want        State
+		transitions []string
+	}{
+		{"stays closed under the threshold", time.Hour, "AFAFA", StateClosed, nil},
+		{"success resets the count", time.Hour, "FFSFF", StateClosed, nil},
+		{"opens at the threshold", time.Hour, "FFF", StateOpen, []string{"closed>open"}},
+		{"open refuses calls", time.Hour, "FFFD", StateOpen, []string{"closed>open"}},
+		{"half-open after the cool-down", 0, "FFFA", StateHalfOpen, []string{"closed>open", "open>half-open"}},
+		{"one trial at a time", 0, "FFFAD", StateHalfOpen, []string{"closed>open", "open>half-open"}},
+		{"trial success closes", 0, "FFFASA", StateClosed, []string{"closed>open", "open>half-open", "half-open>closed"}},
+		{"failed trial reopens", 0, "FFFAF", StateOpen, []string{"closed>open", "open>half-open", "half-open>open"}},
+		{"released trial lets another through", 0, "FFFARA", StateHalfOpen, []string{"closed>open", "open>half-open"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBreaker(3, tt.coolDown)
+			var transitions []string
+			b.OnStateChange = func(from, to State) {
+				transitions = append(transitions, string(from)+">"+string(to))
+			}
+			for i, step := range tt.steps {
+				switch step {
+				case 'F':
+					b.Failure()
+				case 'S':
+					b.Success()
+				case 'R':
+					b.Release()
+				case 'A', 'D':
+					if ok, _ := b.Allow(); ok != (step == 'A') {
+						t.Fatalf("step %d: Allow() = %v in state %s", i+1, ok, b.State())
+					}
+				}
+			}
+			if got := b.State(); got != tt.want {
+				t.Errorf("State() = %s, want %s", got, tt.want)
+			}
+			if !slices.Equal(transitions, tt.transitions) {
+				t.Errorf("transitions = %v, want %v", transitions, tt.transitions)
+			}
+		})
+	}
+}
+
+func TestBreakerWait(t *testing.T) {
+	b := NewBreaker(1, time.Hour)
+	b.Failure()
+	ok, wait := b.Allow()
+	if ok || wait <= 59*time.Minute || wait > time.Hour {
+		t.Errorf("Allow() = %v, %s, want refused for the rest of the cool-down", ok, wait)
+	}
+}
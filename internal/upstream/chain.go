@@ -0,0 +1,227 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"ubuntuhive.tech/gonovella/internal/logging"
+)
+
+// errLostRace stops an attempt whose answer is no longer wanted.
+var errLostRace = errors.New("another route answered first")
+
+// Route is one provider and model pair in a fallback chain.
+type Route struct {
+	Client *Client
+	Model  string
+
+	// Budget is how long the route may take to produce its first token
+	// (or its whole answer, when not streaming) before the chain moves on.
+	// Zero means no budget.
+	Budget time.Duration
+}
+
+// Chain tries its routes in order until one answers.
+type Chain struct {
+	Routes []Route
+
+	// Hedge, when positive, starts the next route in parallel if the
+	// current one has not produced a token after this long. The first
+	// route to produce a token wins and the others are cancelled.
+	Hedge time.Duration
+}
+
+// Single returns a chain with one route and no fallback.
+func Single(client *Client, model string) *Chain {
+	return &Chain{Routes: []Route{{Client: client, Model: model}}}
+}
+
+// WithModel returns a chain asking for model: the routes serving it when
+// there are any, otherwise every route with its model replaced.
+func (ch *Chain) WithModel(model string) *Chain {
+	chain := &Chain{Hedge: ch.Hedge}
+	for _, route := range ch.Routes {
+		if route.Model == model {
+			chain.Routes = append(chain.Routes, route)
+		}
+	}
+	if len(chain.Routes) > 0 {
+		return chain
+	}
+	for _, route := range ch.Routes {
+		route.Model = model
+		chain.Routes = append(chain.Routes, route)
+	}
+	return chain
+}
+
+// Complete returns the first full answer any route gives.
+func (ch *Chain) Complete(ctx context.Context, req Request) (Result, error) {
+	return ch.race(ctx, req, func(ctx context.Context, route Route, req Request, claim func() bool) (Result, error) {
+		result, err := route.Client.Complete(ctx, req)
+		if err == nil && !claim() {
+			return result, errLostRace
+		}
+		return result, err
+	})
+}
+
+// Stream relays the deltas of the first route to produce a token.
+func (ch *Chain) Stream(ctx context.Context, req Request, onDelta func(string) error) (Result, error) {
+	return ch.race(ctx, req, func(ctx context.Context, route Route, req Request, claim func() bool) (Result, error) {
+		return route.Client.Stream(ctx, req, func(content string) error {
+			if !claim() {
+				return errLostRace
+			}
+			return onDelta(content)
+		})
+	})
+}
+
+type outcome struct {
+	route  int
+	result Result
+	err    error
+}
+
+// race runs attempts over the routes. An attempt calls claim once it has
+// output; the first attempt to claim wins and every other one is cancelled.
+func (ch *Chain) race(ctx context.Context, req Request, attempt func(context.Context, Route, Request, func() bool) (Result, error)) (Result, error) {
+	if len(ch.Routes) == 0 {
+		return Result{}, fmt.Errorf("no upstream routes configured")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu      sync.Mutex
+		winner  = -1
+		cancels = make([]context.CancelFunc, len(ch.Routes))
+	)
+	outcomes := make(chan outcome, len(ch.Routes))
+
+	// claim makes route i the winner unless another route already is
+	claim := func(i int) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if winner == -1 {
+			winner = i
+			for j, cancelAttempt := range cancels {
+				if j != i && cancelAttempt != nil {
+					cancelAttempt()
+				}
+			}
+		}
+		return winner == i
+	}
+
+	next, running := 0, 0
+	launch := func() bool {
+		if next >= len(ch.Routes) {
+			return false
+		}
+		i, route := next, ch.Routes[next]
+		next++
+		running++
+
+		attemptCtx, cancelAttempt := context.WithCancel(ctx)
+		mu.Lock()
+		cancels[i] = cancelAttempt
+		mu.Unlock()
+
+		routeReq := req
+		if route.Model != "" {
+			routeReq.Model = route.Model
+		}
+
+		var overBudget bool
+		var budget *time.Timer
+		if route.Budget > 0 {
+			budget = time.AfterFunc(route.Budget, func() {
+				mu.Lock()
+				defer mu.Unlock()
+				if winner == -1 {
+					overBudget = true
+					cancelAttempt()
+				}
+			})
+		}
+
+		go func() {
+			defer cancelAttempt()
+			result, err := attempt(attemptCtx, route, routeReq, func() bool {
+				if budget != nil {
+					budget.Stop()
+				}
+				return claim(i)
+			})
+			mu.Lock()
+			if overBudget {
+				err = &Error{Kind: KindTimeout, Message: fmt.Sprintf("%s/%s exceeded its %s latency budget", route.Client.Name, routeReq.Model, route.Budget)}
+			}
+			mu.Unlock()
+			outcomes <- outcome{route: i, result: result, err: err}
+		}()
+		return true
+	}
+
+	var hedge <-chan time.Time
+	resetHedge := func() {
+		if ch.Hedge > 0 && next < len(ch.Routes) {
+			hedge = time.After(ch.Hedge)
+		} else {
+			hedge = nil
+		}
+	}
+
+	launch()
+	resetHedge()
+
+	var lastErr error
+	for running > 0 {
+		select {
+		case o := <-outcomes:
+			running--
+
+			mu.Lock()
+			won := winner
+			mu.Unlock()
+
+			o.result.Fallback = o.route > 0
+			switch {
+			case won == o.route:
+				return o.result, o.err
+			case won != -1:
+				// A loser finishing after being cancelled
+				continue
+			case o.err == nil:
+				// Finished without producing any output
+				if claim(o.route) {
+					return o.result, nil
+				}
+				continue
+			}
+
+			lastErr = o.err
+			route := ch.Routes[o.route]
+			logging.From(ctx).Warn("upstream route failed", "provider", route.Client.Name, "model", route.Model, "error", o.err)
+			fallbacksTotal.Inc()
+			if running == 0 && launch() {
+				resetHedge()
+			}
+		case <-hedge:
+			mu.Lock()
+			won := winner
+			mu.Unlock()
+			if won == -1 && launch() {
+				hedgesTotal.Inc()
+			}
+			resetHedge()
+		}
+	}
+	return Result{}, lastErr
+}
@@ -0,0 +1,392 @@
+// Package upstream talks to an OpenAI compatible chat completions API on
+// behalf of the CLI and the demo servers. It classifies failures, retries
+// the transient ones with jittered exponential backoff and stops calling a
+// provider that keeps failing.
+package upstream
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"ubuntuhive.tech/gonovella/internal/logging"
+	"ubuntuhive.tech/gonovella/internal/requestid"
+	"ubuntuhive.tech/gonovella/internal/tracing"
+	"ubuntuhive.tech/gonovella/internal/usage"
+)
+
+// ImageURL points at an image, usually a base64 data URL.
+type ImageURL struct {
+	URL string `json:"url"`
+}
+
+// Part is one piece of message content.
+type Part struct {
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageURL *ImageURL `json:"image_url,omitempty"`
+}
+
+// Message is one turn of a conversation.
+type Message struct {
+	Role    string `json:"role"`
+	Content []Part `json:"content"`
+}
+
+// Request is a chat completion request.
+type Request struct {
+	Model     string
+	MaxTokens int
+	Messages  []Message
+}
+
+// UserMessage asks prompt about the given images.
+func UserMessage(prompt string, imageURLs ...string) Message {
+	parts := []Part{{Type: "text", Text: prompt}}
+	for _, url := range imageURLs {
+		parts = append(parts, Part{Type: "image_url", ImageURL: &ImageURL{URL: url}})
+	}
+	return Message{Role: "user", Content: parts}
+}
+
+// SystemMessage instructs the model for the whole conversation.
+func SystemMessage(text string) Message {
+	return Message{Role: "system", Content: []Part{{Type: "text", Text: text}}}
+}
+
+// AssistantMessage is an earlier answer of the model, such as the answer
+// of a few-shot example.
+func AssistantMessage(text string) Message {
+	return Message{Role: "assistant", Content: []Part{{Type: "text", Text: text}}}
+}
+
+// Result is the answer to a request and who gave it.
+type Result struct {
+	Text     string
+	Provider string
+	Model    string
+	Usage    usage.Usage // token counts; the cost is left to the caller's price table
+	Fallback bool        // answered by a route after the first of its chain
+}
+
+// Client calls the chat completions endpoint.
+type Client struct {
+	Name       string // provider name reported in results
+	URL        string
+	APIKey     string
+	HTTPClient *http.Client
+	Retry      RetryPolicy
+	Breaker    *Breaker
+
+	// Timeout bounds each non-streaming attempt. Streams are bounded by the
+	// transport's response header timeout and the caller's context instead.
+	Timeout time.Duration
+}
+
+// New returns a client with default retry, breaker and timeout settings.
+func New(url, apiKey string) *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = 60 * time.Second
+
+	client := &Client{
+		Name:       "openai",
+		URL:        url,
+		APIKey:     apiKey,
+		HTTPClient: &http.Client{Transport: transport},
+		Retry:      DefaultRetryPolicy,
+		Breaker:    NewBreaker(5, 30*time.Second),
+		Timeout:    2 * time.Minute,
+	}
+	client.Breaker.OnStateChange = func(from, to State) {
+		slog.Warn("upstream circuit breaker changed state", "provider", client.Name, "from", from, "to", to)
+		breakerTransitions.WithLabelValues(client.Name, string(to)).Inc()
+	}
+	return client
+}
+
+// Complete returns the full answer to req.
+func (c *Client) Complete(ctx context.Context, req Request) (result Result, err error) {
+	ctx, span := tracing.Start(ctx, "upstream.request", c.spanAttributes(req, "complete")...)
+	defer func() {
+		span.SetAttributes(resultAttributes(result)...)
+		tracing.End(span, err)
+	}()
+
+	result = Result{Provider: c.Name, Model: req.Model}
+	start := time.Now()
+	err = c.do(ctx, func(ctx context.Context) (bool, error) {
+		if c.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+			defer cancel()
+		}
+
+		resp, err := c.send(ctx, req, false)
+		if err != nil {
+			return false, err
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return false, transportError(err)
+		}
+
+		content := gjson.GetBytes(body, "choices.0.message.content")
+		if !content.Exists() {
+			return false, &Error{Kind: KindMalformed, StatusCode: resp.StatusCode, Message: "response has no message content"}
+		}
+		result.Text = content.String()
+		if model := gjson.GetBytes(body, "model").String(); model != "" {
+			result.Model = model
+		}
+		result.Usage = parseUsage(gjson.GetBytes(body, "usage"))
+		return false, nil
+	})
+	callDuration.WithLabelValues(c.Name, req.Model, "complete", outcomeLabel(err)).Observe(time.Since(start).Seconds())
+	return result, err
+}
+
+// Stream calls onDelta with each piece of the answer as it arrives and
+// returns the full answer. Failures before the first piece are retried;
+// once content has been delivered a failure is returned as is.
+func (c *Client) Stream(ctx context.Context, req Request, onDelta func(string) error) (result Result, err error) {
+	ctx, span := tracing.Start(ctx, "upstream.request", c.spanAttributes(req, "stream")...)
+	defer func() {
+		span.SetAttributes(resultAttributes(result)...)
+		tracing.End(span, err)
+	}()
+
+	// The wait for the first token and the rest of the stream get a span each
+	_, waiting := tracing.Start(ctx, "upstream.first_token")
+	var streaming trace.Span
+	defer func() {
+		if streaming == nil {
+			tracing.End(waiting, err)
+		} else {
+			tracing.End(streaming, err)
+		}
+	}()
+
+	result = Result{Provider: c.Name, Model: req.Model}
+	var (
+		answer     strings.Builder
+		start      = time.Now()
+		firstToken time.Time
+	)
+	err = c.do(ctx, func(ctx context.Context) (bool, error) {
+		resp, err := c.send(ctx, req, true)
+		if err != nil {
+			return false, err
+		}
+		defer resp.Body.Close()
+
+		// Use bufio to read response line by line
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+
+			// OpenAI streams each chunk prefixed by "data:"
+			if !strings.HasPrefix(line, "data:") {
+				continue
+			}
+
+			// "data: [DONE]" indicates the end of the stream
+			jsonData := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+			if jsonData == "[DONE]" {
+				return answer.Len() > 0, nil
+			}
+
+			chunk := gjson.Parse(jsonData)
+			if msg := chunk.Get("error.message"); msg.Exists() {
+				return answer.Len() > 0, &Error{Kind: KindServer, Message: msg.String()}
+			}
+			if model := chunk.Get("model").String(); model != "" {
+				result.Model = model
+			}
+			// With include_usage the last chunk carries the usage and no choices
+			if u := chunk.Get("usage"); u.IsObject() {
+				result.Usage = parseUsage(u)
+			}
+
+			// The relevant content is in "choices" -> array -> "delta" -> "content"
+			content := ""
+			for _, choice := range chunk.Get("choices").Array() {
+				content += choice.Get("delta.content").String()
+			}
+			if content == "" {
+				continue
+			}
+			if answer.Len() == 0 {
+				firstToken = time.Now()
+				timeToFirstToken.WithLabelValues(c.Name, req.Model).Observe(firstToken.Sub(start).Seconds())
+				waiting.End()
+				_, streaming = tracing.Start(ctx, "upstream.stream_completion")
+			}
+			answer.WriteString(content)
+			if err := onDelta(content); err != nil {
+				return true, err
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return answer.Len() > 0, transportError(err)
+		}
+		// A stream cut short of [DONE] is not a whole answer
+		return answer.Len() > 0, transportError(fmt.Errorf("stream ended before [DONE]: %w", io.ErrUnexpectedEOF))
+	})
+	result.Text = answer.String()
+	callDuration.WithLabelValues(c.Name, req.Model, "stream", outcomeLabel(err)).Observe(time.Since(start).Seconds())
+	if elapsed := time.Since(firstToken).Seconds(); err == nil && !firstToken.IsZero() && elapsed > 0 && result.Usage.CompletionTokens > 0 {
+		tokensPerSecond.WithLabelValues(c.Name, req.Model).Observe(float64(result.Usage.CompletionTokens) / elapsed)
+	}
+	return result, err
+}
+
+// do runs attempt under the retry policy and circuit breaker. attempt
+// reports whether it delivered output, after which it is never repeated.
+func (c *Client) do(ctx context.Context, attempt func(context.Context) (bool, error)) error {
+	maxAttempts := max(c.Retry.MaxAttempts, 1)
+	for n := 1; ; n++ {
+		if c.Breaker != nil {
+			if ok, wait := c.Breaker.Allow(); !ok {
+				failuresTotal.WithLabelValues(c.Name, string(KindCircuitOpen)).Inc()
+				return &Error{Kind: KindCircuitOpen, Message: ErrCircuitOpen.Message, RetryAfter: wait}
+			}
+		}
+
+		attemptsTotal.WithLabelValues(c.Name).Inc()
+		delivered, err := attempt(ctx)
+		if err != nil && ctx.Err() != nil {
+			// The caller gave up, which says nothing about the provider
+			if c.Breaker != nil {
+				c.Breaker.Release()
+			}
+			return transportError(ctx.Err())
+		}
+		if err == nil {
+			if c.Breaker != nil {
+				c.Breaker.Success()
+			}
+			return nil
+		}
+
+		var uerr *Error
+		if !errors.As(err, &uerr) {
+			// Errors from the caller's callback say nothing about the provider
+			if c.Breaker != nil {
+				c.Breaker.Success()
+			}
+			return err
+		}
+		failuresTotal.WithLabelValues(c.Name, string(uerr.Kind)).Inc()
+		if c.Breaker != nil {
+			if uerr.Retryable() {
+				c.Breaker.Failure()
+			} else {
+				c.Breaker.Success()
+			}
+		}
+
+		if !uerr.Retryable() || delivered || n >= maxAttempts || ctx.Err() != nil {
+			logging.From(ctx).Error("upstream call failed", "provider", c.Name, "attempt", n, "max_attempts", maxAttempts, "error", err)
+			return err
+		}
+
+		delay := c.Retry.Delay(n, uerr.RetryAfter)
+		logging.From(ctx).Warn("upstream attempt failed, retrying", "provider", c.Name, "attempt", n, "max_attempts", maxAttempts, "delay", delay, "error", err)
+		retriesTotal.WithLabelValues(c.Name).Inc()
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return transportError(ctx.Err())
+		}
+	}
+}
+
+// send posts req and returns the response when the provider answered 200.
+func (c *Client) send(ctx context.Context, req Request, stream bool) (*http.Response, error) {
+	payload := map[string]any{
+		"model":      req.Model,
+		"max_tokens": req.MaxTokens,
+		"messages":   req.Messages,
+	}
+	if stream {
+		payload["stream"] = true // Enable streaming
+		payload["stream_options"] = map[string]any{"include_usage": true}
+	}
+	requestBody, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("Error marshalling JSON: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", c.URL, bytes.NewBuffer(requestBody))
+	if err != nil {
+		return nil, fmt.Errorf("Error creating request: %w", err)
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+c.APIKey)
+	httpReq.Header.Set("Content-Type", "application/json")
+	tracing.Inject(ctx, httpReq.Header)
+	if id := requestid.FromContext(ctx); id != "" {
+		httpReq.Header.Set(requestid.Header, id)
+	}
+	logging.From(ctx).Debug("upstream request", "provider", c.Name, "url", c.URL, "model", req.Model, "stream", stream, "headers", httpReq.Header)
+
+	resp, err := c.HTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, transportError(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		message := gjson.GetBytes(body, "error.message").String()
+		if message == "" {
+			message = strings.TrimSpace(string(body))
+		}
+		if message == "" {
+			message = http.StatusText(resp.StatusCode)
+		}
+		return nil, statusError(resp, message)
+	}
+	return resp, nil
+}
+
+// spanAttributes describes a call on its span.
+func (c *Client) spanAttributes(req Request, mode string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("gen_ai.system", c.Name),
+		attribute.String("gen_ai.request.model", req.Model),
+		attribute.Int("gen_ai.request.max_tokens", req.MaxTokens),
+		attribute.String("upstream.mode", mode),
+		attribute.String("server.address", c.URL),
+	}
+}
+
+// resultAttributes records who answered and the tokens it took.
+func resultAttributes(result Result) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("gen_ai.response.model", result.Model),
+		attribute.Int("gen_ai.usage.input_tokens", result.Usage.PromptTokens),
+		attribute.Int("gen_ai.usage.output_tokens", result.Usage.CompletionTokens),
+	}
+}
+
+// parseUsage reads an OpenAI usage object.
+func parseUsage(u gjson.Result) usage.Usage {
+	return usage.Usage{
+		PromptTokens:     int(u.Get("prompt_tokens").Int()),
+		CompletionTokens: int(u.Get("completion_tokens").Int()),
+		TotalTokens:      int(u.Get("total_tokens").Int()),
+	}
+}
@@ -0,0 +1,47 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStreamEnd(t *testing.T) {
+	tests := []struct {
+		name    string
+		done    bool
+		wantErr bool
+	}{
+		{"ends with done", true, false},
+		{"cut short", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				fmt.Fprintln(w, `data: {"model":"m","choices":[{"delta":{"content":"A cat"}}]}`)
+				if tt.done {
+					fmt.Fprintln(w, "data: [DONE]")
+				}
+			}))
+			defer server.Close()
+
+			client := New(server.URL, "")
+			client.Retry.MaxAttempts = 1
+			result, err := client.Stream(context.Background(), Request{Model: "m"}, func(string) error { return nil })
+			if !tt.wantErr {
+				if err != nil || result.Text != "A cat" {
+					t.Fatalf("Stream() = %q, %v, want the answer", result.Text, err)
+				}
+				return
+			}
+			var uerr *Error
+			if !errors.As(err, &uerr) || uerr.Kind != KindNetwork {
+				t.Fatalf("Stream() error = %v, want a network error", err)
+			}
+		})
+	}
+}
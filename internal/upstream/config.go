@@ -0,0 +1,103 @@
+package upstream
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config describes a fallback chain, usually loaded from a YAML file:
+//
+//	hedge: 3s
+//	routes:
+//	  - provider: openai
+//	    url: https://api.openai.com/v1/chat/completions
+//	    api_key_env: OPENAI_API_KEY
+//	    model: gpt-4o
+//	    budget: 20s
+//	  - provider: openai
+//	    model: gpt-4o-mini
+//	  - provider: ollama
+//	    url: http://localhost:11434/v1/chat/completions
+//	    model: llava
+//
+// Routes without a url inherit the url of the previous route, and its
+// api_key_env unless they set their own; a route with a url of its own
+// never inherits a key. Routes calling the default endpoint without an
+// api_key_env use the default key; other routes send none.
+type Config struct {
+	Hedge  time.Duration `yaml:"hedge"`
+	Routes []RouteConfig `yaml:"routes"`
+}
+
+// RouteConfig is one entry of Config.Routes.
+type RouteConfig struct {
+	Provider  string        `yaml:"provider"`
+	URL       string        `yaml:"url"`
+	APIKeyEnv string        `yaml:"api_key_env"`
+	Model     string        `yaml:"model"`
+	Budget    time.Duration `yaml:"budget"`
+}
+
+// LoadChain builds a chain from the YAML file at path. When path is empty
+// the chain has a single route calling url with apiKey and model.
+func LoadChain(path, url, apiKey, model string) (*Chain, error) {
+	if path == "" {
+		return Single(New(url, apiKey), model), nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading upstream config: %w", err)
+	}
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("error parsing upstream config: %w", err)
+	}
+	if len(config.Routes) == 0 {
+		return nil, fmt.Errorf("upstream config %s has no routes", path)
+	}
+
+	// Routes sharing a provider, endpoint and key share a client, and so a
+	// breaker
+	clients := make(map[string]*Client)
+	chain := &Chain{Hedge: config.Hedge}
+	for i, rc := range config.Routes {
+		// A key is only sent on to the endpoint it was configured for
+		if rc.URL == "" && i > 0 {
+			rc.URL = config.Routes[i-1].URL
+			if rc.APIKeyEnv == "" {
+				rc.APIKeyEnv = config.Routes[i-1].APIKeyEnv
+			}
+		}
+		if rc.URL == "" {
+			rc.URL = url
+		}
+		if rc.Model == "" {
+			return nil, fmt.Errorf("upstream route %d has no model", i+1)
+		}
+		config.Routes[i] = rc
+
+		// The default key only goes to the default endpoint
+		var key string
+		switch {
+		case rc.APIKeyEnv != "":
+			key = os.Getenv(rc.APIKeyEnv)
+		case rc.URL == url:
+			key = apiKey
+		}
+		id := rc.Provider + " " + rc.URL + " " + rc.APIKeyEnv
+		client, ok := clients[id]
+		if !ok {
+			client = New(rc.URL, key)
+			if rc.Provider != "" {
+				client.Name = rc.Provider
+			}
+			clients[id] = client
+		}
+		chain.Routes = append(chain.Routes, Route{Client: client, Model: rc.Model, Budget: rc.Budget})
+	}
+	return chain, nil
+}
@@ -0,0 +1,63 @@
+package upstream
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadChainKeys(t *testing.T) {
+	const defaultURL = "https://api.openai.com/v1/chat/completions"
+	t.Setenv("OTHER_API_KEY", "other-key")
+
+	config := `routes:
+  - provider: openai
+    model: gpt-4o
+  - provider: ollama
+    url: http://localhost:11434/v1/chat/completions
+    model: llava
+  - provider: other
+    url: https://other.example/v1/chat/completions
+    api_key_env: OTHER_API_KEY
+    model: other-model
+  - provider: other
+    model: other-mini
+  - provider: local
+    url: http://localhost:8000/v1/chat/completions
+    model: local
+`
+	path := filepath.Join(t.TempDir(), "upstream.yaml")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	chain, err := LoadChain(path, defaultURL, "default-key", "gpt-4o")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		url  string
+		key  string
+	}{
+		{"default endpoint", defaultURL, "default-key"},
+		{"own url without api_key_env", "http://localhost:11434/v1/chat/completions", ""},
+		{"own url with api_key_env", "https://other.example/v1/chat/completions", "other-key"},
+		{"inherited url and api_key_env", "https://other.example/v1/chat/completions", "other-key"},
+		{"own url after a keyed route", "http://localhost:8000/v1/chat/completions", ""},
+	}
+	if len(chain.Routes) != len(tests) {
+		t.Fatalf("%d routes, want %d", len(chain.Routes), len(tests))
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := chain.Routes[i].Client
+			if client.URL != tt.url || client.APIKey != tt.key {
+				t.Errorf("route %d calls %s with key %q, want %s with %q", i+1, client.URL, client.APIKey, tt.url, tt.key)
+			}
+		})
+	}
+	if chain.Routes[2].Client != chain.Routes[3].Client {
+		t.Error("routes sharing a provider, url and key do not share a client")
+	}
+}
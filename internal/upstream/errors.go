@@ -0,0 +1,134 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Kind classifies why an upstream call failed.
+type Kind string
+
+const (
+	KindRateLimited Kind = "rate_limited" // 429
+	KindServer      Kind = "server"       // 5xx
+	KindNetwork     Kind = "network"      // connection or read failure
+	KindTimeout     Kind = "timeout"      // deadline exceeded
+	KindClient      Kind = "client"       // 4xx other than 429, not worth retrying
+	KindAuth        Kind = "auth"         // 401 or 403
+	KindMalformed   Kind = "malformed"    // 200 without usable content
+	KindCircuitOpen Kind = "circuit_open" // breaker refused the call
+	KindOverloaded  Kind = "overloaded"   // our own queue for upstream calls is full
+)
+
+// ErrCircuitOpen is returned without calling the provider while the breaker is open.
+var ErrCircuitOpen = &Error{Kind: KindCircuitOpen, Message: "upstream circuit breaker is open"}
+
+// Error is a classified upstream failure.
+type Error struct {
+	Kind       Kind
+	StatusCode int
+	RetryAfter time.Duration
+	Message    string
+	Err        error
+}
+
+func (e *Error) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("upstream %s error (status %d): %s", e.Kind, e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("upstream %s error: %s", e.Kind, e.Message)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Retryable reports whether repeating the call may succeed.
+func (e *Error) Retryable() bool {
+	switch e.Kind {
+	case KindRateLimited, KindServer, KindNetwork, KindTimeout:
+		return true
+	}
+	return false
+}
+
+// HTTPStatus maps an upstream failure to the status our own API should answer with.
+func HTTPStatus(err error) int {
+	var uerr *Error
+	if !errors.As(err, &uerr) {
+		return http.StatusInternalServerError
+	}
+	switch uerr.Kind {
+	case KindRateLimited:
+		return http.StatusTooManyRequests
+	case KindCircuitOpen, KindOverloaded:
+		return http.StatusServiceUnavailable
+	case KindTimeout:
+		return http.StatusGatewayTimeout
+	case KindClient:
+		return http.StatusBadRequest
+	}
+	return http.StatusBadGateway
+}
+
+// RetryAfter returns how long the caller should wait before trying again, if known.
+func RetryAfter(err error) time.Duration {
+	var uerr *Error
+	if errors.As(err, &uerr) {
+		return uerr.RetryAfter
+	}
+	return 0
+}
+
+// statusError classifies a non-200 response.
+func statusError(resp *http.Response, message string) *Error {
+	e := &Error{
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		Message:    message,
+	}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		e.Kind = KindRateLimited
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		e.Kind = KindAuth
+	case resp.StatusCode == http.StatusRequestTimeout:
+		e.Kind = KindTimeout
+	case resp.StatusCode >= 500:
+		e.Kind = KindServer
+	default:
+		e.Kind = KindClient
+	}
+	return e
+}
+
+// transportError classifies a failure to reach the provider or read its answer.
+func transportError(err error) *Error {
+	kind := KindNetwork
+	if errors.Is(err, context.DeadlineExceeded) {
+		kind = KindTimeout
+	} else if ne, ok := err.(interface{ Timeout() bool }); ok && ne.Timeout() {
+		kind = KindTimeout
+	}
+	return &Error{Kind: kind, Message: err.Error(), Err: err}
+}
+
+// parseRetryAfter understands both delay-seconds and HTTP-date values.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
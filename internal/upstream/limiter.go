@@ -0,0 +1,150 @@
+package upstream
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter bounds how many upstream calls run at once. Callers beyond the
+// limit wait in a FIFO queue of bounded length and are told their position
+// as it changes; once the queue is full they are turned away straight away.
+// A nil *Limiter admits every call.
+type Limiter struct {
+	// MaxWait bounds the time spent queued; zero waits as long as the
+	// caller's context allows.
+	MaxWait time.Duration
+
+	mu       sync.Mutex
+	slots    int
+	busy     int
+	maxQueue int
+	queue    []*waiter
+}
+
+type waiter struct {
+	ready chan struct{} // closed when the waiter is handed a slot
+	moved chan int      // latest queue position, buffered
+}
+
+// NewLimiter returns a limiter running at most slots calls at once with up
+// to queue callers waiting. It returns nil when slots is not positive.
+func NewLimiter(slots, queue int) *Limiter {
+	if slots <= 0 {
+		return nil
+	}
+	return &Limiter{slots: slots, maxQueue: max(queue, 0)}
+}
+
+// ErrOverloaded is returned when the wait queue is full or the wait took too long.
+var ErrOverloaded = &Error{Kind: KindOverloaded, RetryAfter: time.Second, Message: "too many upstream calls in progress"}
+
+// Acquire takes a slot, waiting in the queue if none is free. onQueued, if
+// not nil, is called with the 1-based queue position when the caller joins
+// the queue and again whenever it moves up. The returned release function
+// must be called once the upstream call is done.
+func (l *Limiter) Acquire(ctx context.Context, onQueued func(position int)) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	if l.busy < l.slots && len(l.queue) == 0 {
+		l.busy++
+		l.mu.Unlock()
+		inFlightGauge.Inc()
+		return l.releaser(), nil
+	}
+	if len(l.queue) >= l.maxQueue {
+		l.mu.Unlock()
+		queueRejected.Inc()
+		return nil, ErrOverloaded
+	}
+	w := &waiter{ready: make(chan struct{}), moved: make(chan int, 1)}
+	l.queue = append(l.queue, w)
+	position := len(l.queue)
+	queueDepthGauge.Inc()
+	l.mu.Unlock()
+
+	start := time.Now()
+	defer func() {
+		queueWait.Observe(time.Since(start).Seconds())
+	}()
+
+	var timeout <-chan time.Time
+	if l.MaxWait > 0 {
+		timer := time.NewTimer(l.MaxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		if onQueued != nil {
+			onQueued(position)
+		}
+		select {
+		case <-w.ready:
+			inFlightGauge.Inc()
+			return l.releaser(), nil
+		case position = <-w.moved:
+		case <-ctx.Done():
+			return nil, l.leave(w, ctx.Err())
+		case <-timeout:
+			queueRejected.Inc()
+			return nil, l.leave(w, ErrOverloaded)
+		}
+	}
+}
+
+// leave takes w out of the queue. If w was handed a slot in the meantime
+// the slot is passed on instead.
+func (l *Limiter) leave(w *waiter, err error) error {
+	l.mu.Lock()
+	for i, queued := range l.queue {
+		if queued == w {
+			l.queue = append(l.queue[:i], l.queue[i+1:]...)
+			queueDepthGauge.Dec()
+			l.notify()
+			l.mu.Unlock()
+			return err
+		}
+	}
+	l.mu.Unlock()
+
+	// Already granted: give the slot back
+	inFlightGauge.Inc()
+	l.releaser()()
+	return err
+}
+
+func (l *Limiter) releaser() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			inFlightGauge.Dec()
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if len(l.queue) == 0 {
+				l.busy--
+				return
+			}
+			// Hand the slot straight to the head of the queue
+			next := l.queue[0]
+			l.queue = l.queue[1:]
+			queueDepthGauge.Dec()
+			close(next.ready)
+			l.notify()
+		})
+	}
+}
+
+// notify tells every waiter its current position. Called with mu held.
+func (l *Limiter) notify() {
+	for i, w := range l.queue {
+		select {
+		case <-w.moved:
+		default:
+		}
+		w.moved <- i + 1
+	}
+}
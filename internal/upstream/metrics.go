@@ -0,0 +1,93 @@
+package upstream
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics, served by any server that mounts metrics.Handler
+var (
+	callDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "upstream_request_duration_seconds",
+		Help:    "Time for an upstream call, retries included, by provider, model, mode and outcome.",
+		Buckets: []float64{.25, .5, 1, 2.5, 5, 10, 20, 30, 60, 120},
+	}, []string{"provider", "model", "mode", "outcome"})
+
+	timeToFirstToken = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "upstream_time_to_first_token_seconds",
+		Help:    "Time from starting a stream to its first content, by provider and model.",
+		Buckets: []float64{.1, .25, .5, 1, 2, 4, 8, 15, 30},
+	}, []string{"provider", "model"})
+
+	tokensPerSecond = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "upstream_stream_tokens_per_second",
+		Help:    "Completion tokens per second after the first token of a stream, by provider and model.",
+		Buckets: []float64{5, 10, 20, 40, 60, 80, 120, 200},
+	}, []string{"provider", "model"})
+
+	attemptsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "upstream_attempts_total",
+		Help: "Upstream call attempts by provider.",
+	}, []string{"provider"})
+
+	retriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "upstream_retries_total",
+		Help: "Upstream attempts repeated after a transient failure, by provider.",
+	}, []string{"provider"})
+
+	failuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "upstream_failures_total",
+		Help: "Failed upstream attempts by provider and failure kind.",
+	}, []string{"provider", "kind"})
+
+	breakerTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "upstream_breaker_transitions_total",
+		Help: "Circuit breaker state changes by provider and new state.",
+	}, []string{"provider", "state"})
+
+	fallbacksTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "upstream_fallbacks_total",
+		Help: "Routes of a fallback chain that failed and handed over to the next.",
+	})
+
+	hedgesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "upstream_hedges_total",
+		Help: "Routes started in parallel because the current one was slow.",
+	})
+
+	inFlightGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "upstream_in_flight",
+		Help: "Upstream calls holding a limiter slot.",
+	})
+
+	queueDepthGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "upstream_queue_depth",
+		Help: "Callers waiting for a limiter slot.",
+	})
+
+	queueWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "upstream_queue_wait_seconds",
+		Help:    "Time callers spent queued for a limiter slot.",
+		Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	})
+
+	queueRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "upstream_queue_rejected_total",
+		Help: "Callers turned away because the limiter queue was full or the wait too long.",
+	})
+)
+
+// outcomeLabel labels how a call ended: "ok", the kind of upstream failure, or
+// "aborted" when the caller stopped it.
+func outcomeLabel(err error) string {
+	var uerr *Error
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.As(err, &uerr):
+		return string(uerr.Kind)
+	}
+	return "aborted"
+}
@@ -0,0 +1,37 @@
+package upstream
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// RetryPolicy controls how failed calls are repeated.
+type RetryPolicy struct {
+	MaxAttempts   int           // total attempts, including the first
+	BaseDelay     time.Duration // delay before the first retry
+	MaxDelay      time.Duration // cap on any single delay
+	MaxRetryAfter time.Duration // cap on a provider supplied Retry-After
+}
+
+// DefaultRetryPolicy makes three attempts with jittered exponential backoff.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:   3,
+	BaseDelay:     500 * time.Millisecond,
+	MaxDelay:      10 * time.Second,
+	MaxRetryAfter: 30 * time.Second,
+}
+
+// Delay returns how long to wait before the given retry (1 for the first).
+// A Retry-After from the provider wins over the computed backoff.
+func (p RetryPolicy) Delay(retry int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return min(retryAfter, p.MaxRetryAfter)
+	}
+
+	backoff := p.BaseDelay << (retry - 1)
+	if backoff <= 0 || backoff > p.MaxDelay {
+		backoff = p.MaxDelay
+	}
+	// Full jitter spreads retries from many clients over the whole window
+	return time.Duration(rand.Int64N(int64(backoff)) + 1)
+}
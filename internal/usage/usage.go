@@ -0,0 +1,135 @@
+// Package usage counts the tokens each extraction spends, prices them from
+// a configurable table and aggregates the totals per caller.
+package usage
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Usage is the token count of a single request and its estimated cost.
+type Usage struct {
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	TotalTokens      int     `json:"total_tokens"`
+	CostUSD          float64 `json:"cost_usd"`
+}
+
+// Price is what a model charges, in USD per million tokens.
+type Price struct {
+	Input  float64 `yaml:"input" json:"input"`
+	Output float64 `yaml:"output" json:"output"`
+}
+
+// PriceTable maps model names to prices. A model without an exact entry
+// uses the longest entry it starts with, so "gpt-4o-2024-08-06" is priced
+// as "gpt-4o".
+type PriceTable map[string]Price
+
+// DefaultPrices are list prices at the time of writing.
+var DefaultPrices = PriceTable{
+	"gpt-4o":      {Input: 2.50, Output: 10.00},
+	"gpt-4o-mini": {Input: 0.15, Output: 0.60},
+}
+
+// LoadPrices reads a YAML price table such as:
+//
+//	gpt-4o:      {input: 2.50, output: 10.00}
+//	gpt-4o-mini: {input: 0.15, output: 0.60}
+//
+// An empty path returns DefaultPrices.
+func LoadPrices(path string) (PriceTable, error) {
+	if path == "" {
+		return DefaultPrices, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading price table: %w", err)
+	}
+	var table PriceTable
+	if err := yaml.Unmarshal(data, &table); err != nil {
+		return nil, fmt.Errorf("error parsing price table: %w", err)
+	}
+	return table, nil
+}
+
+// Lookup returns the price for model.
+func (t PriceTable) Lookup(model string) (Price, bool) {
+	if price, ok := t[model]; ok {
+		return price, true
+	}
+	best, found := "", false
+	for name := range t {
+		if strings.HasPrefix(model, name) && len(name) > len(best) {
+			best, found = name, true
+		}
+	}
+	return t[best], found
+}
+
+// Apply fills in the estimated cost of u for model. Unknown models cost zero.
+func (t PriceTable) Apply(u *Usage, model string) {
+	price, _ := t.Lookup(model)
+	u.CostUSD = (float64(u.PromptTokens)*price.Input + float64(u.CompletionTokens)*price.Output) / 1_000_000
+}
+
+// String formats u for terminal output.
+func (u Usage) String() string {
+	return fmt.Sprintf("%d prompt + %d completion = %d tokens (~$%.4f)", u.PromptTokens, u.CompletionTokens, u.TotalTokens, u.CostUSD)
+}
+
+// Totals aggregates the usage of one caller.
+type Totals struct {
+	Key              string  `json:"key"`
+	Requests         int     `json:"requests"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	TotalTokens      int     `json:"total_tokens"`
+	CostUSD          float64 `json:"cost_usd"`
+}
+
+// Ledger aggregates usage per caller key in memory.
+type Ledger struct {
+	mu     sync.Mutex
+	totals map[string]*Totals
+}
+
+// NewLedger returns an empty ledger.
+func NewLedger() *Ledger {
+	return &Ledger{totals: make(map[string]*Totals)}
+}
+
+// Record adds one request's usage to key's totals.
+func (l *Ledger) Record(key string, u Usage) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	t, ok := l.totals[key]
+	if !ok {
+		t = &Totals{Key: key}
+		l.totals[key] = t
+	}
+	t.Requests++
+	t.PromptTokens += u.PromptTokens
+	t.CompletionTokens += u.CompletionTokens
+	t.TotalTokens += u.TotalTokens
+	t.CostUSD += u.CostUSD
+}
+
+// Report returns the totals of every caller, ordered by key.
+func (l *Ledger) Report() []Totals {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	report := make([]Totals, 0, len(l.totals))
+	for _, t := range l.totals {
+		report = append(report, *t)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Key < report[j].Key })
+	return report
+}
@@ -0,0 +1,110 @@
+package validate
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// WriteText writes one file:line:column line per error.
+func WriteText(w io.Writer, results []Result) error {
+	for _, r := range results {
+		for _, e := range r.Errors {
+			if _, err := fmt.Fprintf(w, "%s:%d:%d: %s\n", r.File, e.Line, e.Column, e.describe()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WriteJSON writes all results, valid ones included, as a JSON array.
+func WriteJSON(w io.Writer, results []Result) error {
+	if results == nil {
+		results = []Result{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(results)
+}
+
+// WriteGitHub writes GitHub Actions workflow commands, which annotate the
+// failing lines of a pull request.
+func WriteGitHub(w io.Writer, results []Result) error {
+	escape := strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A")
+	property := strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C")
+	for _, r := range results {
+		for _, e := range r.Errors {
+			_, err := fmt.Fprintf(w, "::error file=%s,line=%d,col=%d,title=%s::%s\n",
+				property.Replace(r.File), e.Line, e.Column, property.Replace(e.title()), escape.Replace(e.Message))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type junitSuite struct {
+	XMLName  xml.Name    `xml:"testsuite"`
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failures  []junitDetail `xml:"failure"`
+}
+
+type junitDetail struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// WriteJUnit writes a JUnit test suite named after the schema, with one
+// test case per document.
+func WriteJUnit(w io.Writer, schema string, results []Result) error {
+	suite := junitSuite{Name: "validate " + schema, Tests: len(results)}
+	for _, r := range results {
+		c := junitCase{Name: fmt.Sprintf("%s#%d", r.File, r.Document), ClassName: r.File}
+		for _, e := range r.Errors {
+			c.Failures = append(c.Failures, junitDetail{
+				Message: e.describe(),
+				Text:    fmt.Sprintf("%s:%d:%d: %s", r.File, e.Line, e.Column, e.describe()),
+			})
+		}
+		if !r.Valid() {
+			suite.Failures++
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suite); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func (e Error) title() string {
+	if e.Path == "" {
+		return "document"
+	}
+	return e.Path
+}
+
+func (e Error) describe() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
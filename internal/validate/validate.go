@@ -0,0 +1,250 @@
+// Package validate checks JSON, YAML and NDJSON documents against a CUE
+// definition and reports every failing path with its position in the input.
+package validate
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"cuelang.org/go/cue"
+	"cuelang.org/go/cue/ast"
+	"cuelang.org/go/cue/cuecontext"
+	cueerrors "cuelang.org/go/cue/errors"
+	"cuelang.org/go/cue/token"
+	cuejson "cuelang.org/go/encoding/json"
+	cueyaml "cuelang.org/go/encoding/yaml"
+	"gopkg.in/yaml.v3"
+	"ubuntuhive.tech/gonovella/internal/convert"
+)
+
+var ctx = cuecontext.New()
+
+// Schema is the CUE value documents are unified with.
+type Schema struct {
+	Name  string
+	value cue.Value
+}
+
+// Error is one failing path of a document. Line and Column point into the
+// input, or at the start of the document when the path is missing from it.
+type Error struct {
+	Path    string `json:"path"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Message string `json:"message"`
+}
+
+// Result is the outcome of validating one document. Document counts from 1
+// within its file.
+type Result struct {
+	File     string  `json:"file"`
+	Document int     `json:"document"`
+	Line     int     `json:"line"`
+	Errors   []Error `json:"errors,omitempty"`
+}
+
+// Valid reports whether the document passed.
+func (r Result) Valid() bool {
+	return len(r.Errors) == 0
+}
+
+// LoadSchema compiles the CUE file named by ref, which has the form
+// file.cue#Definition. Without a fragment the whole file is the schema.
+func LoadSchema(ref string) (*Schema, error) {
+	path, def, _ := strings.Cut(ref, "#")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading schema: %w", err)
+	}
+	v := ctx.CompileBytes(data, cue.Filename(path))
+	if err := v.Err(); err != nil {
+		return nil, fmt.Errorf("invalid schema %s: %w", path, err)
+	}
+	if def != "" {
+		v = v.LookupPath(cue.ParsePath("#" + def))
+		if !v.Exists() {
+			return nil, fmt.Errorf("schema %s has no definition #%s", path, def)
+		}
+		def = "#" + def
+	}
+	return &Schema{Name: def, value: v}, nil
+}
+
+// Validate checks every document of r, named name, in format, which must
+// be JSON, YAML or NDJSON.
+func (s *Schema) Validate(r io.Reader, name string, format convert.Format) ([]Result, error) {
+	var (
+		docs []ast.Expr
+		err  error
+	)
+	switch format {
+	case convert.JSON, convert.NDJSON:
+		docs, err = decodeJSON(r, name)
+	case convert.YAML:
+		docs, err = decodeYAML(r, name)
+	default:
+		return nil, fmt.Errorf("cannot validate %s documents (want json, yaml or ndjson)", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 {
+		return []Result{{File: name, Document: 1, Line: 1, Errors: []Error{{Line: 1, Column: 1, Message: "no documents"}}}}, nil
+	}
+
+	results := make([]Result, len(docs))
+	for i, doc := range docs {
+		start := position(doc)
+		results[i] = Result{File: name, Document: i + 1, Line: start.Line()}
+		data := ctx.BuildExpr(doc)
+		err := s.value.Unify(data).Validate(cue.Concrete(true))
+		results[i].Errors = sortErrors(append(s.errors(err, name), missing(s.value, data, nil, start)...))
+	}
+	return results, nil
+}
+
+// errors flattens err into one Error per path, positioned in the document.
+// Incomplete values that have no position in the document are missing
+// fields, which CUE leaves out when there are other errors, so those are
+// reported by missing instead.
+func (s *Schema) errors(err error, name string) []Error {
+	var list []Error
+	seen := map[string]bool{}
+	for _, e := range cueerrors.Errors(err) {
+		path := e.Path()
+		if len(path) > 0 && path[0] == s.Name {
+			path = path[1:]
+		}
+		format, args := e.Msg()
+		item := Error{Path: strings.Join(path, "."), Message: fmt.Sprintf(format, args...)}
+		pos := token.NoPos
+		for _, p := range append([]token.Pos{e.Position()}, e.InputPositions()...) {
+			if p.IsValid() && p.Filename() == name {
+				pos = p
+				break
+			}
+		}
+		if !pos.IsValid() && strings.HasPrefix(item.Message, "incomplete value") {
+			continue
+		}
+		item.Line, item.Column = pos.Line(), pos.Column()
+		if id := fmt.Sprint(item); !seen[id] {
+			seen[id] = true
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// missing reports the fields schema requires that data lacks, positioned at
+// the start of the enclosing struct. Fields with a default or a concrete
+// value in the schema are filled in by unification and not required.
+func missing(schema, data cue.Value, path []string, pos token.Pos) []Error {
+	if schema.IncompleteKind() != cue.StructKind || data.IncompleteKind() != cue.StructKind {
+		return nil
+	}
+	fields, err := schema.Fields()
+	if err != nil {
+		return nil
+	}
+	var list []Error
+	for fields.Next() {
+		field := append(path[:len(path):len(path)], fields.Selector().String())
+		value := data.LookupPath(cue.MakePath(fields.Selector()))
+		if value.Exists() {
+			list = append(list, missing(fields.Value(), value, field, value.Pos())...)
+			continue
+		}
+		if _, ok := fields.Value().Default(); ok || fields.Value().IsConcrete() {
+			continue
+		}
+		list = append(list, Error{
+			Path:    strings.Join(field, "."),
+			Line:    pos.Line(),
+			Column:  pos.Column(),
+			Message: "missing required field",
+		})
+	}
+	return list
+}
+
+func sortErrors(list []Error) []Error {
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Line != list[j].Line {
+			return list[i].Line < list[j].Line
+		}
+		return list[i].Column < list[j].Column
+	})
+	return list
+}
+
+func decodeJSON(r io.Reader, name string) ([]ast.Expr, error) {
+	dec := cuejson.NewDecoder(nil, name, r)
+	var docs []ast.Expr
+	for {
+		expr, err := dec.Extract()
+		if errors.Is(err, io.EOF) {
+			return docs, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+		docs = append(docs, expr)
+	}
+}
+
+// decodeYAML extracts each document of a YAML stream. CUE returns several
+// documents as one list, which is only told apart from a single list
+// document by counting the documents first.
+func decodeYAML(r io.Reader, name string) ([]ast.Expr, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	count := 0
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var doc yaml.Node
+		if err := dec.Decode(&doc); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid YAML: %w", err)
+		}
+		count++
+	}
+
+	file, err := cueyaml.Extract(name, data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid YAML: %w", err)
+	}
+	if count == 0 {
+		return nil, nil
+	}
+	var expr ast.Expr = &ast.StructLit{Elts: file.Decls}
+	if len(file.Decls) == 1 {
+		if embed, ok := file.Decls[0].(*ast.EmbedDecl); ok {
+			expr = embed.Expr
+		}
+	}
+	if list, ok := expr.(*ast.ListLit); ok && count > 1 {
+		return list.Elts, nil
+	}
+	return []ast.Expr{expr}, nil
+}
+
+// position returns where doc starts, falling back to its first field for
+// structs without braces, whose position only holds relative spacing.
+func position(doc ast.Expr) token.Pos {
+	if p := doc.Pos(); p.Line() > 0 {
+		return p
+	}
+	if s, ok := doc.(*ast.StructLit); ok && len(s.Elts) > 0 {
+		return s.Elts[0].Pos()
+	}
+	return token.NoPos
+}